@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultAPIListen is where the REST API listens unless the config says otherwise. Only
+// processes on the same machine can reach it.
+const defaultAPIListen = "localhost:8080"
+
+// defaultAPITokenFile holds the shared secret clients of the REST API authenticate with. The
+// MCP server reads it from here, next to messages.db.
+const defaultAPITokenFile = "store/api_token"
+
+// loadAPIToken reads the shared secret from path, creating a random one readable only by the
+// current user if the file doesn't exist yet
+func loadAPIToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("API token file %s is empty", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read API token file: %v", err)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate API token: %v", err)
+	}
+	token := hex.EncodeToString(secret)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create API token directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write API token file: %v", err)
+	}
+	fmt.Printf("Created API token in %s\n", path)
+	return token, nil
+}
+
+// requireAPIToken rejects requests that don't carry the token as "Authorization: Bearer <token>"
+func requireAPIToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			fmt.Printf("Rejected an unauthenticated %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="whatsapp-bridge"`)
+			http.Error(w, "Missing or invalid API token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenAPI opens the listener of the REST API: a unix socket for "unix:/path", otherwise a
+// TCP address, wrapped in TLS if a certificate is configured
+func listenAPI(config APIConfig) (net.Listener, error) {
+	var listener net.Listener
+	if socket, ok := strings.CutPrefix(config.Listen, "unix:"); ok {
+		// A socket left behind by a previous run would make Listen fail
+		if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(socket)
+		}
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(socket, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to restrict socket permissions: %v", err)
+		}
+		listener = l
+	} else {
+		l, err := net.Listen("tcp", config.Listen)
+		if err != nil {
+			return nil, err
+		}
+		listener = l
+	}
+
+	if config.TLS == nil {
+		return listener, nil
+	}
+	tlsConfig, err := config.TLS.serverConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// serverConfig loads the certificates of the TLS config. With a client CA, clients must
+// present a certificate it signed (mutual TLS).
+func (c *APITLSConfig) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// isLoopbackListen reports whether the listen address only accepts connections from this
+// machine
+func isLoopbackListen(listen string) bool {
+	if strings.HasPrefix(listen, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
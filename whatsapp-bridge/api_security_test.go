@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsLoopbackListen(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"127.0.0.2:8080", true},
+		{"[::1]:8080", true},
+		{"unix:/run/whatsapp-bridge.sock", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.10:8080", false},
+		{"bridge.example.com:8080", false},
+		{"localhost", false}, // not a valid address, so it isn't trusted either
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackListen(tt.listen); got != tt.want {
+			t.Errorf("isLoopbackListen(%q) = %v, want %v", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestRequireAPIToken(t *testing.T) {
+	handler := requireAPIToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"valid token", "Bearer s3cret", http.StatusNoContent},
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"token prefix", "Bearer s3cre", http.StatusUnauthorized},
+		{"token with suffix", "Bearer s3cret2", http.StatusUnauthorized},
+		{"bare token", "s3cret", http.StatusUnauthorized},
+		{"other scheme", "Basic s3cret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/chats", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); (tt.want == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+		})
+	}
+}
+
+func TestLoadAPIToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store", "api_token")
+	token, err := loadAPIToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Errorf("generated token %q, want 32 random bytes in hex", token)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("token file has mode %v, want 0600", info.Mode().Perm())
+	}
+
+	again, err := loadAPIToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != token {
+		t.Error("loading the token again gave a different token")
+	}
+
+	if err := os.WriteFile(path, []byte("  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAPIToken(path); err == nil {
+		t.Error("loadAPIToken accepted an empty token file")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the bridge settings loaded from the JSON config file
+type Config struct {
+	Media      MediaRetentionConfig `json:"media"`
+	Embeddings EmbeddingsConfig     `json:"embeddings"`
+	API        APIConfig            `json:"api"`
+}
+
+// APIConfig controls who can reach the REST API and which files it may send
+type APIConfig struct {
+	// Listen is a "host:port" address or "unix:/path/to/socket" (default localhost:8080)
+	Listen string `json:"listen"`
+	// TokenFile holds the shared secret clients must send as a bearer token. It is created
+	// with a random secret if it doesn't exist (default store/api_token).
+	TokenFile string `json:"token_file"`
+	// TLS serves the API over HTTPS, optionally requiring client certificates
+	TLS *APITLSConfig `json:"tls,omitempty"`
+	// MediaDirs are the directories files sent through media_path may come from
+	// (default: the home directory and the temp directory)
+	MediaDirs []string `json:"media_dirs"`
+	// MediaDeny are files and directories within them that may not be sent. Hidden files
+	// and the bridge's store are always denied, see MediaPolicy.
+	MediaDeny []string `json:"media_deny,omitempty"`
+	// MediaMaxSizeMB is the largest file that may be sent (default 100)
+	MediaMaxSizeMB int64 `json:"media_max_size_mb,omitempty"`
+}
+
+// APITLSConfig holds the certificates for serving the REST API over TLS
+type APITLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile, if set, makes clients authenticate with a certificate signed by this CA
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+}
+
+// EmbeddingsConfig selects the embedding model used for semantic search
+type EmbeddingsConfig struct {
+	// Backend is "command" to run a local model, "hash" for the built-in hashing embedder
+	// (deterministic, but only matches shared words) or empty to disable semantic search
+	Backend string `json:"backend"`
+	// Command is the program and arguments of the local model, see commandEmbedder
+	Command []string `json:"command,omitempty"`
+	// Model names the model; changing it re-embeds all messages (default: the command line)
+	Model string `json:"model,omitempty"`
+	// Dimensions is the vector size of the hash backend (default 256)
+	Dimensions int `json:"dimensions,omitempty"`
+	// BatchSize is how many messages are embedded at once (default 32)
+	BatchSize int `json:"batch_size,omitempty"`
+}
+
+// MediaRetentionConfig controls how long downloaded media is kept and how much disk it may use
+type MediaRetentionConfig struct {
+	// MaxTotalSizeMB caps the total size of all downloaded media, 0 means unlimited
+	MaxTotalSizeMB int64 `json:"max_total_size_mb"`
+	// MaxAge removes media this long after it was downloaded, e.g. "720h" or "30d"
+	MaxAge Duration `json:"max_age"`
+	// GCInterval is how often the garbage collector runs (default 1h)
+	GCInterval Duration `json:"gc_interval"`
+	// Rules override the global settings for particular chats or media types.
+	// The first matching rule wins.
+	Rules []MediaRetentionRule `json:"rules"`
+}
+
+// MediaRetentionRule applies to media from a chat and/or of a media type
+type MediaRetentionRule struct {
+	ChatJID   string `json:"chat_jid,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	// Keep exempts matching media from deletion, like pinning it
+	Keep bool `json:"keep,omitempty"`
+	// MaxAge replaces the global max age for matching media
+	MaxAge Duration `json:"max_age,omitempty"`
+	// MaxTotalSizeMB caps the total size of matching media, 0 means no separate cap
+	MaxTotalSizeMB int64 `json:"max_total_size_mb,omitempty"`
+}
+
+// Matches reports whether the rule applies to media of the given type in the given chat
+func (r MediaRetentionRule) Matches(chatJID, mediaType string) bool {
+	if r.ChatJID != "" && r.ChatJID != chatJID {
+		return false
+	}
+	if r.MediaType != "" && r.MediaType != mediaType {
+		return false
+	}
+	return true
+}
+
+// Duration is a time.Duration that is read from JSON strings such as "72h" or "30d"
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"72h\" or \"30d\": %v", err)
+	}
+	parsed, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// parseDuration parses a Go duration, additionally accepting a whole number of days ("30d")
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return parsed, nil
+}
+
+// defaultConfig returns the settings used when no config file exists
+func defaultConfig() *Config {
+	return &Config{
+		Media: MediaRetentionConfig{
+			GCInterval: Duration(time.Hour),
+		},
+		API: APIConfig{
+			Listen:    defaultAPIListen,
+			TokenFile: defaultAPITokenFile,
+			MediaDirs: defaultMediaDirs(),
+		},
+	}
+}
+
+// defaultMediaDirs returns the directories files may be sent from by default. The temp
+// directory holds voice messages the MCP server converted to Opus.
+func defaultMediaDirs() []string {
+	dirs := []string{os.TempDir()}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append([]string{home}, dirs...)
+	}
+	return dirs
+}
+
+// loadConfig reads the config file at path. A missing file yields the defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	if cfg.Media.GCInterval <= 0 {
+		cfg.Media.GCInterval = Duration(time.Hour)
+	}
+	if cfg.API.Listen == "" {
+		cfg.API.Listen = defaultAPIListen
+	}
+	if cfg.API.TokenFile == "" {
+		cfg.API.TokenFile = defaultAPITokenFile
+	}
+	if tls := cfg.API.TLS; tls != nil && (tls.CertFile == "" || tls.KeyFile == "") {
+		return nil, fmt.Errorf("api.tls needs both cert_file and key_file")
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,39 @@
+#!/usr/bin/env python3
+"""Embedding command for the bridge's "command" embeddings backend.
+
+Runs a local ONNX model through fastembed (pip install fastembed). The model is
+downloaded once into the cache directory; after that everything runs offline.
+
+Protocol: one JSON request per line on stdin, {"texts": ["...", ...]}, answered by one
+JSON line on stdout, {"embeddings": [[...], ...]} or {"error": "..."}.
+"""
+
+import json
+import os
+import sys
+
+from fastembed import TextEmbedding
+
+MODEL = os.environ.get("EMBED_MODEL", "sentence-transformers/paraphrase-multilingual-MiniLM-L12-v2")
+CACHE_DIR = os.environ.get("EMBED_CACHE_DIR")
+
+
+def main():
+    model = TextEmbedding(model_name=MODEL, cache_dir=CACHE_DIR)
+
+    for line in sys.stdin:
+        line = line.strip()
+        if not line:
+            continue
+        try:
+            texts = json.loads(line)["texts"]
+            embeddings = [vector.tolist() for vector in model.embed(texts)]
+            response = {"embeddings": embeddings}
+        except Exception as e:
+            response = {"error": str(e)}
+        sys.stdout.write(json.dumps(response) + "\n")
+        sys.stdout.flush()
+
+
+if __name__ == "__main__":
+    main()
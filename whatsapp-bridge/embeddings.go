@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Embedder turns texts into vectors for semantic search
+type Embedder interface {
+	// Model identifies the embedding model. It is stored with every vector so that
+	// switching models re-embeds the history instead of mixing incompatible vectors.
+	Model() string
+	// Embed returns one vector per text
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// newEmbedder creates the embedder selected in the config, or nil if semantic search is disabled
+func newEmbedder(config EmbeddingsConfig) (Embedder, error) {
+	switch config.Backend {
+	case "":
+		return nil, nil
+	case "hash":
+		return &hashEmbedder{dimensions: config.Dimensions}, nil
+	case "command":
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("the command embeddings backend needs a command")
+		}
+		model := config.Model
+		if model == "" {
+			model = strings.Join(config.Command, " ")
+		}
+		return &commandEmbedder{command: config.Command, model: model}, nil
+	default:
+		return nil, fmt.Errorf("unknown embeddings backend %q, use \"command\" or \"hash\"", config.Backend)
+	}
+}
+
+// hashEmbedder is a deterministic embedder that hashes words and character trigrams into a
+// fixed number of dimensions. It needs no model and gives repeatable vectors, which makes
+// it useful for testing, but it only finds texts that share words or word fragments.
+type hashEmbedder struct {
+	dimensions int
+}
+
+func (e *hashEmbedder) Model() string {
+	return fmt.Sprintf("hash-%d", e.dims())
+}
+
+func (e *hashEmbedder) dims() int {
+	if e.dimensions <= 0 {
+		return 256
+	}
+	return e.dimensions
+}
+
+func (e *hashEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, e.dims())
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, word := range words {
+			e.add(vector, "w:"+word, 1)
+			padded := []rune(" " + word + " ")
+			for j := 0; j+3 <= len(padded); j++ {
+				e.add(vector, "t:"+string(padded[j:j+3]), 0.5)
+			}
+		}
+		normalizeVector(vector)
+		vectors[i] = vector
+	}
+	return vectors, nil
+}
+
+// add adds weight to the dimension the feature hashes to, with a hashed sign so that
+// collisions cancel out on average
+func (e *hashEmbedder) add(vector []float32, feature string, weight float32) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+	if sum&(1<<63) != 0 {
+		weight = -weight
+	}
+	vector[sum%uint64(len(vector))] += weight
+}
+
+// commandEmbedder runs a local embedding model as a long-lived child process. For every
+// batch it writes one JSON line {"texts": [...]} to the process's stdin and reads one JSON
+// line {"embeddings": [[...], ...]} (or {"error": "..."}) from its stdout.
+type commandEmbedder struct {
+	command []string
+	model   string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+type embedRequest struct {
+	Texts []string `json:"texts"`
+}
+
+type embedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func (e *commandEmbedder) Model() string {
+	return e.model
+}
+
+func (e *commandEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if e.cmd == nil {
+		if err := e.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	request, err := json.Marshal(embedRequest{Texts: texts})
+	if err != nil {
+		return nil, err
+	}
+	// Talk to the command in the background so a hung model can't outlive the context
+	type reply struct {
+		line []byte
+		err  error
+	}
+	replies := make(chan reply, 1)
+	stdin, stdout := e.stdin, e.stdout
+	go func() {
+		if _, err := stdin.Write(append(request, '\n')); err != nil {
+			replies <- reply{err: fmt.Errorf("failed to write to embedding command: %v", err)}
+			return
+		}
+		line, err := stdout.ReadBytes('\n')
+		if err != nil {
+			err = fmt.Errorf("failed to read from embedding command: %v", err)
+		}
+		replies <- reply{line, err}
+	}()
+
+	var line []byte
+	select {
+	case r := <-replies:
+		if r.err != nil {
+			e.stop()
+			return nil, r.err
+		}
+		line = r.line
+	case <-ctx.Done():
+		// A late answer would be read as the answer to the next request, so start over
+		e.stop()
+		return nil, fmt.Errorf("embedding command did not answer: %v", ctx.Err())
+	}
+
+	var response embedResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		e.stop()
+		return nil, fmt.Errorf("invalid response from embedding command: %v", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("embedding command failed: %s", response.Error)
+	}
+	if len(response.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("embedding command returned %d vectors for %d texts", len(response.Embeddings), len(texts))
+	}
+
+	for _, vector := range response.Embeddings {
+		normalizeVector(vector)
+	}
+	return response.Embeddings, nil
+}
+
+// start launches the embedding command
+func (e *commandEmbedder) start() error {
+	cmd := exec.Command(e.command[0], e.command[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start embedding command: %v", err)
+	}
+
+	e.cmd = cmd
+	e.stdin = stdin
+	e.stdout = bufio.NewReaderSize(stdout, 1<<20)
+	return nil
+}
+
+// stop terminates the embedding command so the next call starts a fresh one
+func (e *commandEmbedder) stop() {
+	if e.cmd == nil {
+		return
+	}
+	e.stdin.Close()
+	e.cmd.Process.Kill()
+	e.cmd.Wait()
+	e.cmd = nil
+}
+
+// normalizeVector scales a vector to unit length so that dot products are cosine similarities
+func normalizeVector(vector []float32) {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(1 / math.Sqrt(sum))
+	for i := range vector {
+		vector[i] *= norm
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Full-text search uses an FTS5 index over message text, captions and document names.
+// FTS5 is only compiled into go-sqlite3 with the sqlite_fts5 build tag, so the index is
+// optional rather than part of the migrations: it is created when available and its
+// triggers are removed when not, so that a build without FTS5 can still write messages.
+//
+// The index is an external content table keyed by the rowid of messages. The triggers
+// being present means the index is in sync; when they are missing the index is rebuilt.
+// Note that VACUUM may renumber rowids, after which the index must be rebuilt with
+// INSERT INTO messages_fts(messages_fts) VALUES('rebuild').
+
+var ftsTriggers = []string{"messages_fts_insert", "messages_fts_delete", "messages_fts_update"}
+
+// fts5Available reports whether the linked SQLite supports FTS5
+func fts5Available(db *sql.DB) bool {
+	var enabled bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	return err == nil && enabled
+}
+
+// ensureFullTextIndex creates or repairs the full-text index, or disables its triggers
+// when FTS5 isn't available. It returns whether full-text search is enabled.
+func ensureFullTextIndex(db *sql.DB) (bool, error) {
+	if !fts5Available(db) {
+		for _, trigger := range ftsTriggers {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+				return false, fmt.Errorf("failed to drop trigger %s: %v", trigger, err)
+			}
+		}
+		return false, nil
+	}
+
+	var triggers int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN (?, ?, ?)",
+		ftsTriggers[0], ftsTriggers[1], ftsTriggers[2],
+	).Scan(&triggers)
+	if err != nil {
+		return false, err
+	}
+	if triggers == len(ftsTriggers) {
+		return true, nil
+	}
+
+	fmt.Println("Building full-text search index, this may take a while for large histories...")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+			content, caption, filename,
+			content = 'messages', content_rowid = 'rowid',
+			tokenize = 'unicode61 remove_diacritics 2',
+			prefix = '2 3'
+		);
+
+		DROP TRIGGER IF EXISTS messages_fts_insert;
+		DROP TRIGGER IF EXISTS messages_fts_delete;
+		DROP TRIGGER IF EXISTS messages_fts_update;
+
+		CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, content, caption, filename)
+			VALUES (new.rowid, new.content, new.caption, new.filename);
+		END;
+
+		CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content, caption, filename)
+			VALUES ('delete', old.rowid, old.content, old.caption, old.filename);
+		END;
+
+		CREATE TRIGGER messages_fts_update AFTER UPDATE OF content, caption, filename ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content, caption, filename)
+			VALUES ('delete', old.rowid, old.content, old.caption, old.filename);
+			INSERT INTO messages_fts (rowid, content, caption, filename)
+			VALUES (new.rowid, new.content, new.caption, new.filename);
+		END;
+
+		INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
+	`)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to create full-text index: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
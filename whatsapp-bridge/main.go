@@ -4,16 +4,20 @@ import (
 	"context"
 	"database/sql"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -44,6 +48,10 @@ type Message struct {
 // Database handler for storing message history
 type MessageStore struct {
 	db *sql.DB
+
+	// Messages edited after they were embedded, for the semantic index to embed again
+	editedMu sync.Mutex
+	edited   []editedMessage
 }
 
 // Initialize message store
@@ -59,35 +67,20 @@ func NewMessageStore() (*MessageStore, error) {
 		return nil, fmt.Errorf("failed to open message database: %v", err)
 	}
 
-	// Create tables if they don't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS chats (
-			jid TEXT PRIMARY KEY,
-			name TEXT,
-			last_message_time TIMESTAMP
-		);
-		
-		CREATE TABLE IF NOT EXISTS messages (
-			id TEXT,
-			chat_jid TEXT,
-			sender TEXT,
-			content TEXT,
-			timestamp TIMESTAMP,
-			is_from_me BOOLEAN,
-			media_type TEXT,
-			filename TEXT,
-			url TEXT,
-			media_key BLOB,
-			file_sha256 BLOB,
-			file_enc_sha256 BLOB,
-			file_length INTEGER,
-			PRIMARY KEY (id, chat_jid),
-			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
-		);
-	`)
+	// Bring the schema up to date
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %v", err)
+	}
+
+	// Full-text search is optional, see fts.go
+	ftsEnabled, err := ensureFullTextIndex(db)
 	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create tables: %v", err)
+		return nil, fmt.Errorf("failed to set up full-text search: %v", err)
+	}
+	if !ftsEnabled {
+		fmt.Println("Full-text search is disabled because SQLite was built without FTS5 (build with -tags sqlite_fts5 to enable it)")
 	}
 
 	return &MessageStore{db: db}, nil
@@ -98,30 +91,87 @@ func (store *MessageStore) Close() error {
 	return store.db.Close()
 }
 
-// Store a chat in the database
+// Store a chat in the database. Like every time in messages.db, the last message time is
+// stored in UTC so that times compare correctly as text.
 func (store *MessageStore) StoreChat(jid, name string, lastMessageTime time.Time) error {
 	_, err := store.db.Exec(
 		"INSERT OR REPLACE INTO chats (jid, name, last_message_time) VALUES (?, ?, ?)",
-		jid, name, lastMessageTime,
+		jid, name, lastMessageTime.UTC(),
 	)
 	return err
 }
 
-// Store a message in the database
-func (store *MessageStore) StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
-	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
+// Store a message in the database. replyToID is the ID of the quoted message, if any,
+// and media is nil for messages without media.
+func (store *MessageStore) StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool, replyToID string, media *MediaInfo) error {
 	// Only store if there's actual content or media
-	if content == "" && mediaType == "" {
+	if content == "" && media == nil {
 		return nil
 	}
+	if media == nil {
+		media = &MediaInfo{}
+	}
 
-	_, err := store.db.Exec(
-		`INSERT OR REPLACE INTO messages 
-		(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, chatJID, sender, content, timestamp, isFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength,
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// An edit makes the message's embedding stale
+	var rowID int64
+	var oldContent, oldCaption string
+	err = tx.QueryRow(
+		"SELECT rowid, COALESCE(content, ''), COALESCE(caption, '') FROM messages WHERE id = ? AND chat_jid = ?",
+		id, chatJID,
+	).Scan(&rowID, &oldContent, &oldCaption)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	edited := err == nil && (oldContent != content || oldCaption != media.Caption)
+
+	// Upsert rather than INSERT OR REPLACE so the full-text index triggers see an update
+	// instead of a silent delete
+	_, err = tx.Exec(
+		`INSERT INTO messages 
+		(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length,
+		direct_path, mimetype, media_key_timestamp, width, height, duration, thumbnail, caption, reply_to_id) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id, chat_jid) DO UPDATE SET
+			sender = excluded.sender, content = excluded.content, timestamp = excluded.timestamp, is_from_me = excluded.is_from_me,
+			media_type = excluded.media_type, filename = excluded.filename, url = excluded.url, media_key = excluded.media_key,
+			file_sha256 = excluded.file_sha256, file_enc_sha256 = excluded.file_enc_sha256, file_length = excluded.file_length,
+			direct_path = excluded.direct_path, mimetype = excluded.mimetype, media_key_timestamp = excluded.media_key_timestamp,
+			width = excluded.width, height = excluded.height, duration = excluded.duration, thumbnail = excluded.thumbnail,
+			caption = excluded.caption, reply_to_id = excluded.reply_to_id`,
+		id, chatJID, sender, content, timestamp.UTC(), isFromMe, media.MediaType, media.Filename, media.URL, media.MediaKey, media.FileSHA256, media.FileEncSHA256, media.FileLength,
+		media.DirectPath, media.Mimetype, media.MediaKeyTimestamp, media.Width, media.Height, media.Duration, media.Thumbnail, media.Caption,
+		replyToID,
 	)
-	return err
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var embedded int64
+	if edited {
+		res, err := tx.Exec("DELETE FROM message_embeddings WHERE message_id = ? AND chat_jid = ?", id, chatJID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		embedded, _ = res.RowsAffected()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if embedded > 0 {
+		store.editedMu.Lock()
+		store.edited = append(store.edited, editedMessage{rowID: rowID, messageID: id, chatJID: chatJID})
+		store.editedMu.Unlock()
+	}
+	return nil
 }
 
 // Get messages from a chat
@@ -189,6 +239,30 @@ func extractTextContent(msg *waProto.Message) string {
 	return ""
 }
 
+// extractReplyTo returns the ID of the message a message quotes, or "" if it isn't a reply
+func extractReplyTo(msg *waProto.Message) string {
+	if msg == nil {
+		return ""
+	}
+
+	var contextInfo *waProto.ContextInfo
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		contextInfo = msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		contextInfo = msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		contextInfo = msg.GetVideoMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		contextInfo = msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		contextInfo = msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		contextInfo = msg.GetStickerMessage().GetContextInfo()
+	}
+	return contextInfo.GetStanzaID()
+}
+
 // SendMessageResponse represents the response for the send message API
 type SendMessageResponse struct {
 	Success bool   `json:"success"`
@@ -371,45 +445,170 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 	return true, fmt.Sprintf("Message sent to %s", recipient)
 }
 
-// Extract media info from a message
-func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string, url string, mediaKey []byte, fileSHA256 []byte, fileEncSHA256 []byte, fileLength uint64) {
+// MediaInfo holds everything needed to download and describe the media of a message
+type MediaInfo struct {
+	MediaType         string
+	Filename          string
+	URL               string
+	DirectPath        string
+	MediaKey          []byte
+	FileSHA256        []byte
+	FileEncSHA256     []byte
+	FileLength        uint64
+	Mimetype          string
+	MediaKeyTimestamp int64
+	Width             uint32
+	Height            uint32
+	Duration          uint32 // seconds
+	Thumbnail         []byte
+	Caption           string
+}
+
+// Extract media info from a message, or nil if it has no media. Generated filenames are
+// derived from the message timestamp and ID so that they are stable and unique per message.
+func extractMediaInfo(msg *waProto.Message, messageID string, timestamp time.Time) *MediaInfo {
 	if msg == nil {
-		return "", "", "", nil, nil, nil, 0
+		return nil
 	}
 
+	stamp := timestamp.Format("20060102_150405") + "_" + messageID
+
 	// Check for image message
 	if img := msg.GetImageMessage(); img != nil {
-		return "image", "image_" + time.Now().Format("20060102_150405") + ".jpg",
-			img.GetURL(), img.GetMediaKey(), img.GetFileSHA256(), img.GetFileEncSHA256(), img.GetFileLength()
+		return &MediaInfo{
+			MediaType:         "image",
+			Filename:          "image_" + stamp + mediaExtension(img.GetMimetype(), ".jpg"),
+			URL:               img.GetURL(),
+			DirectPath:        img.GetDirectPath(),
+			MediaKey:          img.GetMediaKey(),
+			FileSHA256:        img.GetFileSHA256(),
+			FileEncSHA256:     img.GetFileEncSHA256(),
+			FileLength:        img.GetFileLength(),
+			Mimetype:          img.GetMimetype(),
+			MediaKeyTimestamp: img.GetMediaKeyTimestamp(),
+			Width:             img.GetWidth(),
+			Height:            img.GetHeight(),
+			Thumbnail:         img.GetJPEGThumbnail(),
+			Caption:           img.GetCaption(),
+		}
 	}
 
 	// Check for video message
 	if vid := msg.GetVideoMessage(); vid != nil {
-		return "video", "video_" + time.Now().Format("20060102_150405") + ".mp4",
-			vid.GetURL(), vid.GetMediaKey(), vid.GetFileSHA256(), vid.GetFileEncSHA256(), vid.GetFileLength()
+		return &MediaInfo{
+			MediaType:         "video",
+			Filename:          "video_" + stamp + mediaExtension(vid.GetMimetype(), ".mp4"),
+			URL:               vid.GetURL(),
+			DirectPath:        vid.GetDirectPath(),
+			MediaKey:          vid.GetMediaKey(),
+			FileSHA256:        vid.GetFileSHA256(),
+			FileEncSHA256:     vid.GetFileEncSHA256(),
+			FileLength:        vid.GetFileLength(),
+			Mimetype:          vid.GetMimetype(),
+			MediaKeyTimestamp: vid.GetMediaKeyTimestamp(),
+			Width:             vid.GetWidth(),
+			Height:            vid.GetHeight(),
+			Duration:          vid.GetSeconds(),
+			Thumbnail:         vid.GetJPEGThumbnail(),
+			Caption:           vid.GetCaption(),
+		}
 	}
 
 	// Check for audio message
 	if aud := msg.GetAudioMessage(); aud != nil {
-		return "audio", "audio_" + time.Now().Format("20060102_150405") + ".ogg",
-			aud.GetURL(), aud.GetMediaKey(), aud.GetFileSHA256(), aud.GetFileEncSHA256(), aud.GetFileLength()
+		return &MediaInfo{
+			MediaType:         "audio",
+			Filename:          "audio_" + stamp + mediaExtension(aud.GetMimetype(), ".ogg"),
+			URL:               aud.GetURL(),
+			DirectPath:        aud.GetDirectPath(),
+			MediaKey:          aud.GetMediaKey(),
+			FileSHA256:        aud.GetFileSHA256(),
+			FileEncSHA256:     aud.GetFileEncSHA256(),
+			FileLength:        aud.GetFileLength(),
+			Mimetype:          aud.GetMimetype(),
+			MediaKeyTimestamp: aud.GetMediaKeyTimestamp(),
+			Duration:          aud.GetSeconds(),
+		}
 	}
 
 	// Check for document message
 	if doc := msg.GetDocumentMessage(); doc != nil {
 		filename := doc.GetFileName()
 		if filename == "" {
-			filename = "document_" + time.Now().Format("20060102_150405")
+			filename = "document_" + stamp + mediaExtension(doc.GetMimetype(), "")
+		}
+		return &MediaInfo{
+			MediaType:         "document",
+			Filename:          filename,
+			URL:               doc.GetURL(),
+			DirectPath:        doc.GetDirectPath(),
+			MediaKey:          doc.GetMediaKey(),
+			FileSHA256:        doc.GetFileSHA256(),
+			FileEncSHA256:     doc.GetFileEncSHA256(),
+			FileLength:        doc.GetFileLength(),
+			Mimetype:          doc.GetMimetype(),
+			MediaKeyTimestamp: doc.GetMediaKeyTimestamp(),
+			Thumbnail:         doc.GetJPEGThumbnail(),
+			Caption:           doc.GetCaption(),
+		}
+	}
+
+	// Check for sticker message
+	if stk := msg.GetStickerMessage(); stk != nil {
+		return &MediaInfo{
+			MediaType:         "sticker",
+			Filename:          "sticker_" + stamp + mediaExtension(stk.GetMimetype(), ".webp"),
+			URL:               stk.GetURL(),
+			DirectPath:        stk.GetDirectPath(),
+			MediaKey:          stk.GetMediaKey(),
+			FileSHA256:        stk.GetFileSHA256(),
+			FileEncSHA256:     stk.GetFileEncSHA256(),
+			FileLength:        stk.GetFileLength(),
+			Mimetype:          stk.GetMimetype(),
+			MediaKeyTimestamp: stk.GetMediaKeyTimestamp(),
+			Width:             stk.GetWidth(),
+			Height:            stk.GetHeight(),
+			Thumbnail:         stk.GetPngThumbnail(),
 		}
-		return "document", filename,
-			doc.GetURL(), doc.GetMediaKey(), doc.GetFileSHA256(), doc.GetFileEncSHA256(), doc.GetFileLength()
 	}
 
-	return "", "", "", nil, nil, nil, 0
+	return nil
+}
+
+// mediaExtensions maps the MIME types WhatsApp commonly uses to file extensions
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"image/gif":       ".gif",
+	"video/mp4":       ".mp4",
+	"video/3gpp":      ".3gp",
+	"audio/ogg":       ".ogg",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/aac":       ".aac",
+	"application/pdf": ".pdf",
+}
+
+// mediaExtension returns the file extension for a MIME type, or fallback if it is unknown
+func mediaExtension(mimetype, fallback string) string {
+	mimetype = strings.TrimSpace(strings.SplitN(mimetype, ";", 2)[0])
+	if ext, ok := mediaExtensions[strings.ToLower(mimetype)]; ok {
+		return ext
+	}
+	return fallback
 }
 
 // Handle regular incoming messages with media support
 func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, logger waLog.Logger) {
+	// Reactions are stored with the message they react to rather than as messages
+	if reaction := msg.Message.GetReactionMessage(); reaction != nil {
+		if err := handleReaction(messageStore, msg, reaction); err != nil {
+			logger.Warnf("%v", err)
+		}
+		return
+	}
+
 	// Save message to database
 	chatJID := msg.Info.Chat.String()
 	sender := msg.Info.Sender.User
@@ -427,10 +626,10 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 	content := extractTextContent(msg.Message)
 
 	// Extract media info
-	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength := extractMediaInfo(msg.Message)
+	media := extractMediaInfo(msg.Message, msg.Info.ID, msg.Info.Timestamp)
 
 	// Skip if there's no content and no media
-	if content == "" && mediaType == "" {
+	if content == "" && media == nil {
 		return
 	}
 
@@ -442,13 +641,8 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 		content,
 		msg.Info.Timestamp,
 		msg.Info.IsFromMe,
-		mediaType,
-		filename,
-		url,
-		mediaKey,
-		fileSHA256,
-		fileEncSHA256,
-		fileLength,
+		extractReplyTo(msg.Message),
+		media,
 	)
 
 	if err != nil {
@@ -462,8 +656,8 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 		}
 
 		// Log based on message type
-		if mediaType != "" {
-			fmt.Printf("[%s] %s %s: [%s: %s] %s\n", timestamp, direction, sender, mediaType, filename, content)
+		if media != nil {
+			fmt.Printf("[%s] %s %s: [%s: %s] %s\n", timestamp, direction, sender, media.MediaType, media.Filename, content)
 		} else if content != "" {
 			fmt.Printf("[%s] %s %s: %s\n", timestamp, direction, sender, content)
 		}
@@ -484,6 +678,13 @@ type DownloadMediaResponse struct {
 	Path     string `json:"path,omitempty"`
 }
 
+// PinMediaRequest represents the request body for the pin media API
+type PinMediaRequest struct {
+	MessageID string `json:"message_id"`
+	ChatJID   string `json:"chat_jid"`
+	Pinned    bool   `json:"pinned"`
+}
+
 // Store additional media info in the database
 func (store *MessageStore) StoreMediaInfo(id, chatJID, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
 	_, err := store.db.Exec(
@@ -493,18 +694,44 @@ func (store *MessageStore) StoreMediaInfo(id, chatJID, url string, mediaKey, fil
 	return err
 }
 
+// Remember a new location for the media of a message, e.g. after the phone re-uploaded it
+func (store *MessageStore) UpdateMediaDirectPath(id, chatJID, directPath string) error {
+	// The old URL points at the expired upload, so drop it in favour of the direct path
+	_, err := store.db.Exec(
+		"UPDATE messages SET url = '', direct_path = ? WHERE id = ? AND chat_jid = ?",
+		directPath, id, chatJID,
+	)
+	return err
+}
+
 // Get media info from the database
-func (store *MessageStore) GetMediaInfo(id, chatJID string) (string, string, string, []byte, []byte, []byte, uint64, error) {
-	var mediaType, filename, url string
-	var mediaKey, fileSHA256, fileEncSHA256 []byte
-	var fileLength uint64
+func (store *MessageStore) GetMediaInfo(id, chatJID string) (*MediaInfo, error) {
+	var media MediaInfo
+	var mediaType, filename, url, directPath, mimetype sql.NullString
+	var fileLength, mediaKeyTimestamp, width, height, duration sql.NullInt64
 
 	err := store.db.QueryRow(
-		"SELECT media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length FROM messages WHERE id = ? AND chat_jid = ?",
+		`SELECT media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length,
+		direct_path, mimetype, media_key_timestamp, width, height, duration, thumbnail
+		FROM messages WHERE id = ? AND chat_jid = ?`,
 		id, chatJID,
-	).Scan(&mediaType, &filename, &url, &mediaKey, &fileSHA256, &fileEncSHA256, &fileLength)
+	).Scan(&mediaType, &filename, &url, &media.MediaKey, &media.FileSHA256, &media.FileEncSHA256, &fileLength,
+		&directPath, &mimetype, &mediaKeyTimestamp, &width, &height, &duration, &media.Thumbnail)
+	if err != nil {
+		return nil, err
+	}
 
-	return mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err
+	media.MediaType = mediaType.String
+	media.Filename = filename.String
+	media.URL = url.String
+	media.FileLength = uint64(fileLength.Int64)
+	media.DirectPath = directPath.String
+	media.Mimetype = mimetype.String
+	media.MediaKeyTimestamp = mediaKeyTimestamp.Int64
+	media.Width = uint32(width.Int64)
+	media.Height = uint32(height.Int64)
+	media.Duration = uint32(duration.Int64)
+	return &media, nil
 }
 
 // MediaDownloader implements the whatsmeow.DownloadableMessage interface
@@ -553,72 +780,61 @@ func (d *MediaDownloader) GetMediaType() whatsmeow.MediaType {
 	return d.MediaType
 }
 
-// Function to download media from a message
+// Function to download media from a message. Media is stored content-addressed by its
+// SHA256, so media that was already downloaded for another message (e.g. forwarded
+// media) is reused instead of being fetched again.
 func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string) (bool, string, string, string, error) {
-	// Query the database for the message
-	var mediaType, filename, url string
-	var mediaKey, fileSHA256, fileEncSHA256 []byte
-	var fileLength uint64
-	var err error
-
-	// First, check if we already have this file
-	chatDir := fmt.Sprintf("store/%s", strings.ReplaceAll(chatJID, ":", "_"))
-	localPath := ""
-
 	// Get media info from the database
-	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength, err = messageStore.GetMediaInfo(messageID, chatJID)
-
+	media, err := messageStore.GetMediaInfo(messageID, chatJID)
 	if err != nil {
-		// Try to get basic info if extended info isn't available
-		err = messageStore.db.QueryRow(
-			"SELECT media_type, filename FROM messages WHERE id = ? AND chat_jid = ?",
-			messageID, chatJID,
-		).Scan(&mediaType, &filename)
-
-		if err != nil {
-			return false, "", "", "", fmt.Errorf("failed to find message: %v", err)
-		}
+		return false, "", "", "", fmt.Errorf("failed to find message: %v", err)
 	}
+	mediaType, filename := media.MediaType, media.Filename
+	mediaKey, fileSHA256 := media.MediaKey, media.FileSHA256
 
 	// Check if this is a media message
 	if mediaType == "" {
 		return false, "", "", "", fmt.Errorf("not a media message")
 	}
 
-	// Create directory for the chat if it doesn't exist
-	if err := os.MkdirAll(chatDir, 0755); err != nil {
-		return false, "", "", "", fmt.Errorf("failed to create chat directory: %v", err)
+	// Check if this message's media was already downloaded
+	blob, exportName, err := messageStore.GetMessageMedia(messageID, chatJID)
+	if err != nil {
+		return false, "", "", "", fmt.Errorf("failed to look up downloaded media: %v", err)
+	}
+	if blob != nil {
+		if success, mediaType, exportName, path, err := serveStoredBlob(messageStore, blob.SHA256, messageID, chatJID, mediaType, exportName); success || err != nil {
+			return success, mediaType, exportName, path, err
+		}
 	}
 
-	// Generate a local path for the file
-	localPath = fmt.Sprintf("%s/%s", chatDir, filename)
+	exportName = mediaExportName(filename, messageID)
+	ext := filepath.Ext(exportName)
 
-	// Get absolute path
-	absPath, err := filepath.Abs(localPath)
-	if err != nil {
-		return false, "", "", "", fmt.Errorf("failed to get absolute path: %v", err)
+	// Check if the same content was already downloaded for another message
+	if len(fileSHA256) > 0 {
+		if success, mediaType, exportName, path, err := serveStoredBlob(messageStore, hex.EncodeToString(fileSHA256), messageID, chatJID, mediaType, exportName); success || err != nil {
+			return success, mediaType, exportName, path, err
+		}
 	}
 
-	// Check if file already exists
-	if _, err := os.Stat(localPath); err == nil {
-		// File exists, return it
-		return true, mediaType, filename, absPath, nil
+	// Messages stored before the direct path was recorded only have the URL
+	directPath := media.DirectPath
+	if directPath == "" {
+		directPath = extractDirectPathFromURL(media.URL)
 	}
 
 	// If we don't have all the media info we need, we can't download
-	if url == "" || len(mediaKey) == 0 || len(fileSHA256) == 0 || len(fileEncSHA256) == 0 || fileLength == 0 {
-		return false, "", "", "", fmt.Errorf("incomplete media information for download")
+	if len(mediaKey) == 0 || len(fileSHA256) == 0 || len(media.FileEncSHA256) == 0 || media.FileLength == 0 {
+		return false, "", "", "", fmt.Errorf("incomplete media information for download: missing media key or file hashes")
 	}
 
 	fmt.Printf("Attempting to download media for message %s in chat %s...\n", messageID, chatJID)
 
-	// Extract direct path from URL
-	directPath := extractDirectPathFromURL(url)
-
 	// Create a downloader that implements DownloadableMessage
 	var waMediaType whatsmeow.MediaType
 	switch mediaType {
-	case "image":
+	case "image", "sticker":
 		waMediaType = whatsmeow.MediaImage
 	case "video":
 		waMediaType = whatsmeow.MediaVideo
@@ -631,52 +847,148 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 	}
 
 	downloader := &MediaDownloader{
-		URL:           url,
+		URL:           media.URL,
 		DirectPath:    directPath,
 		MediaKey:      mediaKey,
-		FileLength:    fileLength,
+		FileLength:    media.FileLength,
 		FileSHA256:    fileSHA256,
-		FileEncSHA256: fileEncSHA256,
+		FileEncSHA256: media.FileEncSHA256,
 		MediaType:     waMediaType,
 	}
 
-	// Download the media using whatsmeow client
-	mediaData, err := client.Download(downloader)
+	// Download the media, sharing the download with any other request for the same content
+	blob, err = mediaDownloads.Do(hex.EncodeToString(fileSHA256), func() (*MediaBlob, error) {
+		// Another request may have finished downloading this content in the meantime
+		if blob, err := messageStore.GetMediaBlob(hex.EncodeToString(fileSHA256)); err == nil && blob != nil {
+			if _, err := os.Stat(blob.Path); err == nil {
+				return blob, nil
+			}
+		}
+
+		// Download the media using whatsmeow client. Media with no location stored at all,
+		// like history syncs from before direct paths were recorded, can only be fetched
+		// once the phone uploads it again.
+		var mediaData []byte
+		var err error
+		needsRetry := downloader.URL == "" && downloader.DirectPath == ""
+		if !needsRetry {
+			mediaData, err = client.Download(downloader)
+			needsRetry = isMediaExpiredError(err)
+		}
+		if needsRetry {
+			// The media URL has expired or is unknown, ask the phone to upload the media again
+			newDirectPath, retryErr := requestMediaRetry(client, messageStore, messageID, chatJID, mediaKey)
+			if retryErr != nil {
+				return nil, retryErr
+			}
+
+			// Remember the new location so later downloads don't need another retry
+			if err := messageStore.UpdateMediaDirectPath(messageID, chatJID, newDirectPath); err != nil {
+				fmt.Printf("Failed to store new media location: %v\n", err)
+			}
+
+			downloader.URL = ""
+			downloader.DirectPath = newDirectPath
+			mediaData, err = client.Download(downloader)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to download media: %v", err)
+		}
+
+		// Make sure we got the file the message refers to
+		sha, err := verifyMediaSHA256(mediaData, fileSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("downloaded media failed verification: %v", err)
+		}
+
+		// Save the downloaded media under its content hash
+		blobPath, err := writeMediaBlob(sha, ext, mediaData)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		blob := &MediaBlob{
+			SHA256:       sha,
+			Path:         blobPath,
+			Size:         int64(len(mediaData)),
+			MediaType:    mediaType,
+			CreatedAt:    now,
+			LastAccessed: now,
+		}
+		if err := messageStore.StoreMediaBlob(blob); err != nil {
+			return nil, fmt.Errorf("failed to record media blob: %v", err)
+		}
+
+		fmt.Printf("Successfully downloaded %s media to %s (%d bytes)\n", mediaType, blobPath, len(mediaData))
+		return blob, nil
+	})
 	if err != nil {
-		return false, "", "", "", fmt.Errorf("failed to download media: %v", err)
+		return false, "", "", "", err
 	}
 
-	// Save the downloaded media to file
-	if err := os.WriteFile(localPath, mediaData, 0644); err != nil {
-		return false, "", "", "", fmt.Errorf("failed to save media file: %v", err)
+	success, mediaType, exportName, path, err := serveStoredBlob(messageStore, blob.SHA256, messageID, chatJID, mediaType, exportName)
+	if err == nil && !success {
+		err = fmt.Errorf("media was deleted by the media GC while it was being downloaded, please try again")
 	}
-
-	fmt.Printf("Successfully downloaded %s media to %s (%d bytes)\n", mediaType, absPath, len(mediaData))
-	return true, mediaType, filename, absPath, nil
+	return success, mediaType, exportName, path, err
 }
 
-// Extract direct path from a WhatsApp media URL
-func extractDirectPathFromURL(url string) string {
-	// The direct path is typically in the URL, we need to extract it
-	// Example URL: https://mmg.whatsapp.net/v/t62.7118-24/13812002_698058036224062_3424455886509161511_n.enc?ccb=11-4&oh=...
+// serveStoredBlob links the stored blob with the given hash to a message and serves it.
+// It holds mediaBlobsMu throughout, so the media GC can't delete the blob in between, and
+// reports false if the blob isn't stored.
+func serveStoredBlob(messageStore *MessageStore, sha, messageID, chatJID, mediaType, exportName string) (bool, string, string, string, error) {
+	mediaBlobsMu.Lock()
+	defer mediaBlobsMu.Unlock()
 
-	// Find the path part after the domain
-	parts := strings.SplitN(url, ".net/", 2)
-	if len(parts) < 2 {
-		return url // Return original URL if parsing fails
+	blob, err := messageStore.GetMediaBlob(sha)
+	if err != nil {
+		return false, "", "", "", fmt.Errorf("failed to look up media blob: %v", err)
+	}
+	if blob == nil {
+		return false, "", "", "", nil
 	}
+	if _, err := os.Stat(blob.Path); err != nil {
+		return false, "", "", "", nil
+	}
+	if err := messageStore.LinkMessageMedia(messageID, chatJID, blob.SHA256, exportName); err != nil {
+		return false, "", "", "", fmt.Errorf("failed to link media: %v", err)
+	}
+	return serveMediaBlob(messageStore, blob, mediaType, chatJID, exportName)
+}
 
-	pathPart := parts[1]
+// serveMediaBlob marks a blob as used and returns the download result for it
+func serveMediaBlob(messageStore *MessageStore, blob *MediaBlob, mediaType, chatJID, exportName string) (bool, string, string, string, error) {
+	if err := messageStore.TouchMediaBlob(blob.SHA256); err != nil {
+		fmt.Printf("Failed to update media access time: %v\n", err)
+	}
 
-	// Remove query parameters
-	pathPart = strings.SplitN(pathPart, "?", 2)[0]
+	path, err := linkExportName(blob.Path, chatJID, exportName)
+	if err != nil {
+		return false, "", "", "", err
+	}
+	return true, mediaType, exportName, path, nil
+}
 
-	// Create proper direct path format
-	return "/" + pathPart
+// Extract the direct path from a WhatsApp media URL. Only used for messages stored before
+// the direct path was recorded; returns "" if the URL isn't on a WhatsApp media host.
+func extractDirectPathFromURL(mediaURL string) string {
+	// Example URL: https://mmg.whatsapp.net/v/t62.7118-24/13812002_698058036224062_3424455886509161511_n.enc?ccb=11-4&oh=...
+	parsed, err := url.Parse(mediaURL)
+	if err != nil || parsed.Path == "" {
+		return ""
+	}
+	if host := parsed.Hostname(); host != "whatsapp.net" && !strings.HasSuffix(host, ".whatsapp.net") {
+		return ""
+	}
+	return parsed.Path
 }
 
-// Start a REST API server to expose the WhatsApp client functionality
-func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port int) {
+// Start a REST API server to expose the WhatsApp client functionality. Every request must
+// carry the API token.
+func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, mediaGC *MediaGC, vectorIndex *VectorIndex, config APIConfig) error {
+	mediaPolicy := NewMediaPolicy(config)
+
 	// Handler for sending messages
 	http.HandleFunc("/api/send", func(w http.ResponseWriter, r *http.Request) {
 		// Only allow POST requests
@@ -705,8 +1017,22 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 
 		fmt.Println("Received request to send message", req.Message, req.MediaPath)
 
+		// Only send files the media policy allows
+		mediaPath := req.MediaPath
+		if mediaPath != "" {
+			resolved, err := mediaPolicy.Check(mediaPath)
+			if err != nil {
+				mediaPolicy.Audit(MediaAuditEntry{Path: mediaPath, Reason: err.Error(), Recipient: req.Recipient, Remote: r.RemoteAddr})
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(SendMessageResponse{Success: false, Message: err.Error()})
+				return
+			}
+			mediaPath = resolved
+		}
+
 		// Send the message
-		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, req.MediaPath)
+		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, mediaPath)
 		fmt.Println("Message sent", success, message)
 		// Set response headers
 		w.Header().Set("Content-Type", "application/json")
@@ -774,23 +1100,98 @@ func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port
 		})
 	})
 
+	// Handler for downloading all media of a chat, streaming progress as it goes
+	http.HandleFunc("/api/download/chat", handleExportChatMedia(client, messageStore))
+
+	// Handler for semantic search
+	http.HandleFunc("/api/semantic_search", handleSemanticSearch(vectorIndex))
+
+	// Handler for checking a file against the media policy before sending it
+	http.HandleFunc("/api/media/check", handleCheckMedia(mediaPolicy))
+
+	// Handler for media storage statistics
+	http.HandleFunc("/api/media/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats, err := messageStore.GetMediaStats(10)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to compute media stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+		stats.Policy = mediaGC.config
+		stats.LastGC = mediaGC.LastRun()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	// Handler for pinning media so the retention policy never deletes it
+	http.HandleFunc("/api/media/pin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req PinMediaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.MessageID == "" || req.ChatJID == "" {
+			http.Error(w, "Message ID and Chat JID are required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := messageStore.SetMediaPinned(req.MessageID, req.ChatJID, req.Pinned); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(SendMessageResponse{Success: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(SendMessageResponse{Success: true, Message: "Media pin state updated"})
+	})
+
+	token, err := loadAPIToken(config.TokenFile)
+	if err != nil {
+		return err
+	}
+	listener, err := listenAPI(config)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", config.Listen, err)
+	}
+
 	// Start the server
-	serverAddr := fmt.Sprintf(":%d", port)
-	fmt.Printf("Starting REST API server on %s...\n", serverAddr)
+	fmt.Printf("Starting REST API server on %s...\n", config.Listen)
+	if config.TLS == nil && !isLoopbackListen(config.Listen) {
+		fmt.Printf("Warning: the REST API is reachable from other machines without TLS, so the API token is sent in the clear\n")
+	}
 
 	// Run server in a goroutine so it doesn't block
 	go func() {
-		if err := http.ListenAndServe(serverAddr, nil); err != nil {
+		if err := http.Serve(listener, requireAPIToken(token, http.DefaultServeMux)); err != nil {
 			fmt.Printf("REST API server error: %v\n", err)
 		}
 	}()
+	return nil
 }
 
 func main() {
+	configPath := flag.String("config", "config.json", "Path to the bridge config file")
+	flag.Parse()
+
 	// Set up logger
 	logger := waLog.Stdout("Client", "INFO", true)
 	logger.Infof("Starting WhatsApp client...")
 
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Errorf("Failed to load config: %v", err)
+		return
+	}
+
 	// Create database connection for storing session data
 	dbLog := waLog.Stdout("Database", "INFO", true)
 
@@ -834,16 +1235,55 @@ func main() {
 	}
 	defer messageStore.Close()
 
+	// Recover direct paths for messages stored before they were recorded
+	go func() {
+		derived, err := backfillDirectPathsFromURLs(messageStore)
+		if err != nil {
+			logger.Warnf("Failed to derive direct paths: %v", err)
+		} else if derived > 0 {
+			fmt.Printf("Backfilled media info: %d direct paths derived from URLs\n", derived)
+		}
+	}()
+
+	// Enforce the media retention policy in the background
+	mediaGC := NewMediaGC(messageStore, config.Media)
+	mediaGC.Start()
+
+	// Embed messages for semantic search if an embedding backend is configured
+	embedder, err := newEmbedder(config.Embeddings)
+	if err != nil {
+		logger.Errorf("Failed to set up embeddings: %v", err)
+		return
+	}
+	var vectorIndex *VectorIndex
+	if embedder != nil {
+		vectorIndex = NewVectorIndex(messageStore, embedder, config.Embeddings.BatchSize)
+		if err := vectorIndex.Start(); err != nil {
+			logger.Errorf("Failed to start semantic index: %v", err)
+			return
+		}
+	}
+
 	// Setup event handling for messages and history sync
 	client.AddEventHandler(func(evt interface{}) {
 		switch v := evt.(type) {
 		case *events.Message:
 			// Process regular messages
 			handleMessage(client, messageStore, v, logger)
+			if vectorIndex != nil {
+				vectorIndex.Notify()
+			}
+
+		case *events.MediaRetry:
+			// Answer to a request to re-upload expired media
+			mediaRetries.deliver(v)
 
 		case *events.HistorySync:
 			// Process history sync events
 			handleHistorySync(client, messageStore, v, logger)
+			if vectorIndex != nil {
+				vectorIndex.Notify()
+			}
 
 		case *events.Connected:
 			logger.Infof("Connected to WhatsApp")
@@ -906,7 +1346,10 @@ func main() {
 	fmt.Println("\n✓ Connected to WhatsApp! Type 'help' for commands.")
 
 	// Start REST API server
-	startRESTServer(client, messageStore, 8080)
+	if err := startRESTServer(client, messageStore, mediaGC, vectorIndex, config.API); err != nil {
+		logger.Errorf("Failed to start REST API server: %v", err)
+		return
+	}
 
 	// Create a channel to keep the main goroutine alive
 	exitChan := make(chan os.Signal, 1)
@@ -1053,6 +1496,10 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					continue
 				}
 
+				if err := storeHistoryReactions(messageStore, jid, client.Store.ID.User, msg.Message); err != nil {
+					logger.Warnf("Failed to store history reactions: %v", err)
+				}
+
 				// Extract text content
 				var content string
 				if msg.Message.Message != nil {
@@ -1063,20 +1510,31 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					}
 				}
 
-				// Extract media info
-				var mediaType, filename, url string
-				var mediaKey, fileSHA256, fileEncSHA256 []byte
-				var fileLength uint64
+				// Message ID and timestamp, also used to name media files
+				msgID := ""
+				if msg.Message.Key != nil && msg.Message.Key.ID != nil {
+					msgID = *msg.Message.Key.ID
+				}
 
-				if msg.Message.Message != nil {
-					mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength = extractMediaInfo(msg.Message.Message)
+				timestamp := time.Time{}
+				if ts := msg.Message.GetMessageTimestamp(); ts != 0 {
+					timestamp = time.Unix(int64(ts), 0)
+				} else {
+					continue
 				}
 
+				// Extract media info
+				media := extractMediaInfo(msg.Message.Message, msgID, timestamp)
+
 				// Log the message content for debugging
+				var mediaType, filename string
+				if media != nil {
+					mediaType, filename = media.MediaType, media.Filename
+				}
 				logger.Infof("Message content: %v, Media Type: %v", content, mediaType)
 
 				// Skip messages with no content and no media
-				if content == "" && mediaType == "" {
+				if content == "" && media == nil {
 					continue
 				}
 
@@ -1099,19 +1557,6 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 				}
 
 				// Store message
-				msgID := ""
-				if msg.Message.Key != nil && msg.Message.Key.ID != nil {
-					msgID = *msg.Message.Key.ID
-				}
-
-				// Get message timestamp
-				timestamp := time.Time{}
-				if ts := msg.Message.GetMessageTimestamp(); ts != 0 {
-					timestamp = time.Unix(int64(ts), 0)
-				} else {
-					continue
-				}
-
 				err = messageStore.StoreMessage(
 					msgID,
 					chatJID,
@@ -1119,13 +1564,8 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					content,
 					timestamp,
 					isFromMe,
-					mediaType,
-					filename,
-					url,
-					mediaKey,
-					fileSHA256,
-					fileEncSHA256,
-					fileLength,
+					extractReplyTo(msg.Message.Message),
+					media,
 				)
 				if err != nil {
 					logger.Warnf("Failed to store history message: %v", err)
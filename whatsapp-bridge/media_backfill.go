@@ -0,0 +1,40 @@
+package main
+
+// backfillDirectPathsFromURLs stores the direct path embedded in WhatsApp media URLs for
+// media messages that don't have one yet
+func backfillDirectPathsFromURLs(store *MessageStore) (int, error) {
+	rows, err := store.db.Query(`
+		SELECT id, chat_jid, url FROM messages
+		WHERE COALESCE(media_type, '') != '' AND COALESCE(direct_path, '') = '' AND COALESCE(url, '') != ''
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct{ id, chatJID, directPath string }
+	var updates []pending
+	for rows.Next() {
+		var id, chatJID, mediaURL string
+		if err := rows.Scan(&id, &chatJID, &mediaURL); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if directPath := extractDirectPathFromURL(mediaURL); directPath != "" {
+			updates = append(updates, pending{id, chatJID, directPath})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, update := range updates {
+		if _, err := store.db.Exec(
+			"UPDATE messages SET direct_path = ? WHERE id = ? AND chat_jid = ?",
+			update.directPath, update.id, update.chatJID,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
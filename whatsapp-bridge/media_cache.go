@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Downloaded media is stored once per content hash under store/media/<xx>/<sha256><ext>.
+// Each message that references a blob gets a row in message_media and a
+// human-friendly symlink in store/<chat_jid>/ pointing at the blob.
+const mediaBlobDir = "store/media"
+
+// MediaBlob describes a stored media file, identified by the SHA256 of its plaintext
+type MediaBlob struct {
+	SHA256       string
+	Path         string
+	Size         int64
+	MediaType    string
+	CreatedAt    time.Time
+	LastAccessed time.Time
+}
+
+// GetMediaBlob returns the blob stored for a content hash, or nil if there is none
+func (store *MessageStore) GetMediaBlob(sha string) (*MediaBlob, error) {
+	var blob MediaBlob
+	var mediaType sql.NullString
+	err := store.db.QueryRow(
+		"SELECT sha256, path, size, media_type, created_at, last_accessed FROM media_blobs WHERE sha256 = ?",
+		sha,
+	).Scan(&blob.SHA256, &blob.Path, &blob.Size, &mediaType, &blob.CreatedAt, &blob.LastAccessed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blob.MediaType = mediaType.String
+	return &blob, nil
+}
+
+// StoreMediaBlob records a blob that has been written to disk
+func (store *MessageStore) StoreMediaBlob(blob *MediaBlob) error {
+	_, err := store.db.Exec(
+		`INSERT OR REPLACE INTO media_blobs (sha256, path, size, media_type, created_at, last_accessed)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		blob.SHA256, blob.Path, blob.Size, blob.MediaType, blob.CreatedAt.UTC(), blob.LastAccessed.UTC(),
+	)
+	return err
+}
+
+// TouchMediaBlob updates the last access time of a blob
+func (store *MessageStore) TouchMediaBlob(sha string) error {
+	_, err := store.db.Exec("UPDATE media_blobs SET last_accessed = ? WHERE sha256 = ?", time.Now().UTC(), sha)
+	return err
+}
+
+// LinkMessageMedia maps a message to the blob holding its media
+func (store *MessageStore) LinkMessageMedia(messageID, chatJID, sha, exportName string) error {
+	// Keep the pin state if the message was linked before
+	_, err := store.db.Exec(
+		`INSERT INTO message_media (message_id, chat_jid, sha256, export_name) VALUES (?, ?, ?, ?)
+		ON CONFLICT (message_id, chat_jid) DO UPDATE SET sha256 = excluded.sha256, export_name = excluded.export_name`,
+		messageID, chatJID, sha, exportName,
+	)
+	return err
+}
+
+// GetMessageMedia returns the blob and export name linked to a message, or nil if the
+// media hasn't been downloaded yet
+func (store *MessageStore) GetMessageMedia(messageID, chatJID string) (*MediaBlob, string, error) {
+	var sha, exportName string
+	err := store.db.QueryRow(
+		"SELECT sha256, export_name FROM message_media WHERE message_id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&sha, &exportName)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	blob, err := store.GetMediaBlob(sha)
+	if err != nil || blob == nil {
+		return nil, "", err
+	}
+	return blob, exportName, nil
+}
+
+// mediaBlobPath returns where the blob with the given hash is stored
+func mediaBlobPath(sha, ext string) string {
+	return filepath.Join(mediaBlobDir, sha[:2], sha+ext)
+}
+
+// chatMediaDir returns the directory holding the human-friendly links for a chat
+func chatMediaDir(chatJID string) string {
+	return fmt.Sprintf("store/%s", strings.ReplaceAll(chatJID, ":", "_"))
+}
+
+// mediaExportName makes a filename unique per message by including the message ID,
+// e.g. "invoice.pdf" becomes "invoice_3EB0C767D26A.pdf"
+func mediaExportName(filename, messageID string) string {
+	filename = filepath.Base(filename)
+	if strings.Contains(filename, messageID) {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + messageID + ext
+}
+
+// verifyMediaSHA256 checks downloaded media against the hash announced in the message
+func verifyMediaSHA256(data, expected []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	if len(expected) > 0 && !bytes.Equal(sum[:], expected) {
+		return "", fmt.Errorf("SHA256 mismatch: expected %s, got %s", hex.EncodeToString(expected), hex.EncodeToString(sum[:]))
+	}
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writeMediaBlob atomically writes media data to its content-addressed location
+func writeMediaBlob(sha, ext string, data []byte) (string, error) {
+	blobPath := mediaBlobPath(sha, ext)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create media directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), ".download-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write media file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write media file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return "", fmt.Errorf("failed to save media file: %v", err)
+	}
+
+	return blobPath, nil
+}
+
+// linkExportName creates (or refreshes) the human-friendly symlink for a message's media
+// and returns the absolute path that should be handed out. If symlinks aren't supported,
+// the blob path itself is returned.
+func linkExportName(blobPath, chatJID, exportName string) (string, error) {
+	absBlob, err := filepath.Abs(blobPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %v", err)
+	}
+
+	chatDir := chatMediaDir(chatJID)
+	if err := os.MkdirAll(chatDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create chat directory: %v", err)
+	}
+
+	linkPath := filepath.Join(chatDir, exportName)
+	absLink, err := filepath.Abs(linkPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %v", err)
+	}
+
+	if target, err := os.Readlink(linkPath); err == nil {
+		if target == absBlob {
+			return absLink, nil
+		}
+		os.Remove(linkPath)
+	} else if _, err := os.Lstat(linkPath); err == nil {
+		// A regular file from before media was content-addressed, replace it
+		os.Remove(linkPath)
+	}
+
+	if err := os.Symlink(absBlob, linkPath); err != nil {
+		return absBlob, nil
+	}
+	return absLink, nil
+}
+
+// mediaBlobsMu is held while a download links and serves a stored blob and while the
+// media GC deletes one, so a blob is never deleted out from under a download
+var mediaBlobsMu sync.Mutex
+
+// mediaDownloads shares in-flight downloads of the same content between requests
+var mediaDownloads = &downloadGroup{}
+
+// downloadGroup deduplicates concurrent downloads by content hash
+type downloadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*downloadCall
+}
+
+type downloadCall struct {
+	done chan struct{}
+	blob *MediaBlob
+	err  error
+}
+
+// Do runs fn for the given key unless a call for the same key is already in flight,
+// in which case it waits for that call and returns its result
+func (g *downloadGroup) Do(key string, fn func() (*MediaBlob, error)) (*MediaBlob, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*downloadCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.blob, call.err
+	}
+	call := &downloadCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.blob, call.err = fn()
+	close(call.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.blob, call.err
+}
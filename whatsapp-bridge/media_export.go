@@ -0,0 +1,464 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Exports are written to store/exports/<chat_jid>/<job id>/ together with a manifest.
+// The job ID is derived from the request filters, so repeating a request resumes it.
+const mediaExportDir = "store/exports"
+
+const (
+	defaultExportConcurrency = 4
+	maxExportConcurrency     = 16
+)
+
+// ExportChatMediaRequest represents the request body for the chat media export API
+type ExportChatMediaRequest struct {
+	ChatJID     string   `json:"chat_jid"`
+	MediaTypes  []string `json:"media_types,omitempty"`
+	After       string   `json:"after,omitempty"`
+	Before      string   `json:"before,omitempty"`
+	Format      string   `json:"format,omitempty"` // "directory" (default) or "zip"
+	Concurrency int      `json:"concurrency,omitempty"`
+}
+
+// ExportProgressEvent is streamed to the client as one JSON object per line
+type ExportProgressEvent struct {
+	Type      string `json:"type"` // "start", "item", "complete" or "error"
+	Done      int    `json:"done"`
+	Total     int    `json:"total"`
+	MessageID string `json:"message_id,omitempty"`
+	Status    string `json:"status,omitempty"` // "downloaded", "skipped" or "failed"
+	File      string `json:"file,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Output    string `json:"output,omitempty"`
+	Manifest  string `json:"manifest,omitempty"`
+	Failed    int    `json:"failed,omitempty"`
+}
+
+// ExportManifest describes the contents of an export directory or archive
+type ExportManifest struct {
+	ChatJID    string               `json:"chat_jid"`
+	MediaTypes []string             `json:"media_types,omitempty"`
+	After      string               `json:"after,omitempty"`
+	Before     string               `json:"before,omitempty"`
+	CreatedAt  time.Time            `json:"created_at"`
+	UpdatedAt  time.Time            `json:"updated_at"`
+	Items      []ExportManifestItem `json:"items"`
+}
+
+// ExportManifestItem is one media file in an export
+type ExportManifestItem struct {
+	MessageID string    `json:"message_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Sender    string    `json:"sender"`
+	MediaType string    `json:"media_type"`
+	File      string    `json:"file,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Status    string    `json:"status"` // "ok" or "failed"
+	Error     string    `json:"error,omitempty"`
+}
+
+// exportJob holds the state of a running export
+type exportJob struct {
+	req      ExportChatMediaRequest
+	dir      string
+	manifest *ExportManifest
+
+	mu   sync.Mutex
+	done int
+}
+
+// exportJobID derives a stable ID from the request filters
+func exportJobID(req ExportChatMediaRequest) string {
+	types := append([]string(nil), req.MediaTypes...)
+	sort.Strings(types)
+	sum := sha256.Sum256([]byte(strings.Join([]string{req.ChatJID, strings.Join(types, ","), req.After, req.Before}, "|")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// listExportItems returns the media messages of a chat matching the request filters
+func (store *MessageStore) listExportItems(req ExportChatMediaRequest) ([]ExportManifestItem, error) {
+	query := "SELECT id, timestamp, sender, media_type FROM messages WHERE chat_jid = ? AND media_type IS NOT NULL AND media_type != ''"
+	params := []interface{}{req.ChatJID}
+
+	if len(req.MediaTypes) > 0 {
+		query += " AND media_type IN (?" + strings.Repeat(", ?", len(req.MediaTypes)-1) + ")"
+		for _, mediaType := range req.MediaTypes {
+			params = append(params, mediaType)
+		}
+	}
+	if req.After != "" {
+		after, err := time.Parse(time.RFC3339, req.After)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date format for 'after': %s", req.After)
+		}
+		query += " AND timestamp > ?"
+		params = append(params, after.UTC())
+	}
+	if req.Before != "" {
+		before, err := time.Parse(time.RFC3339, req.Before)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date format for 'before': %s", req.Before)
+		}
+		query += " AND timestamp < ?"
+		params = append(params, before.UTC())
+	}
+	query += " ORDER BY timestamp"
+
+	rows, err := store.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []ExportManifestItem
+	for rows.Next() {
+		var item ExportManifestItem
+		if err := rows.Scan(&item.MessageID, &item.Timestamp, &item.Sender, &item.MediaType); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// loadExportManifest reads the manifest of a previous run of the same export, if any
+func loadExportManifest(dir string) *ExportManifest {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil
+	}
+	var manifest ExportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil
+	}
+	return &manifest
+}
+
+// save writes the manifest atomically so an interrupted export can be resumed
+func (job *exportJob) save() error {
+	job.manifest.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(job.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(job.dir, ".manifest.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(job.dir, "manifest.json"))
+}
+
+// placeExportFile puts a downloaded blob into the export directory, hard linking it
+// where possible and copying it otherwise
+func placeExportFile(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// exportItem downloads the media of one message and places it in the export directory. It
+// works on a copy of the manifest item and returns it updated, so the caller can store it
+// while holding job.mu.
+func (job *exportJob) exportItem(client *whatsmeow.Client, messageStore *MessageStore, item ExportManifestItem) (ExportManifestItem, string) {
+	// Skip items a previous run already exported
+	if item.Status == "ok" && item.File != "" {
+		if _, err := os.Stat(filepath.Join(job.dir, item.File)); err == nil {
+			return item, "skipped"
+		}
+	}
+
+	success, _, filename, path, err := downloadMedia(client, messageStore, item.MessageID, job.req.ChatJID)
+	if err == nil && !success {
+		err = fmt.Errorf("unknown error")
+	}
+	if err == nil {
+		var src string
+		src, err = filepath.EvalSymlinks(path)
+		if err == nil {
+			err = placeExportFile(src, filepath.Join(job.dir, filename))
+		}
+	}
+	if err != nil {
+		item.Status = "failed"
+		item.Error = err.Error()
+		return item, "failed"
+	}
+
+	item.Status = "ok"
+	item.Error = ""
+	item.File = filename
+	if blob, _, err := messageStore.GetMessageMedia(item.MessageID, job.req.ChatJID); err == nil && blob != nil {
+		item.SHA256 = blob.SHA256
+		item.Size = blob.Size
+	}
+	return item, "downloaded"
+}
+
+// writeZip packs the export directory into a zip archive next to it
+func (job *exportJob) writeZip() (string, error) {
+	zipPath := job.dir + ".zip"
+	tmp := zipPath + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	zw := zip.NewWriter(f)
+
+	files := []string{"manifest.json"}
+	for _, item := range job.manifest.Items {
+		if item.Status == "ok" {
+			files = append(files, item.File)
+		}
+	}
+
+	for _, name := range files {
+		// Media is already compressed, so store it as is
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		in, err := os.Open(filepath.Join(job.dir, name))
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		_, err = io.Copy(w, in)
+		in.Close()
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return zipPath, os.Rename(tmp, zipPath)
+}
+
+// exportChatMedia downloads all media of a chat matching the request with bounded
+// concurrency, calling progress after every item. Items exported by a previous run
+// of the same request are skipped.
+func exportChatMedia(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, req ExportChatMediaRequest, progress func(ExportProgressEvent)) error {
+	items, err := messageStore.listExportItems(req)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no media in chat %s matches the request", req.ChatJID)
+	}
+
+	dir := filepath.Join(mediaExportDir, strings.ReplaceAll(req.ChatJID, ":", "_"), exportJobID(req))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create export directory: %v", err)
+	}
+
+	job := &exportJob{
+		req: req,
+		dir: dir,
+		manifest: &ExportManifest{
+			ChatJID:    req.ChatJID,
+			MediaTypes: req.MediaTypes,
+			After:      req.After,
+			Before:     req.Before,
+			CreatedAt:  time.Now(),
+		},
+	}
+
+	// Carry over the results of a previous run
+	previous := make(map[string]ExportManifestItem)
+	if manifest := loadExportManifest(dir); manifest != nil {
+		job.manifest.CreatedAt = manifest.CreatedAt
+		for _, item := range manifest.Items {
+			previous[item.MessageID] = item
+		}
+	}
+	for i := range items {
+		if prev, ok := previous[items[i].MessageID]; ok {
+			items[i] = prev
+		}
+	}
+	job.manifest.Items = items
+
+	total := len(items)
+	progress(ExportProgressEvent{Type: "start", Total: total, Output: dir})
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultExportConcurrency
+	}
+	if concurrency > maxExportConcurrency {
+		concurrency = maxExportConcurrency
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				job.mu.Lock()
+				item := job.manifest.Items[i]
+				job.mu.Unlock()
+
+				item, status := job.exportItem(client, messageStore, item)
+
+				job.mu.Lock()
+				job.manifest.Items[i] = item
+				job.done++
+				event := ExportProgressEvent{
+					Type:      "item",
+					Done:      job.done,
+					Total:     total,
+					MessageID: item.MessageID,
+					Status:    status,
+					File:      item.File,
+					Error:     item.Error,
+				}
+				if status != "skipped" {
+					if err := job.save(); err != nil {
+						fmt.Printf("Failed to save export manifest: %v\n", err)
+					}
+				}
+				progress(event)
+				job.mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range job.manifest.Items {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := job.save(); err != nil {
+		return fmt.Errorf("failed to save export manifest: %v", err)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("export interrupted after %d of %d items, repeat the request to resume", job.done, total)
+	}
+
+	failed := 0
+	for _, item := range job.manifest.Items {
+		if item.Status != "ok" {
+			failed++
+		}
+	}
+
+	output := dir
+	if req.Format == "zip" {
+		output, err = job.writeZip()
+		if err != nil {
+			return fmt.Errorf("failed to write zip archive: %v", err)
+		}
+	}
+
+	absOutput, _ := filepath.Abs(output)
+	absManifest, _ := filepath.Abs(filepath.Join(dir, "manifest.json"))
+	progress(ExportProgressEvent{
+		Type:     "complete",
+		Done:     job.done,
+		Total:    total,
+		Failed:   failed,
+		Output:   absOutput,
+		Manifest: absManifest,
+	})
+	return nil
+}
+
+// handleExportChatMedia streams the progress of a chat media export as newline-delimited JSON
+func handleExportChatMedia(client *whatsmeow.Client, messageStore *MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ExportChatMediaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.ChatJID == "" {
+			http.Error(w, "Chat JID is required", http.StatusBadRequest)
+			return
+		}
+		// The JID names the export directory, so it must not be able to point outside it
+		if jid, err := types.ParseJID(req.ChatJID); err != nil || jid.User == "" || jid.Server == "" || strings.ContainsAny(req.ChatJID, `/\`) {
+			http.Error(w, "Invalid chat JID", http.StatusBadRequest)
+			return
+		}
+		if req.Format != "" && req.Format != "directory" && req.Format != "zip" {
+			http.Error(w, "Format must be \"directory\" or \"zip\"", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+
+		progress := func(event ExportProgressEvent) {
+			encoder.Encode(event)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err := exportChatMedia(r.Context(), client, messageStore, req, progress); err != nil {
+			progress(ExportProgressEvent{Type: "error", Error: err.Error()})
+		}
+	}
+}
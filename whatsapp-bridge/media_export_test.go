@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandleExportChatMediaChatJID(t *testing.T) {
+	handler := handleExportChatMedia(nil, nil)
+	for _, chatJID := range []string{
+		"",
+		"../../etc",
+		"..",
+		"s.whatsapp.net",
+		"123@s.whatsapp.net/../../x",
+		`123@s.whatsapp.net\..\x`,
+		"@s.whatsapp.net",
+	} {
+		body := strings.NewReader(`{"chat_jid": "` + strings.ReplaceAll(chatJID, `\`, `\\`) + `"}`)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/download/chat", body))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("chat_jid %q: status = %d, want %d", chatJID, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestExportChatMediaUnknownChat(t *testing.T) {
+	store := newTestStore(t)
+	t.Chdir(t.TempDir())
+
+	var events []ExportProgressEvent
+	err := exportChatMedia(context.Background(), nil, store, ExportChatMediaRequest{ChatJID: "123@s.whatsapp.net"}, func(event ExportProgressEvent) {
+		events = append(events, event)
+	})
+	if err == nil {
+		t.Fatal("exporting a chat with no media succeeded")
+	}
+	if len(events) != 0 {
+		t.Errorf("got progress events %+v", events)
+	}
+	if _, err := os.Stat(mediaExportDir); !os.IsNotExist(err) {
+		t.Errorf("export directory was created: %v", err)
+	}
+}
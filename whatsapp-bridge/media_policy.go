@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaAuditLog records every file the media policy refused to send, one JSON object per line
+const mediaAuditLog = "store/media_audit.log"
+
+// defaultMediaMaxSizeMB is the largest file that may be sent unless the config says otherwise
+const defaultMediaMaxSizeMB = 100
+
+// MediaPolicy decides which files may be sent through media_path. Files must be in one of
+// the allowed directories, and may not be hidden, part of the bridge's store (other than
+// downloaded media and exports), denied by the config or too large. Symlinks are resolved
+// before any of this is checked.
+type MediaPolicy struct {
+	dirs    []string
+	deny    []string
+	maxSize int64
+
+	mu sync.Mutex // serializes writes to the audit log
+}
+
+// MediaAuditEntry is a line of the audit log
+type MediaAuditEntry struct {
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Reason    string    `json:"reason"`
+	Recipient string    `json:"recipient,omitempty"`
+	Client    string    `json:"client,omitempty"` // the MCP client that asked, if known
+	Remote    string    `json:"remote"`
+}
+
+// CheckMediaRequest represents the request body for the media path check API
+type CheckMediaRequest struct {
+	MediaPath string `json:"media_path"`
+	Recipient string `json:"recipient,omitempty"`
+	Client    string `json:"client,omitempty"`
+}
+
+// CheckMediaResponse represents the response for the media path check API
+type CheckMediaResponse struct {
+	Allowed bool   `json:"allowed"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// NewMediaPolicy creates the policy from the api section of the config
+func NewMediaPolicy(config APIConfig) *MediaPolicy {
+	maxSize := config.MediaMaxSizeMB
+	if maxSize <= 0 {
+		maxSize = defaultMediaMaxSizeMB
+	}
+	return &MediaPolicy{
+		dirs:    config.MediaDirs,
+		deny:    config.MediaDeny,
+		maxSize: maxSize * 1024 * 1024,
+	}
+}
+
+// Check returns the path of the file to send, with symlinks resolved, or why it may not be sent
+func (p *MediaPolicy) Check(mediaPath string) (string, error) {
+	abs, err := filepath.Abs(mediaPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid media path %s: %v", mediaPath, err)
+	}
+	// A missing file is only reported once the path passed the other checks, so they can't
+	// be used to find out which files exist elsewhere
+	resolved, resolveErr := filepath.EvalSymlinks(abs)
+	if resolveErr != nil {
+		resolved = abs
+	}
+	name := mediaPath
+	if resolved != abs {
+		name = fmt.Sprintf("%s (a link to %s)", mediaPath, resolved)
+	}
+
+	root, ok := p.root(resolved)
+	if !ok {
+		return "", fmt.Errorf("%s is outside the directories files may be sent from (api.media_dirs)", name)
+	}
+	rel, _ := filepath.Rel(root, resolved)
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return "", fmt.Errorf("%s is a hidden file or in a hidden directory, which may not be sent", name)
+		}
+	}
+	if inDir(resolved, resolvePath("store")) && !inDir(resolved, resolvePath(mediaBlobDir)) && !inDir(resolved, resolvePath(mediaExportDir)) {
+		return "", fmt.Errorf("%s is part of the bridge's store, only downloaded media and exports may be sent from it", name)
+	}
+	for _, denied := range p.deny {
+		if inDir(resolved, resolvePath(expandHome(denied))) {
+			return "", fmt.Errorf("%s is denied by api.media_deny (%s)", name, denied)
+		}
+	}
+
+	if resolveErr != nil {
+		return "", fmt.Errorf("media file not found: %s", mediaPath)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("media file not found: %s", mediaPath)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", mediaPath)
+	}
+	if info.Size() > p.maxSize {
+		return "", fmt.Errorf("%s is %.1f MB, more than the %d MB files may have (api.media_max_size_mb)", mediaPath, float64(info.Size())/(1024*1024), p.maxSize/(1024*1024))
+	}
+	return resolved, nil
+}
+
+// root returns the allowed directory path is in
+func (p *MediaPolicy) root(path string) (string, bool) {
+	for _, dir := range p.dirs {
+		if root := resolvePath(expandHome(dir)); inDir(path, root) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// Audit appends a refused file to the audit log
+func (p *MediaPolicy) Audit(entry MediaAuditEntry) {
+	entry.Time = time.Now().UTC()
+	fmt.Printf("Refused to send media %s: %s\n", entry.Path, entry.Reason)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := os.OpenFile(mediaAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Printf("Failed to write media audit log: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Printf("Failed to write media audit log: %v\n", err)
+	}
+}
+
+// handleCheckMedia lets the MCP server check a file against the policy before it reads or
+// converts it
+func handleCheckMedia(policy *MediaPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req CheckMediaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.MediaPath == "" {
+			http.Error(w, "Media path is required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		path, err := policy.Check(req.MediaPath)
+		if err != nil {
+			policy.Audit(MediaAuditEntry{Path: req.MediaPath, Reason: err.Error(), Recipient: req.Recipient, Client: req.Client, Remote: r.RemoteAddr})
+			json.NewEncoder(w).Encode(CheckMediaResponse{Allowed: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(CheckMediaResponse{Allowed: true, Path: path})
+	}
+}
+
+// resolvePath returns the absolute path with symlinks resolved, or just the absolute path if
+// it doesn't exist
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// expandHome replaces a leading ~ with the home directory
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~"); ok && (rest == "" || rest[0] == '/' || rest[0] == filepath.Separator) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + rest
+		}
+	}
+	return path
+}
+
+// inDir reports whether path is dir or inside it
+func inDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
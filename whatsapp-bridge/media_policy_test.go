@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMediaPolicyCheck(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	bridge := filepath.Join(root, "bridge")
+	t.Setenv("HOME", home)
+
+	files := map[string]int64{
+		"home/photo.jpg":                 10,
+		"home/docs/report.pdf":           10,
+		"home/.hidden.jpg":               10,
+		"home/.ssh/id_rsa":               10,
+		"home/secret/plan.pdf":           10,
+		"home/big.mp4":                   1024*1024 + 1,
+		"outside/file.jpg":               10,
+		"bridge/store/messages.db":       10,
+		"bridge/store/api_token":         10,
+		"bridge/store/media/ab/abc.jpg":  10,
+		"bridge/store/exports/chat/a.gz": 10,
+	}
+	for name, size := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(size); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	links := map[string]string{
+		"home/link-to-photo.jpg":   "photo.jpg",
+		"home/link-to-outside.jpg": "../outside/file.jpg",
+		"home/link-to-key":         ".ssh/id_rsa",
+		"home/link-to-store.db":    "../bridge/store/messages.db",
+		"home/link-to-secret.pdf":  "secret/plan.pdf",
+		"home/dangling.jpg":        "missing.jpg",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The store is found relative to the working directory, like the bridge does
+	t.Chdir(bridge)
+
+	policy := NewMediaPolicy(APIConfig{
+		MediaDirs:      []string{"~", bridge},
+		MediaDeny:      []string{"~/secret"},
+		MediaMaxSizeMB: 1,
+	})
+	tests := []struct {
+		path string
+		want string // the file sent, relative to root, or empty if it is refused
+		err  string // part of the reason it is refused
+	}{
+		{"home/photo.jpg", "home/photo.jpg", ""},
+		{"home/docs/report.pdf", "home/docs/report.pdf", ""},
+		{"home/docs/../photo.jpg", "home/photo.jpg", ""},
+		{"home/link-to-photo.jpg", "home/photo.jpg", ""},
+		{"bridge/store/media/ab/abc.jpg", "bridge/store/media/ab/abc.jpg", ""},
+		{"bridge/store/exports/chat/a.gz", "bridge/store/exports/chat/a.gz", ""},
+
+		{"outside/file.jpg", "", "outside the directories"},
+		{"home/../outside/file.jpg", "", "outside the directories"},
+		{"home/link-to-outside.jpg", "", "outside the directories"},
+		{"outside/missing.jpg", "", "outside the directories"}, // doesn't tell whether it exists
+		{"home/.hidden.jpg", "", "hidden"},
+		{"home/.ssh/id_rsa", "", "hidden"},
+		{"home/link-to-key", "", "hidden"},
+		{"bridge/store/messages.db", "", "bridge's store"},
+		{"bridge/store/api_token", "", "bridge's store"},
+		{"home/link-to-store.db", "", "bridge's store"},
+		{"home/secret/plan.pdf", "", "api.media_deny"},
+		{"home/link-to-secret.pdf", "", "api.media_deny"},
+		{"home/missing.jpg", "", "not found"},
+		{"home/dangling.jpg", "", "not found"},
+		{"home/docs", "", "not a regular file"},
+		{"home/big.mp4", "", "media_max_size_mb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := policy.Check(filepath.Join(root, tt.path))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Check = %q, %v, want an error about %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			want := resolvePath(filepath.Join(root, tt.want))
+			if got != want {
+				t.Errorf("Check = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Relative paths are read from the working directory
+	if _, err := policy.Check("store/media/ab/abc.jpg"); err != nil {
+		t.Errorf("Check of a relative path: %v", err)
+	}
+}
+
+func TestInDir(t *testing.T) {
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/home/a/photo.jpg", "/home/a", true},
+		{"/home/a", "/home/a", true},
+		{"/home/a/b/c", "/home/a", true},
+		{"/home/ab/photo.jpg", "/home/a", false},
+		{"/home/photo.jpg", "/home/a", false},
+		{"/home/a/..foo", "/home/a", true},
+		{"/", "/home/a", false},
+	}
+	for _, tt := range tests {
+		if got := inDir(tt.path, tt.dir); got != tt.want {
+			t.Errorf("inDir(%q, %q) = %v, want %v", tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
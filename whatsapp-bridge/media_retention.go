@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MediaStats summarizes the disk space used by downloaded media
+type MediaStats struct {
+	TotalSize    int64                 `json:"total_size"`
+	BlobCount    int                   `json:"blob_count"`
+	MessageCount int                   `json:"message_count"`
+	PinnedSize   int64                 `json:"pinned_size"`
+	PinnedCount  int                   `json:"pinned_count"`
+	OldestAccess *time.Time            `json:"oldest_access,omitempty"`
+	ByMediaType  map[string]MediaUsage `json:"by_media_type"`
+	TopChats     []ChatMediaUsage      `json:"top_chats"`
+	Policy       MediaRetentionConfig  `json:"policy"`
+	LastGC       *MediaGCResult        `json:"last_gc,omitempty"`
+}
+
+// MediaUsage is the number and total size of a group of blobs
+type MediaUsage struct {
+	Count int   `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+// ChatMediaUsage is the media usage attributed to a single chat
+type ChatMediaUsage struct {
+	ChatJID string `json:"chat_jid"`
+	Name    string `json:"name,omitempty"`
+	Count   int    `json:"count"`
+	Size    int64  `json:"size"`
+}
+
+// MediaGCResult describes a garbage collector run
+type MediaGCResult struct {
+	StartedAt    time.Time     `json:"started_at"`
+	Duration     time.Duration `json:"duration"`
+	DeletedCount int           `json:"deleted_count"`
+	DeletedSize  int64         `json:"deleted_size"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// mediaBlobUsage is a blob together with the messages that link to it
+type mediaBlobUsage struct {
+	MediaBlob
+	Pinned bool
+	Chats  []string
+}
+
+// MediaGC enforces the media retention policy
+type MediaGC struct {
+	store  *MessageStore
+	config MediaRetentionConfig
+
+	running sync.Mutex // held for the whole of a run, so runs don't overlap
+
+	mu      sync.Mutex // guards lastRun
+	lastRun *MediaGCResult
+}
+
+// NewMediaGC creates a garbage collector for the given retention policy
+func NewMediaGC(store *MessageStore, config MediaRetentionConfig) *MediaGC {
+	return &MediaGC{store: store, config: config}
+}
+
+// Start runs the garbage collector once and then periodically in the background
+func (gc *MediaGC) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(gc.config.GCInterval))
+		defer ticker.Stop()
+		for {
+			gc.Run()
+			<-ticker.C
+		}
+	}()
+}
+
+// LastRun returns the result of the most recent garbage collector run
+func (gc *MediaGC) LastRun() *MediaGCResult {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.lastRun
+}
+
+// Run deletes expired media and then evicts the least recently used media until
+// every size limit is met. Pinned media and media covered by a "keep" rule are never deleted.
+func (gc *MediaGC) Run() *MediaGCResult {
+	gc.running.Lock()
+	defer gc.running.Unlock()
+
+	result := &MediaGCResult{StartedAt: time.Now()}
+	defer func() {
+		result.Duration = time.Since(result.StartedAt)
+		gc.mu.Lock()
+		gc.lastRun = result
+		gc.mu.Unlock()
+		if result.DeletedCount > 0 || result.Error != "" {
+			fmt.Printf("Media GC: deleted %d files (%d bytes) in %s %s\n", result.DeletedCount, result.DeletedSize, result.Duration, result.Error)
+		}
+	}()
+
+	blobs, err := gc.store.listMediaBlobUsage()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	now := time.Now()
+	var remaining []*mediaBlobUsage
+	for _, blob := range blobs {
+		if gc.deletable(blob) && gc.expired(blob, now) && gc.delete(blob, result) {
+			continue
+		}
+		remaining = append(remaining, blob)
+	}
+
+	// Least recently used first
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].LastAccessed.Before(remaining[j].LastAccessed)
+	})
+
+	// Per-rule size limits, counting only the media each rule governs
+	for i := range gc.config.Rules {
+		rule := &gc.config.Rules[i]
+		if rule.MaxTotalSizeMB <= 0 || rule.Keep {
+			continue
+		}
+		remaining = gc.evict(remaining, rule.MaxTotalSizeMB*1024*1024, func(blob *mediaBlobUsage) bool {
+			return gc.ruleFor(blob) == rule
+		}, result)
+	}
+
+	// Global size limit
+	if gc.config.MaxTotalSizeMB > 0 {
+		gc.evict(remaining, gc.config.MaxTotalSizeMB*1024*1024, func(*mediaBlobUsage) bool { return true }, result)
+	}
+
+	return result
+}
+
+// ruleFor returns the first retention rule matching any chat the blob belongs to
+func (gc *MediaGC) ruleFor(blob *mediaBlobUsage) *MediaRetentionRule {
+	for i := range gc.config.Rules {
+		for _, chat := range blob.Chats {
+			if gc.config.Rules[i].Matches(chat, blob.MediaType) {
+				return &gc.config.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// deletable reports whether the policy allows the blob to be deleted at all
+func (gc *MediaGC) deletable(blob *mediaBlobUsage) bool {
+	if blob.Pinned {
+		return false
+	}
+	if rule := gc.ruleFor(blob); rule != nil && rule.Keep {
+		return false
+	}
+	return true
+}
+
+// expired reports whether the blob is older than the max age that applies to it
+func (gc *MediaGC) expired(blob *mediaBlobUsage, now time.Time) bool {
+	maxAge := time.Duration(gc.config.MaxAge)
+	if rule := gc.ruleFor(blob); rule != nil && rule.MaxAge > 0 {
+		maxAge = time.Duration(rule.MaxAge)
+	}
+	return maxAge > 0 && now.Sub(blob.CreatedAt) > maxAge
+}
+
+// evict deletes the least recently used matching blobs until their total size is
+// within limit, and returns the blobs that are left
+func (gc *MediaGC) evict(blobs []*mediaBlobUsage, limit int64, matches func(*mediaBlobUsage) bool, result *MediaGCResult) []*mediaBlobUsage {
+	var total int64
+	for _, blob := range blobs {
+		if matches(blob) {
+			total += blob.Size
+		}
+	}
+
+	var remaining []*mediaBlobUsage
+	for _, blob := range blobs {
+		if total > limit && matches(blob) && gc.deletable(blob) && gc.delete(blob, result) {
+			total -= blob.Size
+			continue
+		}
+		remaining = append(remaining, blob)
+	}
+	return remaining
+}
+
+// delete removes a blob, its per-message links and its database records, and reports
+// whether it did. Blobs used or pinned since they were listed are kept.
+func (gc *MediaGC) delete(blob *mediaBlobUsage, result *MediaGCResult) bool {
+	mediaBlobsMu.Lock()
+	deleted, err := gc.store.DeleteMediaBlob(blob.SHA256, blob.LastAccessed)
+	mediaBlobsMu.Unlock()
+	if err != nil {
+		fmt.Printf("Media GC: failed to delete %s: %v\n", blob.SHA256, err)
+		return false
+	}
+	if !deleted {
+		return false
+	}
+	result.DeletedCount++
+	result.DeletedSize += blob.Size
+	return true
+}
+
+// listMediaBlobUsage returns every stored blob with its pin state and the chats linking to it
+func (store *MessageStore) listMediaBlobUsage() ([]*mediaBlobUsage, error) {
+	rows, err := store.db.Query(`
+		SELECT b.sha256, b.path, b.size, COALESCE(b.media_type, ''), b.created_at, b.last_accessed,
+			COALESCE(MAX(m.pinned), 0), COALESCE(GROUP_CONCAT(m.chat_jid, ' '), '')
+		FROM media_blobs b
+		LEFT JOIN message_media m ON m.sha256 = b.sha256
+		GROUP BY b.sha256
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []*mediaBlobUsage
+	for rows.Next() {
+		var blob mediaBlobUsage
+		var chats string
+		if err := rows.Scan(&blob.SHA256, &blob.Path, &blob.Size, &blob.MediaType, &blob.CreatedAt, &blob.LastAccessed, &blob.Pinned, &chats); err != nil {
+			return nil, err
+		}
+		blob.Chats = strings.Fields(chats)
+		if len(blob.Chats) == 0 {
+			blob.Chats = []string{""}
+		}
+		blobs = append(blobs, &blob)
+	}
+	return blobs, rows.Err()
+}
+
+// DeleteMediaBlob removes a blob file together with the links pointing at it. The blob is
+// kept, and false returned, if it was accessed after lastAccessed or is pinned.
+func (store *MessageStore) DeleteMediaBlob(sha string, lastAccessed time.Time) (bool, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var path string
+	var accessed time.Time
+	var pinned bool
+	err = tx.QueryRow(`
+		SELECT b.path, b.last_accessed, COALESCE(MAX(m.pinned), 0)
+		FROM media_blobs b
+		LEFT JOIN message_media m ON m.sha256 = b.sha256
+		WHERE b.sha256 = ?
+		GROUP BY b.sha256
+	`, sha).Scan(&path, &accessed, &pinned)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	if accessed.After(lastAccessed) || pinned {
+		tx.Rollback()
+		return false, nil
+	}
+
+	rows, err := tx.Query("SELECT chat_jid, export_name FROM message_media WHERE sha256 = ?", sha)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var links []string
+	for rows.Next() {
+		var chatJID, exportName string
+		if err := rows.Scan(&chatJID, &exportName); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return false, err
+		}
+		links = append(links, filepath.Join(chatMediaDir(chatJID), exportName))
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM message_media WHERE sha256 = ?", sha); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM media_blobs WHERE sha256 = ?", sha); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	for _, link := range links {
+		// Only remove symlinks, never files we didn't create
+		if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(link)
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// SetMediaPinned pins or unpins the media of a message. Pinned media is never deleted.
+func (store *MessageStore) SetMediaPinned(messageID, chatJID string, pinned bool) error {
+	res, err := store.db.Exec(
+		"UPDATE message_media SET pinned = ? WHERE message_id = ? AND chat_jid = ?",
+		pinned, messageID, chatJID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no downloaded media for message %s in chat %s", messageID, chatJID)
+	}
+	return nil
+}
+
+// GetMediaStats computes the current media storage usage
+func (store *MessageStore) GetMediaStats(topChats int) (*MediaStats, error) {
+	stats := &MediaStats{
+		ByMediaType: make(map[string]MediaUsage),
+	}
+
+	blobs, err := store.listMediaBlobUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	byChat := make(map[string]*ChatMediaUsage)
+	for _, blob := range blobs {
+		stats.TotalSize += blob.Size
+		stats.BlobCount++
+
+		usage := stats.ByMediaType[blob.MediaType]
+		usage.Count++
+		usage.Size += blob.Size
+		stats.ByMediaType[blob.MediaType] = usage
+
+		if blob.Pinned {
+			stats.PinnedCount++
+			stats.PinnedSize += blob.Size
+		}
+		if stats.OldestAccess == nil || blob.LastAccessed.Before(*stats.OldestAccess) {
+			accessed := blob.LastAccessed
+			stats.OldestAccess = &accessed
+		}
+
+		// Attribute the blob to every chat that references it
+		for _, chat := range blob.Chats {
+			if chat == "" {
+				continue
+			}
+			if byChat[chat] == nil {
+				byChat[chat] = &ChatMediaUsage{ChatJID: chat}
+			}
+			byChat[chat].Count++
+			byChat[chat].Size += blob.Size
+		}
+	}
+
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM message_media").Scan(&stats.MessageCount); err != nil {
+		return nil, err
+	}
+
+	for _, usage := range byChat {
+		stats.TopChats = append(stats.TopChats, *usage)
+	}
+	sort.Slice(stats.TopChats, func(i, j int) bool {
+		return stats.TopChats[i].Size > stats.TopChats[j].Size
+	})
+	if len(stats.TopChats) > topChats {
+		stats.TopChats = stats.TopChats[:topChats]
+	}
+	for i := range stats.TopChats {
+		var name string
+		if err := store.db.QueryRow("SELECT name FROM chats WHERE jid = ?", stats.TopChats[i].ChatJID).Scan(&name); err == nil {
+			stats.TopChats[i].Name = name
+		}
+	}
+
+	return stats, nil
+}
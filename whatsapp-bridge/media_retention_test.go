@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeleteMediaBlobRechecks(t *testing.T) {
+	store := newTestStore(t)
+	t.Chdir(t.TempDir())
+
+	listedAt := time.Now().Add(-time.Hour).UTC()
+	storeBlob := func(sha string) *MediaBlob {
+		t.Helper()
+		path, err := writeMediaBlob(sha, ".jpg", []byte(sha))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob := &MediaBlob{SHA256: sha, Path: path, Size: 3, MediaType: "image", CreatedAt: listedAt, LastAccessed: listedAt}
+		if err := store.StoreMediaBlob(blob); err != nil {
+			t.Fatal(err)
+		}
+		return blob
+	}
+	deleted := func(blob *MediaBlob) bool {
+		t.Helper()
+		ok, err := store.DeleteMediaBlob(blob.SHA256, listedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, statErr := os.Stat(blob.Path)
+		if ok != os.IsNotExist(statErr) {
+			t.Errorf("DeleteMediaBlob(%s) = %v, but the file exists: %v", blob.SHA256, ok, statErr == nil)
+		}
+		return ok
+	}
+
+	unused := storeBlob("aaa")
+	if !deleted(unused) {
+		t.Error("a blob unused since it was listed was kept")
+	}
+	if ok, err := store.DeleteMediaBlob(unused.SHA256, listedAt); ok || err != nil {
+		t.Errorf("deleting a blob twice = %v, %v", ok, err)
+	}
+
+	// Used by a download after the GC listed it
+	used := storeBlob("bbb")
+	if err := store.TouchMediaBlob(used.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if deleted(used) {
+		t.Error("a blob used since it was listed was deleted")
+	}
+
+	// Pinned after the GC listed it
+	pinned := storeBlob("ccc")
+	if err := store.LinkMessageMedia("m1", "123@s.whatsapp.net", pinned.SHA256, "photo_m1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMediaPinned("m1", "123@s.whatsapp.net", true); err != nil {
+		t.Fatal(err)
+	}
+	if deleted(pinned) {
+		t.Error("a pinned blob was deleted")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waMmsRetry"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// How long to wait for the phone to answer a media retry request
+const mediaRetryTimeout = 60 * time.Second
+
+// mediaRetries routes media retry responses from the phone to the downloads waiting for them
+var mediaRetries = &mediaRetryWaiters{}
+
+// mediaRetryWaiters maps message IDs to the channels waiting for their retry response
+type mediaRetryWaiters struct {
+	mu      sync.Mutex
+	waiters map[types.MessageID][]chan *events.MediaRetry
+}
+
+// wait registers interest in the retry response for a message. The returned
+// function must be called to unregister once the caller stops waiting.
+func (m *mediaRetryWaiters) wait(messageID types.MessageID) (<-chan *events.MediaRetry, func()) {
+	ch := make(chan *events.MediaRetry, 1)
+
+	m.mu.Lock()
+	if m.waiters == nil {
+		m.waiters = make(map[types.MessageID][]chan *events.MediaRetry)
+	}
+	m.waiters[messageID] = append(m.waiters[messageID], ch)
+	m.mu.Unlock()
+
+	cancel := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		waiters := m.waiters[messageID]
+		for i, waiter := range waiters {
+			if waiter == ch {
+				m.waiters[messageID] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(m.waiters[messageID]) == 0 {
+			delete(m.waiters, messageID)
+		}
+	}
+	return ch, cancel
+}
+
+// deliver hands a retry response to everyone waiting for it
+func (m *mediaRetryWaiters) deliver(evt *events.MediaRetry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.waiters[evt.MessageID] {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
+
+// isMediaExpiredError reports whether a download failed because the media is no
+// longer available on the WhatsApp servers
+func isMediaExpiredError(err error) bool {
+	return errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410)
+}
+
+// senderJID rebuilds the sender JID from the stored sender, which is either a full JID
+// or just the user part
+func senderJID(sender string) (types.JID, error) {
+	if strings.Contains(sender, "@") {
+		return types.ParseJID(sender)
+	}
+	return types.NewJID(sender, types.DefaultUserServer), nil
+}
+
+// requestMediaRetry asks the phone to re-upload the media of a message and waits for
+// the answer. It returns the new direct path of the media.
+func requestMediaRetry(client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string, mediaKey []byte) (string, error) {
+	var sender string
+	var isFromMe bool
+	err := messageStore.db.QueryRow(
+		"SELECT sender, is_from_me FROM messages WHERE id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&sender, &isFromMe)
+	if err != nil {
+		return "", fmt.Errorf("failed to find message: %v", err)
+	}
+
+	chat, err := types.ParseJID(chatJID)
+	if err != nil {
+		return "", fmt.Errorf("invalid chat JID: %v", err)
+	}
+
+	info := &types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     chat,
+			IsFromMe: isFromMe,
+			IsGroup:  chat.Server == types.GroupServer,
+		},
+		ID: messageID,
+	}
+	if info.IsGroup {
+		if isFromMe && client.Store.ID != nil {
+			info.Sender = client.Store.ID.ToNonAD()
+		} else if info.Sender, err = senderJID(sender); err != nil {
+			return "", fmt.Errorf("invalid sender JID: %v", err)
+		}
+	}
+
+	// Register before sending so a fast answer isn't missed
+	responses, cancel := mediaRetries.wait(messageID)
+	defer cancel()
+
+	fmt.Printf("Media for message %s has expired, asking the phone to re-upload it...\n", messageID)
+	if err := client.SendMediaRetryReceipt(info, mediaKey); err != nil {
+		return "", fmt.Errorf("failed to send media retry request: %v", err)
+	}
+
+	var evt *events.MediaRetry
+	select {
+	case evt = <-responses:
+	case <-time.After(mediaRetryTimeout):
+		return "", fmt.Errorf("media has expired and the phone did not answer the re-upload request within %s (is it online?)", mediaRetryTimeout)
+	}
+
+	retryData, err := whatsmeow.DecryptMediaRetryNotification(evt, mediaKey)
+	if err != nil {
+		if errors.Is(err, whatsmeow.ErrMediaNotAvailableOnPhone) {
+			return "", fmt.Errorf("media has expired and is no longer available on the phone")
+		}
+		return "", fmt.Errorf("media has expired and the re-upload request failed: %v", err)
+	}
+	if retryData.GetResult() != waMmsRetry.MediaRetryNotification_SUCCESS {
+		return "", fmt.Errorf("media has expired and the phone could not re-upload it (%s)", retryData.GetResult())
+	}
+	if retryData.GetDirectPath() == "" {
+		return "", fmt.Errorf("media has expired and the phone did not return a new location")
+	}
+
+	return retryData.GetDirectPath(), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// migration is one versioned step of the messages.db schema. Migrations run in order,
+// each inside its own transaction, and are recorded in schema_migrations once applied.
+//
+// Databases created before versioning existed already contain some of these tables and
+// columns, so migrations must tolerate finding their changes partially applied.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. Never edit or reorder a released
+// migration; append a new one instead and bump the supported range in the MCP server.
+var migrations = []migration{
+	{1, "chats and messages", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS chats (
+				jid TEXT PRIMARY KEY,
+				name TEXT,
+				last_message_time TIMESTAMP
+			);
+
+			CREATE TABLE IF NOT EXISTS messages (
+				id TEXT,
+				chat_jid TEXT,
+				sender TEXT,
+				content TEXT,
+				timestamp TIMESTAMP,
+				is_from_me BOOLEAN,
+				media_type TEXT,
+				filename TEXT,
+				url TEXT,
+				media_key BLOB,
+				file_sha256 BLOB,
+				file_enc_sha256 BLOB,
+				file_length INTEGER,
+				PRIMARY KEY (id, chat_jid),
+				FOREIGN KEY (chat_jid) REFERENCES chats(jid)
+			);
+		`)
+		return err
+	}},
+	{2, "content-addressed media blobs", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS media_blobs (
+				sha256 TEXT PRIMARY KEY,
+				path TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				media_type TEXT,
+				created_at TIMESTAMP NOT NULL,
+				last_accessed TIMESTAMP NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS message_media (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				sha256 TEXT NOT NULL,
+				export_name TEXT NOT NULL,
+				PRIMARY KEY (message_id, chat_jid),
+				FOREIGN KEY (sha256) REFERENCES media_blobs(sha256)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_message_media_sha256 ON message_media(sha256);
+		`)
+		return err
+	}},
+	{3, "media pinning", func(tx *sql.Tx) error {
+		return addColumn(tx, "message_media", "pinned", "BOOLEAN NOT NULL DEFAULT 0")
+	}},
+	{4, "media details from the message proto", func(tx *sql.Tx) error {
+		for _, column := range []struct{ name, decl string }{
+			{"direct_path", "TEXT"},
+			{"mimetype", "TEXT"},
+			{"media_key_timestamp", "INTEGER"},
+			{"width", "INTEGER"},
+			{"height", "INTEGER"},
+			{"duration", "INTEGER"},
+			{"thumbnail", "BLOB"},
+		} {
+			if err := addColumn(tx, "messages", column.name, column.decl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{5, "history sync backfill tracking", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS history_sync_backfill (
+				file TEXT PRIMARY KEY,
+				processed_at TIMESTAMP NOT NULL
+			);
+		`)
+		return err
+	}},
+	{6, "media captions", func(tx *sql.Tx) error {
+		return addColumn(tx, "messages", "caption", "TEXT")
+	}},
+	{7, "reply references", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "messages", "reply_to_id", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_messages_reply_to_id ON messages(reply_to_id)")
+		return err
+	}},
+	{8, "message embeddings for semantic search", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS message_embeddings (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				model TEXT NOT NULL,
+				vector BLOB NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (message_id, chat_jid)
+			);
+		`)
+		return err
+	}},
+	{9, "timestamps in UTC", func(tx *sql.Tx) error {
+		// Times are compared as text, which only works if they all have the same offset
+		for _, column := range []struct{ table, name string }{
+			{"chats", "last_message_time"},
+			{"messages", "timestamp"},
+			{"media_blobs", "created_at"},
+			{"media_blobs", "last_accessed"},
+			{"history_sync_backfill", "processed_at"},
+			{"message_embeddings", "created_at"},
+			{"schema_migrations", "applied_at"},
+		} {
+			if err := convertTimesToUTC(tx, column.table, column.name); err != nil {
+				return fmt.Errorf("%s.%s: %v", column.table, column.name, err)
+			}
+		}
+		return nil
+	}},
+	{10, "message reactions", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS message_reactions (
+				message_id TEXT NOT NULL,
+				chat_jid TEXT NOT NULL,
+				sender TEXT NOT NULL,
+				is_from_me BOOLEAN NOT NULL,
+				emoji TEXT NOT NULL,
+				timestamp TIMESTAMP NOT NULL,
+				PRIMARY KEY (message_id, chat_jid, sender)
+			);
+		`)
+		return err
+	}},
+}
+
+// schemaVersion is the version of the schema after all migrations have run
+var schemaVersion = migrations[len(migrations)-1].version
+
+// migrate brings the database schema up to date
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if current > schemaVersion {
+		return fmt.Errorf("messages.db has schema version %d but this bridge only knows up to version %d, please update the bridge", current, schemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		fmt.Printf("Applied database migration %d: %s\n", m.version, m.description)
+	}
+	return nil
+}
+
+// applyMigration runs a single migration and records it, all or nothing
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := m.up(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
+		m.version, m.description, time.Now().UTC(),
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumn adds a column to a table unless it already exists
+func addColumn(tx *sql.Tx, table, column, decl string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// convertTimesToUTC rewrites the values of a timestamp column that were stored with another
+// offset, in the format the SQLite driver writes times in
+func convertTimesToUTC(tx *sql.Tx, table, column string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, CAST(%s AS TEXT) FROM %s WHERE %s IS NOT NULL", column, table, column))
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[int64]string)
+	for rows.Next() {
+		var rowID int64
+		var value string
+		if err := rows.Scan(&rowID, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		t, ok := parseStoredTime(value)
+		if !ok {
+			continue
+		}
+		if utc := t.UTC().Format(sqlite3.SQLiteTimestampFormats[0]); utc != value {
+			updates[rowID] = utc
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	stmt, err := tx.Prepare(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for rowID, value := range updates {
+		if _, err := stmt.Exec(value, rowID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStoredTime parses a time the way the SQLite driver does when reading a TIMESTAMP column
+func parseStoredTime(value string) (time.Time, bool) {
+	value = strings.TrimSuffix(value, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(format, value, time.UTC); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
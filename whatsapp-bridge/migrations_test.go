@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// Schemas of messages.db written by bridges from before schema versioning
+const (
+	// originalSchema is what the first release of the bridge created
+	originalSchema = `
+		CREATE TABLE chats (
+			jid TEXT PRIMARY KEY,
+			name TEXT,
+			last_message_time TIMESTAMP
+		);
+
+		CREATE TABLE messages (
+			id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			content TEXT,
+			timestamp TIMESTAMP,
+			is_from_me BOOLEAN,
+			media_type TEXT,
+			filename TEXT,
+			url TEXT,
+			media_key BLOB,
+			file_sha256 BLOB,
+			file_enc_sha256 BLOB,
+			file_length INTEGER,
+			PRIMARY KEY (id, chat_jid),
+			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
+		);
+	`
+
+	// preVersioningSchema is what the last bridge without schema_migrations created, with
+	// some of the tables and columns of later migrations already there
+	preVersioningSchema = `
+		CREATE TABLE chats (
+			jid TEXT PRIMARY KEY,
+			name TEXT,
+			last_message_time TIMESTAMP
+		);
+
+		CREATE TABLE messages (
+			id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			content TEXT,
+			timestamp TIMESTAMP,
+			is_from_me BOOLEAN,
+			media_type TEXT,
+			filename TEXT,
+			url TEXT,
+			media_key BLOB,
+			file_sha256 BLOB,
+			file_enc_sha256 BLOB,
+			file_length INTEGER,
+			direct_path TEXT,
+			mimetype TEXT,
+			media_key_timestamp INTEGER,
+			width INTEGER,
+			height INTEGER,
+			duration INTEGER,
+			thumbnail BLOB,
+			PRIMARY KEY (id, chat_jid),
+			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
+		);
+
+		CREATE TABLE media_blobs (
+			sha256 TEXT PRIMARY KEY,
+			path TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			media_type TEXT,
+			created_at TIMESTAMP NOT NULL,
+			last_accessed TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE message_media (
+			message_id TEXT NOT NULL,
+			chat_jid TEXT NOT NULL,
+			sha256 TEXT NOT NULL,
+			export_name TEXT NOT NULL,
+			pinned BOOLEAN NOT NULL DEFAULT 0,
+			PRIMARY KEY (message_id, chat_jid),
+			FOREIGN KEY (sha256) REFERENCES media_blobs(sha256)
+		);
+
+		CREATE INDEX idx_message_media_sha256 ON message_media(sha256);
+
+		CREATE TABLE history_sync_backfill (
+			file TEXT PRIMARY KEY,
+			processed_at TIMESTAMP NOT NULL
+		);
+	`
+)
+
+// Times the fixtures store, before and after migration 9 converts them to UTC
+const (
+	fixtureLocalTime = "2026-03-01 14:00:00+01:00"
+	fixtureUTCTime   = "2026-03-01 13:00:00+00:00"
+)
+
+// openTestDB opens an empty messages.db in a temporary directory
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "messages.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// migrateTo builds the schema of a bridge that knew migrations up to version
+func migrateTo(t *testing.T, db *sql.DB, version int) {
+	t.Helper()
+	if _, err := db.Exec(`
+		CREATE TABLE schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:version] {
+		if err := applyMigration(db, m); err != nil {
+			t.Fatalf("migration %d: %v", m.version, err)
+		}
+	}
+}
+
+// insertFixtureMessage stores a chat with a message at the given time, with downloaded media
+// if the schema has the media tables
+func insertFixtureMessage(t *testing.T, db *sql.DB, timestamp string, withMedia bool) {
+	t.Helper()
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO chats (jid, name, last_message_time) VALUES ('123@s.whatsapp.net', 'Alice', ?)", []any{timestamp}},
+		{"INSERT INTO messages (id, chat_jid, sender, content, timestamp, is_from_me) VALUES ('m1', '123@s.whatsapp.net', '123', 'meet at the harbour', ?, 0)", []any{timestamp}},
+	}
+	if withMedia {
+		statements = append(statements, []struct {
+			query string
+			args  []any
+		}{
+			{"INSERT INTO media_blobs (sha256, path, size, media_type, created_at, last_accessed) VALUES ('abc', 'store/media/ab/abc.jpg', 10, 'image', ?, ?)", []any{timestamp, timestamp}},
+			{"INSERT INTO message_media (message_id, chat_jid, sha256, export_name) VALUES ('m1', '123@s.whatsapp.net', 'abc', 'm1.jpg')", nil},
+		}...)
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement.query, statement.args...); err != nil {
+			t.Fatalf("%s: %v", statement.query, err)
+		}
+	}
+}
+
+// columns returns the column names of a table
+func columns(t *testing.T, db *sql.DB, table string) map[string]bool {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// appliedVersions returns the versions recorded in schema_migrations
+func appliedVersions(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func TestMigrateUpgradesPastVersions(t *testing.T) {
+	type fixture struct {
+		name  string
+		build func(t *testing.T, db *sql.DB)
+		media bool // whether the fixture has downloaded media
+		utc   bool // whether the fixture already stores times in UTC
+	}
+	fixtures := []fixture{
+		{"original", func(t *testing.T, db *sql.DB) {
+			if _, err := db.Exec(originalSchema); err != nil {
+				t.Fatal(err)
+			}
+		}, false, false},
+		{"pre-versioning", func(t *testing.T, db *sql.DB) {
+			if _, err := db.Exec(preVersioningSchema); err != nil {
+				t.Fatal(err)
+			}
+		}, true, false},
+	}
+	for version := 1; version < schemaVersion; version++ {
+		version := version
+		fixtures = append(fixtures, fixture{
+			name:  fmt.Sprintf("version %d", version),
+			build: func(t *testing.T, db *sql.DB) { migrateTo(t, db, version) },
+			media: version >= 2,
+			utc:   version >= 9,
+		})
+	}
+
+	for _, f := range fixtures {
+		t.Run(f.name, func(t *testing.T) {
+			db := openTestDB(t)
+			f.build(t, db)
+			stored := fixtureLocalTime
+			if f.utc {
+				stored = fixtureUTCTime
+			}
+			insertFixtureMessage(t, db, stored, f.media)
+
+			if err := migrate(db); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+
+			versions := appliedVersions(t, db)
+			if len(versions) != schemaVersion {
+				t.Fatalf("schema_migrations has versions %v, want 1 to %d", versions, schemaVersion)
+			}
+			for i, version := range versions {
+				if version != i+1 {
+					t.Fatalf("schema_migrations has versions %v, want 1 to %d", versions, schemaVersion)
+				}
+			}
+
+			want := map[string][]string{
+				"chats":                 {"jid", "name", "last_message_time"},
+				"messages":              {"id", "chat_jid", "content", "timestamp", "direct_path", "mimetype", "thumbnail", "caption", "reply_to_id"},
+				"media_blobs":           {"sha256", "path", "created_at", "last_accessed"},
+				"message_media":         {"message_id", "chat_jid", "sha256", "export_name", "pinned"},
+				"history_sync_backfill": {"file", "processed_at"},
+				"message_embeddings":    {"message_id", "chat_jid", "model", "vector", "created_at"},
+				"message_reactions":     {"message_id", "chat_jid", "sender", "emoji", "timestamp"},
+			}
+			for table, names := range want {
+				have := columns(t, db, table)
+				for _, name := range names {
+					if !have[name] {
+						t.Errorf("%s has no column %s after migrating", table, name)
+					}
+				}
+			}
+
+			// Migration 9 rewrites times stored with another offset to UTC
+			for _, query := range []string{
+				"SELECT CAST(timestamp AS TEXT) FROM messages WHERE id = 'm1'",
+				"SELECT CAST(last_message_time AS TEXT) FROM chats",
+			} {
+				var value string
+				if err := db.QueryRow(query).Scan(&value); err != nil {
+					t.Fatal(err)
+				}
+				if value != fixtureUTCTime {
+					t.Errorf("%s = %q, want %q", query, value, fixtureUTCTime)
+				}
+			}
+			if f.media {
+				var createdAt, lastAccessed string
+				if err := db.QueryRow("SELECT CAST(created_at AS TEXT), CAST(last_accessed AS TEXT) FROM media_blobs").Scan(&createdAt, &lastAccessed); err != nil {
+					t.Fatal(err)
+				}
+				if createdAt != fixtureUTCTime || lastAccessed != fixtureUTCTime {
+					t.Errorf("media_blobs times are %q and %q, want %q", createdAt, lastAccessed, fixtureUTCTime)
+				}
+			}
+
+			// The full-text index is built over the migrated messages where FTS5 is available
+			enabled, err := ensureFullTextIndex(db)
+			if err != nil {
+				t.Fatalf("ensureFullTextIndex: %v", err)
+			}
+			if enabled {
+				var id string
+				if err := db.QueryRow("SELECT m.id FROM messages_fts JOIN messages m ON m.rowid = messages_fts.rowid WHERE messages_fts MATCH 'harbour'").Scan(&id); err != nil {
+					t.Errorf("full-text search for the fixture message: %v", err)
+				}
+			}
+
+			// Migrating an up to date database changes nothing
+			var appliedAt string
+			if err := db.QueryRow("SELECT CAST(applied_at AS TEXT) FROM schema_migrations WHERE version = ?", schemaVersion).Scan(&appliedAt); err != nil {
+				t.Fatal(err)
+			}
+			if err := migrate(db); err != nil {
+				t.Fatalf("second migrate: %v", err)
+			}
+			if again := appliedVersions(t, db); len(again) != len(versions) {
+				t.Errorf("second migrate recorded versions %v, want %v", again, versions)
+			}
+			var appliedAgain string
+			if err := db.QueryRow("SELECT CAST(applied_at AS TEXT) FROM schema_migrations WHERE version = ?", schemaVersion).Scan(&appliedAgain); err != nil {
+				t.Fatal(err)
+			}
+			if appliedAgain != appliedAt {
+				t.Errorf("second migrate reapplied version %d", schemaVersion)
+			}
+		})
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	db := openTestDB(t)
+	migrateTo(t, db, schemaVersion)
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', '2026-01-01 00:00:00+00:00')", schemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err == nil {
+		t.Fatal("migrate accepted a schema newer than the bridge knows")
+	}
+}
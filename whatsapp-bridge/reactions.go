@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// StoreReaction records a sender's reaction to a message. Each sender has at most one
+// reaction per message; an empty emoji means the sender removed it. Older reactions, e.g.
+// from a history sync that arrives late, don't overwrite newer ones.
+func (store *MessageStore) StoreReaction(messageID, chatJID, sender string, isFromMe bool, emoji string, timestamp time.Time) error {
+	if emoji == "" {
+		_, err := store.db.Exec(
+			"DELETE FROM message_reactions WHERE message_id = ? AND chat_jid = ? AND sender = ? AND timestamp <= ?",
+			messageID, chatJID, sender, timestamp.UTC(),
+		)
+		return err
+	}
+
+	_, err := store.db.Exec(
+		`INSERT INTO message_reactions (message_id, chat_jid, sender, is_from_me, emoji, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (message_id, chat_jid, sender) DO UPDATE SET emoji = excluded.emoji, timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= message_reactions.timestamp`,
+		messageID, chatJID, sender, isFromMe, emoji, timestamp.UTC(),
+	)
+	return err
+}
+
+// reactionTime returns when a reaction was sent, falling back to the time of the message carrying it
+func reactionTime(senderTimestampMS int64, fallback time.Time) time.Time {
+	if senderTimestampMS > 0 {
+		return time.UnixMilli(senderTimestampMS)
+	}
+	return fallback
+}
+
+// handleReaction stores a reaction received as a live message
+func handleReaction(messageStore *MessageStore, msg *events.Message, reaction *waProto.ReactionMessage) error {
+	target := reaction.GetKey().GetID()
+	if target == "" {
+		return nil
+	}
+
+	chatJID := msg.Info.Chat.String()
+	sender := msg.Info.Sender.User
+	timestamp := reactionTime(reaction.GetSenderTimestampMS(), msg.Info.Timestamp)
+	if err := messageStore.StoreReaction(target, chatJID, sender, msg.Info.IsFromMe, reaction.GetText(), timestamp); err != nil {
+		return fmt.Errorf("failed to store reaction: %v", err)
+	}
+
+	if reaction.GetText() == "" {
+		fmt.Printf("[%s] %s removed their reaction to %s\n", timestamp.Format("2006-01-02 15:04:05"), sender, target)
+	} else {
+		fmt.Printf("[%s] %s reacted %s to %s\n", timestamp.Format("2006-01-02 15:04:05"), sender, reaction.GetText(), target)
+	}
+	return nil
+}
+
+// storeHistoryReactions stores the reactions a history sync attaches to a message. The key of
+// each reaction identifies who reacted.
+func storeHistoryReactions(messageStore *MessageStore, chat types.JID, ownUser string, msg *waProto.WebMessageInfo) error {
+	messageID := msg.GetKey().GetID()
+	if messageID == "" {
+		return nil
+	}
+
+	for _, reaction := range msg.GetReactions() {
+		sender, isFromMe := historyReactionSender(chat, ownUser, reaction.GetKey().GetFromMe(), reaction.GetKey().GetParticipant())
+		timestamp := reactionTime(reaction.GetSenderTimestampMS(), time.Unix(int64(msg.GetMessageTimestamp()), 0))
+		if err := messageStore.StoreReaction(messageID, chat.String(), sender, isFromMe, reaction.GetText(), timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyReactionSender returns the user who sent a reaction in a history sync. Like live
+// messages, reactions are stored with the sender's user part rather than the full JID.
+func historyReactionSender(chat types.JID, ownUser string, fromMe bool, participant string) (string, bool) {
+	switch {
+	case fromMe:
+		return ownUser, true
+	case participant != "":
+		if jid, err := types.ParseJID(participant); err == nil {
+			return jid.User, false
+		}
+		return participant, false
+	default:
+		return chat.User, false
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages shorter than this are not worth embedding
+const minEmbeddingTextLength = 3
+
+// VectorIndex keeps an embedding of every message with text so that messages can be found
+// by meaning. Vectors are stored in the message_embeddings table and kept in memory for
+// searching, which is a brute-force scan over all of them.
+type VectorIndex struct {
+	store     *MessageStore
+	embedder  Embedder
+	batchSize int
+	wake      chan struct{}
+
+	// New messages are picked up above newestRowID; the history that existed at startup
+	// is embedded newest first, walking down from backlogRowID
+	newestRowID  int64
+	backlogRowID int64
+
+	mu       sync.RWMutex
+	entries  []vectorEntry
+	caughtUp bool
+}
+
+type vectorEntry struct {
+	messageID string
+	chatJID   string
+	vector    []float32
+}
+
+// editedMessage is a message whose embedding StoreMessage dropped because its text changed
+type editedMessage struct {
+	rowID     int64
+	messageID string
+	chatJID   string
+}
+
+// takeEditedMessages returns the messages edited since the last call
+func (store *MessageStore) takeEditedMessages() []editedMessage {
+	store.editedMu.Lock()
+	defer store.editedMu.Unlock()
+	edited := store.edited
+	store.edited = nil
+	return edited
+}
+
+// SemanticSearchRequest represents the request body for the semantic search API
+type SemanticSearchRequest struct {
+	Query   string `json:"query"`
+	ChatJID string `json:"chat_jid,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// SemanticSearchHit is a message found by semantic search
+type SemanticSearchHit struct {
+	MessageID string  `json:"message_id"`
+	ChatJID   string  `json:"chat_jid"`
+	Score     float32 `json:"score"`
+}
+
+// SemanticSearchResponse represents the response of the semantic search API
+type SemanticSearchResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Model   string `json:"model,omitempty"`
+	Indexed int    `json:"indexed"`
+	// CaughtUp is false while older messages are still being embedded
+	CaughtUp bool                `json:"caught_up"`
+	Hits     []SemanticSearchHit `json:"hits"`
+}
+
+// NewVectorIndex creates an index that embeds messages with the given embedder
+func NewVectorIndex(store *MessageStore, embedder Embedder, batchSize int) *VectorIndex {
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	return &VectorIndex{
+		store:     store,
+		embedder:  embedder,
+		batchSize: batchSize,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Start loads the stored vectors and keeps embedding new messages in the background
+func (idx *VectorIndex) Start() error {
+	// Vectors from another model can't be compared with ours
+	if _, err := idx.store.db.Exec("DELETE FROM message_embeddings WHERE model != ?", idx.embedder.Model()); err != nil {
+		return fmt.Errorf("failed to remove outdated embeddings: %v", err)
+	}
+	if err := idx.load(); err != nil {
+		return fmt.Errorf("failed to load embeddings: %v", err)
+	}
+	if err := idx.store.db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM messages").Scan(&idx.newestRowID); err != nil {
+		return err
+	}
+	idx.backlogRowID = idx.newestRowID + 1
+
+	go idx.run()
+	return nil
+}
+
+// Notify tells the indexer that new messages were stored
+func (idx *VectorIndex) Notify() {
+	select {
+	case idx.wake <- struct{}{}:
+	default:
+	}
+}
+
+// load reads all stored vectors into memory
+func (idx *VectorIndex) load() error {
+	rows, err := idx.store.db.Query("SELECT message_id, chat_jid, vector FROM message_embeddings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var entries []vectorEntry
+	for rows.Next() {
+		var entry vectorEntry
+		var blob []byte
+		if err := rows.Scan(&entry.messageID, &entry.chatJID, &blob); err != nil {
+			return err
+		}
+		entry.vector = decodeVector(blob)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.mu.Unlock()
+	return nil
+}
+
+// run embeds pending messages whenever new ones arrive, and periodically in case a wake-up was missed
+func (idx *VectorIndex) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := idx.indexBatch()
+			if err != nil {
+				fmt.Printf("Semantic index: %v\n", err)
+				break
+			}
+			if n == 0 {
+				idx.mu.Lock()
+				idx.caughtUp = true
+				idx.mu.Unlock()
+				break
+			}
+		}
+
+		select {
+		case <-idx.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// indexBatch embeds a batch of messages that don't have a vector yet, preferring messages
+// that arrived since startup, and returns how many it embedded
+func (idx *VectorIndex) indexBatch() (int, error) {
+	// The cursors only move one way, so each pass over the history is linear
+	const pendingQuery = `
+		SELECT m.rowid, m.id, m.chat_jid, TRIM(COALESCE(m.content, '') || ' ' || COALESCE(m.caption, ''))
+		FROM messages m
+		LEFT JOIN message_embeddings e ON e.message_id = m.id AND e.chat_jid = m.chat_jid
+		WHERE %s AND e.message_id IS NULL AND LENGTH(TRIM(COALESCE(m.content, '') || ' ' || COALESCE(m.caption, ''))) >= ?
+		ORDER BY m.rowid %s
+		LIMIT ?`
+
+	if err := idx.forgetEdited(); err != nil {
+		return 0, err
+	}
+
+	fromNew := true
+	batch, texts, lastRowID, err := idx.pending(fmt.Sprintf(pendingQuery, "m.rowid > ?", "ASC"), idx.newestRowID)
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		fromNew = false
+		if idx.backlogRowID <= 1 {
+			return 0, nil
+		}
+		batch, texts, lastRowID, err = idx.pending(fmt.Sprintf(pendingQuery, "m.rowid < ?", "DESC"), idx.backlogRowID)
+		if err != nil {
+			return 0, err
+		}
+		if len(batch) == 0 {
+			idx.backlogRowID = 0
+			return 0, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	vectors, err := idx.embedder.Embed(ctx, texts)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := idx.store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	for i := range batch {
+		batch[i].vector = vectors[i]
+		if _, err := tx.Exec(
+			"INSERT OR REPLACE INTO message_embeddings (message_id, chat_jid, model, vector, created_at) VALUES (?, ?, ?, ?, ?)",
+			batch[i].messageID, batch[i].chatJID, idx.embedder.Model(), encodeVector(vectors[i]), now,
+		); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	idx.mu.Lock()
+	idx.entries = append(idx.entries, batch...)
+	idx.mu.Unlock()
+
+	if fromNew {
+		idx.newestRowID = lastRowID
+	} else {
+		idx.backlogRowID = lastRowID
+	}
+	return len(batch), nil
+}
+
+// forgetEdited drops the vectors of edited messages and moves the backlog cursor back so
+// that they are embedded again. The vectors are deleted from the table again in case a batch
+// that was embedding the old text stored them after the edit.
+func (idx *VectorIndex) forgetEdited() error {
+	edited := idx.store.takeEditedMessages()
+	if len(edited) == 0 {
+		return nil
+	}
+
+	stale := make(map[[2]string]bool)
+	for _, msg := range edited {
+		if _, err := idx.store.db.Exec(
+			"DELETE FROM message_embeddings WHERE message_id = ? AND chat_jid = ?", msg.messageID, msg.chatJID,
+		); err != nil {
+			return err
+		}
+		stale[[2]string{msg.messageID, msg.chatJID}] = true
+		if msg.rowID >= idx.backlogRowID {
+			idx.backlogRowID = msg.rowID + 1
+		}
+	}
+
+	idx.mu.Lock()
+	entries := idx.entries[:0]
+	for _, entry := range idx.entries {
+		if !stale[[2]string{entry.messageID, entry.chatJID}] {
+			entries = append(entries, entry)
+		}
+	}
+	idx.entries = entries
+	idx.caughtUp = false
+	idx.mu.Unlock()
+	return nil
+}
+
+// pending runs one of the pending message queries and returns the messages, their texts and
+// the rowid of the last one
+func (idx *VectorIndex) pending(query string, cursor int64) ([]vectorEntry, []string, int64, error) {
+	rows, err := idx.store.db.Query(query, cursor, minEmbeddingTextLength, idx.batchSize)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rows.Close()
+
+	var batch []vectorEntry
+	var texts []string
+	var rowID int64
+	for rows.Next() {
+		var entry vectorEntry
+		var text string
+		if err := rows.Scan(&rowID, &entry.messageID, &entry.chatJID, &text); err != nil {
+			return nil, nil, 0, err
+		}
+		batch = append(batch, entry)
+		texts = append(texts, text)
+	}
+	return batch, texts, rowID, rows.Err()
+}
+
+// Search returns the messages most similar in meaning to the query
+func (idx *VectorIndex) Search(ctx context.Context, query, chatJID string, limit int) ([]SemanticSearchHit, error) {
+	vectors, err := idx.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	queryVector := vectors[0]
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var hits []SemanticSearchHit
+	for _, entry := range idx.entries {
+		if chatJID != "" && entry.chatJID != chatJID {
+			continue
+		}
+		if len(entry.vector) != len(queryVector) {
+			continue
+		}
+		var score float32
+		for i, v := range entry.vector {
+			score += v * queryVector[i]
+		}
+		// Unrelated texts score around zero and would only add noise to the ranking
+		if score <= 0 {
+			continue
+		}
+		hits = append(hits, SemanticSearchHit{MessageID: entry.messageID, ChatJID: entry.chatJID, Score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// Status returns how many messages are indexed and whether older messages are still being embedded
+func (idx *VectorIndex) Status() (indexed int, caughtUp bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries), idx.caughtUp
+}
+
+// handleSemanticSearch serves the semantic search API. index is nil when semantic search is disabled.
+func handleSemanticSearch(index *VectorIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req SemanticSearchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Query == "" {
+			http.Error(w, "Query is required", http.StatusBadRequest)
+			return
+		}
+		if req.Limit <= 0 {
+			req.Limit = 20
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if index == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(SemanticSearchResponse{
+				Success: false,
+				Message: "Semantic search is not configured, set embeddings.backend in the bridge config",
+			})
+			return
+		}
+
+		hits, err := index.Search(r.Context(), req.Query, req.ChatJID, req.Limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(SemanticSearchResponse{Success: false, Message: fmt.Sprintf("Semantic search failed: %v", err)})
+			return
+		}
+
+		indexed, caughtUp := index.Status()
+		json.NewEncoder(w).Encode(SemanticSearchResponse{
+			Success:  true,
+			Model:    index.embedder.Model(),
+			Indexed:  indexed,
+			CaughtUp: caughtUp,
+			Hits:     hits,
+		})
+	}
+}
+
+// encodeVector stores a vector as little-endian float32s
+func encodeVector(vector []float32) []byte {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
+
+// decodeVector reads a vector written by encodeVector
+func decodeVector(buf []byte) []float32 {
+	vector := make([]float32, len(buf)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vector
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a MessageStore on an in-memory database with the current schema
+func newTestStore(t *testing.T) *MessageStore {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would get a database of its own
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return &MessageStore{db: db}
+}
+
+// storeTestMessages stores messages with the given texts in order, keyed by ID
+func storeTestMessages(t *testing.T, store *MessageStore, messages ...[3]string) {
+	t.Helper()
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, m := range messages {
+		id, chatJID, content := m[0], m[1], m[2]
+		timestamp := base.Add(time.Duration(i) * time.Minute)
+		if err := store.StoreChat(chatJID, chatJID, timestamp); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreMessage(id, chatJID, "123", content, timestamp, false, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitForIndexed waits until the index holds n vectors and has caught up with the history
+func waitForIndexed(t *testing.T, idx *VectorIndex, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		indexed, caughtUp := idx.Status()
+		if indexed == n && caughtUp {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("index has %d vectors (caught up: %v), want %d", indexed, caughtUp, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHashEmbedder(t *testing.T) {
+	embedder := &hashEmbedder{dimensions: 64}
+	if model := embedder.Model(); model != "hash-64" {
+		t.Errorf("Model() = %q, want hash-64", model)
+	}
+	if model := (&hashEmbedder{}).Model(); model != "hash-256" {
+		t.Errorf("default Model() = %q, want hash-256", model)
+	}
+
+	texts := []string{"Meet at the harbour at noon", "grocery list: milk, eggs", "", "!!!"}
+	first, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("embedding the same texts twice gave different vectors")
+	}
+
+	for i, vector := range first {
+		if len(vector) != 64 {
+			t.Fatalf("vector %d has %d dimensions, want 64", i, len(vector))
+		}
+		var sum float64
+		for _, v := range vector {
+			sum += float64(v) * float64(v)
+		}
+		want := 1.0
+		if i >= 2 {
+			// Texts without words have nothing to hash
+			want = 0
+		}
+		if math.Abs(math.Sqrt(sum)-want) > 1e-5 {
+			t.Errorf("vector of %q has length %f, want %f", texts[i], math.Sqrt(sum), want)
+		}
+	}
+	if reflect.DeepEqual(first[0], first[1]) {
+		t.Error("different texts got the same vector")
+	}
+
+	// Case and punctuation don't change the words
+	same, err := embedder.Embed(context.Background(), []string{"MEET at the harbour, at noon!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(same[0], first[0]) {
+		t.Error("case and punctuation changed the vector")
+	}
+}
+
+func TestCommandEmbedderTimeout(t *testing.T) {
+	// A model that never answers
+	embedder := &commandEmbedder{command: []string{"sleep", "60"}, model: "hung"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := embedder.Embed(ctx, []string{"hello there"}); err == nil {
+		t.Fatal("Embed succeeded without an answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Embed returned after %s, want about the context's timeout", elapsed)
+	}
+	if embedder.cmd != nil {
+		t.Error("the hung command was kept for the next request")
+	}
+}
+
+func TestEncodeVectorRoundTrip(t *testing.T) {
+	vectors := [][]float32{
+		{},
+		{1},
+		{0.25, -0.5, 0, float32(math.Copysign(0, -1)), math.MaxFloat32, math.SmallestNonzeroFloat32, float32(math.Inf(-1))},
+	}
+	for _, vector := range vectors {
+		blob := encodeVector(vector)
+		if len(blob) != 4*len(vector) {
+			t.Errorf("encodeVector(%v) is %d bytes, want %d", vector, len(blob), 4*len(vector))
+		}
+		decoded := decodeVector(blob)
+		if len(decoded) != len(vector) {
+			t.Fatalf("decodeVector(encodeVector(%v)) = %v", vector, decoded)
+		}
+		for i := range vector {
+			if math.Float32bits(decoded[i]) != math.Float32bits(vector[i]) {
+				t.Errorf("decodeVector(encodeVector(%v)) = %v", vector, decoded)
+				break
+			}
+		}
+	}
+}
+
+func TestVectorIndexIndexesBacklogAndNewMessages(t *testing.T) {
+	store := newTestStore(t)
+	storeTestMessages(t, store,
+		[3]string{"m1", "a@g.us", "first message of the history"},
+		[3]string{"m2", "a@g.us", "ok"}, // too short to embed
+		[3]string{"m3", "b@g.us", "second message of the history"},
+		[3]string{"m4", "a@g.us", "third message of the history"},
+		[3]string{"m5", "b@g.us", "fourth message of the history"},
+	)
+
+	// A batch size below the backlog makes the indexer walk it in several batches
+	idx := NewVectorIndex(store, &hashEmbedder{dimensions: 64}, 2)
+	if err := idx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndexed(t, idx, 4)
+
+	storeTestMessages(t, store, [3]string{"m6", "a@g.us", "a new message arrives"})
+	idx.Notify()
+	waitForIndexed(t, idx, 5)
+
+	var stored int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM message_embeddings WHERE model = 'hash-64'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 5 {
+		t.Errorf("message_embeddings has %d vectors, want 5", stored)
+	}
+	var short int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM message_embeddings WHERE message_id = 'm2'").Scan(&short); err != nil {
+		t.Fatal(err)
+	}
+	if short != 0 {
+		t.Error("a message too short to embed was embedded")
+	}
+
+	hits, err := idx.Search(context.Background(), "a new message arrives", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].MessageID != "m6" {
+		t.Errorf("searching for the new message found %+v", hits)
+	}
+}
+
+func TestVectorIndexReembedsEditedMessages(t *testing.T) {
+	store := newTestStore(t)
+	storeTestMessages(t, store,
+		[3]string{"m1", "a@g.us", "meet at the harbour at noon"},
+		[3]string{"m2", "a@g.us", "grocery list milk eggs bread"},
+	)
+	idx := NewVectorIndex(store, &hashEmbedder{dimensions: 256}, 32)
+	if err := idx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndexed(t, idx, 2)
+
+	storeTestMessages(t, store, [3]string{"m1", "a@g.us", "dinner reservation moved to friday"})
+	var stale int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM message_embeddings WHERE message_id = 'm1'").Scan(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Error("editing a message kept its embedding")
+	}
+	idx.Notify()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hits, err := idx.Search(context.Background(), "dinner reservation moved to friday", "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The old text shares word fragments with the new one, so only an exact match counts
+		if len(hits) == 1 && hits[0].MessageID == "m1" && hits[0].Score > 0.99 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the edited text wasn't found, got %+v", hits)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForIndexed(t, idx, 2)
+
+	hits, err := idx.Search(context.Background(), "meet at the harbour at noon", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range hits {
+		if hit.MessageID == "m1" && hit.Score > 0.5 {
+			t.Errorf("the text from before the edit still matches m1: %+v", hit)
+		}
+	}
+
+	// Storing the same text again keeps the vector
+	storeTestMessages(t, store, [3]string{"m2", "a@g.us", "grocery list milk eggs bread"})
+	var kept int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM message_embeddings WHERE message_id = 'm2'").Scan(&kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept != 1 {
+		t.Error("storing an unchanged message dropped its embedding")
+	}
+}
+
+func TestVectorIndexSearch(t *testing.T) {
+	store := newTestStore(t)
+	storeTestMessages(t, store,
+		[3]string{"harbour", "a@g.us", "meet at the harbour at noon"},
+		[3]string{"boats", "a@g.us", "the boats in the harbour"},
+		[3]string{"groceries", "a@g.us", "grocery list milk eggs bread"},
+		[3]string{"harbour-b", "b@g.us", "harbour meeting moved"},
+	)
+	idx := NewVectorIndex(store, &hashEmbedder{dimensions: 256}, 32)
+	if err := idx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForIndexed(t, idx, 4)
+
+	hits, err := idx.Search(context.Background(), "meet at the harbour", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) < 3 || hits[0].MessageID != "harbour" {
+		t.Fatalf("Search ranked %+v, want harbour first", hits)
+	}
+	for i := 1; i < len(hits); i++ {
+		if hits[i].Score > hits[i-1].Score {
+			t.Errorf("hits are not sorted by score: %+v", hits)
+		}
+	}
+	for _, hit := range hits {
+		if hit.MessageID == "groceries" {
+			t.Errorf("an unrelated message was found: %+v", hit)
+		}
+	}
+
+	hits, err = idx.Search(context.Background(), "meet at the harbour", "b@g.us", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].MessageID != "harbour-b" {
+		t.Errorf("Search in b@g.us found %+v, want only harbour-b", hits)
+	}
+
+	hits, err = idx.Search(context.Background(), "harbour", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 {
+		t.Errorf("Search with limit 2 found %d hits", len(hits))
+	}
+}
+
+func TestVectorIndexStartRemovesOtherModels(t *testing.T) {
+	store := newTestStore(t)
+	storeTestMessages(t, store,
+		[3]string{"kept", "a@g.us", "embedded with the current model"},
+		[3]string{"outdated", "a@g.us", "embedded with another model"},
+	)
+	embedder := &hashEmbedder{dimensions: 64}
+	vectors, err := embedder.Embed(context.Background(), []string{"embedded with the current model"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, row := range []struct {
+		id, model string
+		vector    []float32
+	}{
+		{"kept", embedder.Model(), vectors[0]},
+		{"outdated", "some-other-model", []float32{1, 0, 0}},
+	} {
+		if _, err := store.db.Exec(
+			"INSERT INTO message_embeddings (message_id, chat_jid, model, vector, created_at) VALUES (?, 'a@g.us', ?, ?, ?)",
+			row.id, row.model, encodeVector(row.vector), now,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx := NewVectorIndex(store, embedder, 32)
+	if err := idx.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The outdated message is embedded again with the current model
+	waitForIndexed(t, idx, 2)
+
+	rows, err := store.db.Query("SELECT message_id, model FROM message_embeddings ORDER BY message_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string]string)
+	for rows.Next() {
+		var id, model string
+		if err := rows.Scan(&id, &model); err != nil {
+			t.Fatal(err)
+		}
+		got[id] = model
+	}
+	want := map[string]string{"kept": "hash-64", "outdated": "hash-64"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("message_embeddings = %v, want %v", got, want)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -39,6 +42,87 @@ type DownloadMediaResponse struct {
 	Path     string `json:"path,omitempty"`
 }
 
+// DownloadChatMediaRequest represents the request body for the chat media export API
+type DownloadChatMediaRequest struct {
+	ChatJID     string   `json:"chat_jid"`
+	MediaTypes  []string `json:"media_types,omitempty"`
+	After       string   `json:"after,omitempty"`
+	Before      string   `json:"before,omitempty"`
+	Format      string   `json:"format,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+}
+
+// DownloadChatMediaEvent is one progress line streamed back by the chat media export API
+type DownloadChatMediaEvent struct {
+	Type      string `json:"type"`
+	Done      int    `json:"done"`
+	Total     int    `json:"total"`
+	MessageID string `json:"message_id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	File      string `json:"file,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Output    string `json:"output,omitempty"`
+	Manifest  string `json:"manifest,omitempty"`
+	Failed    int    `json:"failed,omitempty"`
+}
+
+// CheckMediaRequest represents the request body for the media path check API
+type CheckMediaRequest struct {
+	MediaPath string `json:"media_path"`
+	Recipient string `json:"recipient,omitempty"`
+	Client    string `json:"client,omitempty"`
+}
+
+// CheckMediaResponse represents the response for the media path check API
+type CheckMediaResponse struct {
+	Allowed bool   `json:"allowed"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// checkMediaPath asks the bridge whether its media policy allows sending the file, before
+// this server looks at or converts it, and returns the path with symlinks resolved. The
+// bridge records refused files in its audit log.
+func checkMediaPath(ctx context.Context, recipient, mediaPath string) (string, error) {
+	url := fmt.Sprintf("%s/media/check", WHATSAPP_API_BASE_URL)
+	payload := CheckMediaRequest{
+		MediaPath: mediaPath,
+		Recipient: recipient,
+	}
+	if c := clientFromContext(ctx); c != nil {
+		payload.Client = c.name
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("JSON marshal error: %v", err)
+	}
+
+	resp, err := bridgeClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP %d - %s", resp.StatusCode, string(body))
+	}
+
+	var result CheckMediaResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("error parsing response: %s", string(body))
+	}
+	if !result.Allowed {
+		log.Printf("Refused to send %s: %s", mediaPath, result.Message)
+		return "", fmt.Errorf("%s", result.Message)
+	}
+	return result.Path, nil
+}
+
 func sendMessage(recipient, message string) (bool, string) {
 	if recipient == "" {
 		return false, "Recipient must be provided"
@@ -55,7 +139,7 @@ func sendMessage(recipient, message string) (bool, string) {
 		return false, fmt.Sprintf("JSON marshal error: %v", err)
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := bridgeClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return false, fmt.Sprintf("Request error: %v", err)
 	}
@@ -101,7 +185,7 @@ func sendFile(recipient, mediaPath string) (bool, string) {
 		return false, fmt.Sprintf("JSON marshal error: %v", err)
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := bridgeClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return false, fmt.Sprintf("Request error: %v", err)
 	}
@@ -156,7 +240,7 @@ func sendAudioMessage(recipient, mediaPath string) (bool, string) {
 		return false, fmt.Sprintf("JSON marshal error: %v", err)
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := bridgeClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return false, fmt.Sprintf("Request error: %v", err)
 	}
@@ -191,7 +275,7 @@ func downloadMedia(messageID, chatJID string) string {
 		return ""
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := bridgeClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		fmt.Printf("Request error: %v\n", err)
 		return ""
@@ -223,6 +307,141 @@ func downloadMedia(messageID, chatJID string) string {
 	}
 }
 
+// downloadChatMedia asks the bridge to download all media of a chat, calling onEvent for
+// every progress line, and returns the final "complete" event
+func downloadChatMedia(ctx context.Context, payload DownloadChatMediaRequest, onEvent func(DownloadChatMediaEvent)) (*DownloadChatMediaEvent, error) {
+	url := fmt.Sprintf("%s/download/chat", WHATSAPP_API_BASE_URL)
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshal error: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("request error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := bridgeClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("HTTP %d - %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event DownloadChatMediaEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("error parsing response: %s", scanner.Text())
+		}
+		switch event.Type {
+		case "error":
+			return nil, fmt.Errorf("%s", event.Error)
+		case "complete":
+			return &event, nil
+		default:
+			onEvent(event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+
+	return nil, fmt.Errorf("bridge closed the connection before the download finished")
+}
+
+// getMediaStats fetches the media storage report from the bridge as raw JSON
+func getMediaStats() (string, error) {
+	url := fmt.Sprintf("%s/media/stats", WHATSAPP_API_BASE_URL)
+
+	resp, err := bridgeClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP %d - %s", resp.StatusCode, string(body))
+	}
+
+	if !json.Valid(body) {
+		return "", fmt.Errorf("error parsing response: %s", string(body))
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// SemanticSearchRequest represents the request body for the semantic search API
+type SemanticSearchRequest struct {
+	Query   string `json:"query"`
+	ChatJID string `json:"chat_jid,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// SemanticSearchHit is a message found by the bridge's semantic index
+type SemanticSearchHit struct {
+	MessageID string  `json:"message_id"`
+	ChatJID   string  `json:"chat_jid"`
+	Score     float32 `json:"score"`
+}
+
+// SemanticSearchResponse represents the response of the semantic search API
+type SemanticSearchResponse struct {
+	Success  bool                `json:"success"`
+	Message  string              `json:"message,omitempty"`
+	Model    string              `json:"model,omitempty"`
+	Indexed  int                 `json:"indexed"`
+	CaughtUp bool                `json:"caught_up"`
+	Hits     []SemanticSearchHit `json:"hits"`
+}
+
+// semanticSearch asks the bridge for the messages closest in meaning to the query
+func semanticSearch(query, chatJID string, limit int) (*SemanticSearchResponse, error) {
+	url := fmt.Sprintf("%s/semantic_search", WHATSAPP_API_BASE_URL)
+	payload := SemanticSearchRequest{
+		Query:   query,
+		ChatJID: chatJID,
+		Limit:   limit,
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshal error: %v", err)
+	}
+
+	resp, err := bridgeClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+
+	var result SemanticSearchResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("HTTP %d - %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if !result.Success {
+		return nil, fmt.Errorf("%s", result.Message)
+	}
+	return &result, nil
+}
+
 // Audio conversion functions
 func convertToOpusOgg(inputFile, outputFile string, bitrate string, sampleRate int) (string, error) {
 	if _, err := os.Stat(inputFile); os.IsNotExist(err) {
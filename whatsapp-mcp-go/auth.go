@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Scopes a client can be granted
+const (
+	scopeRead = "read" // read chats, messages and media
+	scopeSend = "send" // send messages and files
+)
+
+// toolScopes is the scope each tool needs that doesn't just read
+var toolScopes = map[string]string{
+	"send_message":       scopeSend,
+	"send_file":          scopeSend,
+	"send_audio_message": scopeSend,
+}
+
+// toolChatArguments is the argument naming the chat a tool reads or writes. Clients limited
+// to some chats must pass it, and must have access to the chat.
+var toolChatArguments = map[string]string{
+	"get_chat":            "chat_jid",
+	"get_conversation":    "chat",
+	"search_messages":     "chat_jid",
+	"semantic_search":     "chat_jid",
+	"download_media":      "chat_jid",
+	"download_chat_media": "chat_jid",
+	"send_message":        "recipient",
+	"send_file":           "recipient",
+	"send_audio_message":  "recipient",
+}
+
+// allChatsTools report on all chats at once, so clients limited to some chats can't use them
+var allChatsTools = map[string]bool{
+	"media_storage_report": true,
+}
+
+// Settings of token introspection
+const (
+	introspectionCacheTime = time.Minute // how long the result for a token is reused
+	introspectionTimeout   = 10 * time.Second
+)
+
+// authConfig is the file passed with -auth that lists who may connect over HTTP:
+//
+//	{
+//	  "tokens": [
+//	    {"name": "laptop", "token": "...", "scopes": ["read", "send"]},
+//	    {"name": "family-bot", "token_sha256": "...", "scopes": ["read"], "chats": ["120363012345678901@g.us"]}
+//	  ],
+//	  "oauth": {
+//	    "resource": "https://whatsapp.example.com/mcp",
+//	    "authorization_servers": ["https://auth.example.com"],
+//	    "introspection_endpoint": "https://auth.example.com/oauth2/introspect",
+//	    "client_id": "whatsapp-mcp",
+//	    "client_secret": "..."
+//	  }
+//	}
+type authConfig struct {
+	Tokens []tokenConfig `json:"tokens"`
+	OAuth  *oauthConfig  `json:"oauth"`
+}
+
+// tokenConfig is a static bearer token. The token is given either as is or as the hex
+// SHA-256 of it, so the file doesn't have to hold it.
+type tokenConfig struct {
+	Name        string   `json:"name"`
+	Token       string   `json:"token"`
+	TokenSHA256 string   `json:"token_sha256"`
+	Scopes      []string `json:"scopes"`
+	Chats       []string `json:"chats"` // JIDs or phone numbers; empty means all chats
+}
+
+// oauthConfig makes the server an OAuth 2.1 resource server. Access tokens that aren't static
+// tokens are checked at the authorization server's introspection endpoint (RFC 7662) and get
+// the scopes they were granted.
+type oauthConfig struct {
+	Resource              string   `json:"resource"`
+	AuthorizationServers  []string `json:"authorization_servers"`
+	IntrospectionEndpoint string   `json:"introspection_endpoint"`
+	ClientID              string   `json:"client_id"`
+	ClientSecret          string   `json:"client_secret"`
+	Chats                 []string `json:"chats"` // JIDs or phone numbers OAuth clients are limited to
+}
+
+// client is who made a request over HTTP and what they may do
+type client struct {
+	name   string
+	scopes map[string]bool
+	chats  map[string]bool // nil if the client may access all chats
+}
+
+// introspection is a cached result of token introspection
+type introspection struct {
+	client  *client // nil if the token isn't active
+	expires time.Time
+}
+
+// authenticator checks the bearer tokens of HTTP requests
+type authenticator struct {
+	tokens     map[[sha256.Size]byte]*client
+	oauth      *oauthConfig
+	oauthChats map[string]bool
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspection
+}
+
+// loadAuth reads the auth config file at path
+func loadAuth(path string) (*authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config authConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	a := &authenticator{
+		tokens: make(map[[sha256.Size]byte]*client),
+		oauth:  config.OAuth,
+		cache:  make(map[[sha256.Size]byte]introspection),
+	}
+	for i, token := range config.Tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("token %d has no name", i+1)
+		}
+		var hash [sha256.Size]byte
+		switch {
+		case token.Token != "" && token.TokenSHA256 != "":
+			return nil, fmt.Errorf("token %q: set either token or token_sha256", token.Name)
+		case token.Token != "":
+			hash = sha256.Sum256([]byte(token.Token))
+		case token.TokenSHA256 != "":
+			decoded, err := hex.DecodeString(token.TokenSHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("token %q: token_sha256 must be 64 hex digits", token.Name)
+			}
+			copy(hash[:], decoded)
+		default:
+			return nil, fmt.Errorf("token %q: set token or token_sha256", token.Name)
+		}
+		if _, ok := a.tokens[hash]; ok {
+			return nil, fmt.Errorf("token %q: the token is used twice", token.Name)
+		}
+
+		if len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("token %q has no scopes, use %q and/or %q", token.Name, scopeRead, scopeSend)
+		}
+		scopes := make(map[string]bool)
+		for _, scope := range token.Scopes {
+			if scope != scopeRead && scope != scopeSend {
+				return nil, fmt.Errorf("token %q: unknown scope %q, use %q or %q", token.Name, scope, scopeRead, scopeSend)
+			}
+			scopes[scope] = true
+		}
+		chats, err := chatSet(token.Chats)
+		if err != nil {
+			return nil, fmt.Errorf("token %q: %v", token.Name, err)
+		}
+		a.tokens[hash] = &client{name: token.Name, scopes: scopes, chats: chats}
+	}
+
+	if config.OAuth != nil {
+		if config.OAuth.Resource == "" || config.OAuth.IntrospectionEndpoint == "" {
+			return nil, fmt.Errorf("oauth needs a resource and an introspection_endpoint")
+		}
+		if u, err := url.Parse(config.OAuth.Resource); err != nil || !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("oauth resource %q must be an absolute URL", config.OAuth.Resource)
+		}
+		if a.oauthChats, err = chatSet(config.OAuth.Chats); err != nil {
+			return nil, fmt.Errorf("oauth: %v", err)
+		}
+	}
+	if len(a.tokens) == 0 && config.OAuth == nil {
+		return nil, fmt.Errorf("no tokens and no oauth, nobody could connect")
+	}
+	return a, nil
+}
+
+// chatSet turns the chats a client is limited to into a set of JIDs, or nil if there are none
+func chatSet(values []string) (map[string]bool, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	chats := make(map[string]bool)
+	for _, value := range values {
+		jid := labelJID(value)
+		if !strings.Contains(jid, "@") {
+			phone := normalizePhoneNumber(jid)
+			if phone == "" {
+				return nil, fmt.Errorf("chat %q must be a JID or phone number", value)
+			}
+			jid = phone + "@s.whatsapp.net"
+		}
+		chats[jid] = true
+	}
+	return chats, nil
+}
+
+// metadataURL is the URL of the protected resource metadata (RFC 9728) of the server
+func (a *authenticator) metadataURL() string {
+	u, _ := url.Parse(a.oauth.Resource)
+	return u.Scheme + "://" + u.Host + server.ProtectedResourceMetadataPath(a.oauth.Resource)
+}
+
+// metadata is what the server tells OAuth clients about itself
+func (a *authenticator) metadata() server.ProtectedResourceMetadataConfig {
+	return server.ProtectedResourceMetadataConfig{
+		Resource:               a.oauth.Resource,
+		AuthorizationServers:   a.oauth.AuthorizationServers,
+		ScopesSupported:        []string{scopeRead, scopeSend},
+		BearerMethodsSupported: []string{"header"},
+		ResourceName:           "WhatsApp MCP",
+	}
+}
+
+// require only passes on requests with a valid bearer token, with their client in the context
+func (a *authenticator) require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		challenge := `Bearer realm="whatsapp-mcp"`
+		if a.oauth != nil {
+			challenge += fmt.Sprintf(`, resource_metadata="%s"`, a.metadataURL())
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		c, err := a.authenticate(r.Context(), token)
+		if err != nil {
+			log.Printf("Failed to check a token from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "Failed to check the token", http.StatusServiceUnavailable)
+			return
+		}
+		if c == nil {
+			log.Printf("Rejected an invalid token from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", challenge+`, error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withClient(r.Context(), c)))
+	})
+}
+
+// authenticate returns the client a token belongs to, or nil if it isn't valid
+func (a *authenticator) authenticate(ctx context.Context, token string) (*client, error) {
+	hash := sha256.Sum256([]byte(token))
+	if c := a.tokens[hash]; c != nil {
+		return c, nil
+	}
+	if a.oauth == nil {
+		return nil, nil
+	}
+
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.client, nil
+	}
+
+	c, expires, err := a.introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if cacheUntil := time.Now().Add(introspectionCacheTime); expires.IsZero() || expires.After(cacheUntil) {
+		expires = cacheUntil
+	}
+	a.mu.Lock()
+	for key, entry := range a.cache {
+		if time.Now().After(entry.expires) {
+			delete(a.cache, key)
+		}
+	}
+	a.cache[hash] = introspection{client: c, expires: expires}
+	a.mu.Unlock()
+	return c, nil
+}
+
+// introspect asks the authorization server about an access token. It returns the client the
+// token was issued to and when the token expires, or a nil client if it isn't active or not
+// meant for this server.
+func (a *authenticator) introspect(ctx context.Context, token string) (*client, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, introspectionTimeout)
+	defer cancel()
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.oauth.IntrospectionEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.oauth.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.oauth.ClientID), url.QueryEscape(a.oauth.ClientSecret))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("introspection request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error reading introspection response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("introspection failed: HTTP %d - %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Active   bool            `json:"active"`
+		Scope    string          `json:"scope"`
+		Subject  string          `json:"sub"`
+		Username string          `json:"username"`
+		ClientID string          `json:"client_id"`
+		Audience json.RawMessage `json:"aud"`
+		Expires  int64           `json:"exp"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, time.Time{}, fmt.Errorf("error parsing introspection response: %v", err)
+	}
+	if !result.Active {
+		return nil, time.Time{}, nil
+	}
+	var expires time.Time
+	if result.Expires != 0 {
+		expires = time.Unix(result.Expires, 0)
+		if time.Now().After(expires) {
+			return nil, time.Time{}, nil
+		}
+	}
+
+	// The audience is a string or a list of them, and must name this server if it is set
+	if len(result.Audience) > 0 && string(result.Audience) != "null" {
+		var audience []string
+		if err := json.Unmarshal(result.Audience, &audience); err != nil {
+			var single string
+			if err := json.Unmarshal(result.Audience, &single); err != nil {
+				return nil, time.Time{}, fmt.Errorf("error parsing introspection response: invalid aud %s", result.Audience)
+			}
+			audience = []string{single}
+		}
+		found := false
+		for _, aud := range audience {
+			found = found || aud == a.oauth.Resource
+		}
+		if !found {
+			return nil, time.Time{}, nil
+		}
+	}
+
+	c := &client{scopes: make(map[string]bool), chats: a.oauthChats}
+	for _, scope := range strings.Fields(result.Scope) {
+		c.scopes[scope] = true
+	}
+	for _, name := range []string{result.Username, result.Subject, result.ClientID, "oauth"} {
+		if name != "" {
+			c.name = name
+			break
+		}
+	}
+	return c, expires, nil
+}
+
+// isLoopback reports whether addr only accepts connections from the same machine
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type clientKey struct{}
+
+func withClient(ctx context.Context, c *client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// clientFromContext returns the client of an HTTP request, or nil over stdio and without
+// -auth, where whoever can connect may do everything
+func clientFromContext(ctx context.Context) *client {
+	c, _ := ctx.Value(clientKey{}).(*client)
+	return c
+}
+
+// can reports whether the client has a scope
+func (c *client) can(scope string) bool {
+	return c == nil || c.scopes[scope]
+}
+
+// canAccess reports whether the client may access a chat
+func (c *client) canAccess(jid string) bool {
+	return c == nil || c.chats == nil || c.chats[jid]
+}
+
+// limited reports whether the client may only access some chats
+func (c *client) limited() bool {
+	return c != nil && c.chats != nil
+}
+
+// allowedChats returns the JIDs of the chats the client may access, or nil if it may access all
+func (c *client) allowedChats() []string {
+	if !c.limited() {
+		return nil
+	}
+	var jids []string
+	for jid := range c.chats {
+		jids = append(jids, jid)
+	}
+	return jids
+}
+
+// checkChatAccess returns an error if the client of ctx may not access a chat
+func checkChatAccess(ctx context.Context, jid string) error {
+	if !clientFromContext(ctx).canAccess(jid) {
+		return fmt.Errorf("no access to chat %s", jid)
+	}
+	return nil
+}
+
+// authorizeTool checks that the client may call a tool with its arguments, and logs the call
+func authorizeTool(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		c := clientFromContext(ctx)
+		if c == nil {
+			return next(ctx, request)
+		}
+		name := request.Params.Name
+		log.Printf("Client %s called %s", c.name, name)
+
+		scope := toolScopes[name]
+		if scope == "" {
+			scope = scopeRead
+		}
+		if !c.can(scope) {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %s needs the %q scope", name, scope)), nil
+		}
+		if c.limited() && allChatsTools[name] {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %s needs access to all chats", name)), nil
+		}
+		if argument := toolChatArguments[name]; argument != "" && c.limited() {
+			value := request.GetString(argument, "")
+			if value == "" {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: %s needs %s, this client may only access some chats", name, argument)), nil
+			}
+			db, err := openDB()
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+			}
+			jid, err := resolveChat(db, value, c.allowedChats())
+			db.Close()
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+			}
+			if err := checkChatAccess(ctx, jid); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+			}
+		}
+		return next(ctx, request)
+	}
+}
+
+// accessibleTools leaves out the tools the client lacks the scope for
+func accessibleTools(ctx context.Context, tools []mcp.Tool) []mcp.Tool {
+	c := clientFromContext(ctx)
+	if c == nil {
+		return tools
+	}
+	var accessible []mcp.Tool
+	for _, tool := range tools {
+		scope := toolScopes[tool.Name]
+		if scope == "" {
+			scope = scopeRead
+		}
+		if c.can(scope) && !(c.limited() && allChatsTools[tool.Name]) {
+			accessible = append(accessible, tool)
+		}
+	}
+	return accessible
+}
+
+// authorizeResource checks that the client may read a resource
+func authorizeResource(next server.ResourceHandlerFunc) server.ResourceHandlerFunc {
+	return func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		if err := checkResourceAccess(ctx, request.Params.URI); err != nil {
+			return nil, err
+		}
+		return next(ctx, request)
+	}
+}
+
+// checkResourceAccess returns an error if the client of ctx may not read a resource
+func checkResourceAccess(ctx context.Context, uri string) error {
+	c := clientFromContext(ctx)
+	if !c.can(scopeRead) {
+		return fmt.Errorf("reading resources needs the %q scope", scopeRead)
+	}
+	if jid := resourceChatJID(uri); jid != "" {
+		return checkChatAccess(ctx, jid)
+	}
+	return nil
+}
+
+// authorizePrompt checks that the client may read chats, which every prompt does
+func authorizePrompt(next server.PromptHandlerFunc) server.PromptHandlerFunc {
+	return func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		if c := clientFromContext(ctx); c != nil {
+			log.Printf("Client %s got prompt %s", c.name, request.Params.Name)
+			if !c.can(scopeRead) {
+				return nil, fmt.Errorf("prompts need the %q scope", scopeRead)
+			}
+		}
+		return next(ctx, request)
+	}
+}
+
+// hideResources leaves the chats the client may not access out of the resource list
+func hideResources(ctx context.Context, id any, request *mcp.ListResourcesRequest, result *mcp.ListResourcesResult) {
+	c := clientFromContext(ctx)
+	if c == nil {
+		return
+	}
+	accessible := []mcp.Resource{}
+	for _, resource := range result.Resources {
+		if checkResourceAccess(ctx, resource.URI) == nil {
+			accessible = append(accessible, resource)
+		}
+	}
+	result.Resources = accessible
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bridgeClient makes the requests to the bridge's REST API, sending the API token with each
+var bridgeClient = &http.Client{Transport: &bridgeTransport{base: http.DefaultTransport}}
+
+// bridgeTransport adds the bridge's API token to requests. Unless the token is set, the token
+// file is read for every request, so the server keeps working when the bridge creates it on
+// its first start or the token is replaced.
+type bridgeTransport struct {
+	base      http.RoundTripper
+	token     string
+	tokenFile string // default: api_token next to messages.db
+}
+
+func (t *bridgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.token
+	if token == "" {
+		tokenFile := t.tokenFile
+		if tokenFile == "" {
+			tokenFile = filepath.Join(filepath.Dir(getMessagesDBPath()), "api_token")
+		}
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the bridge's API token, has the bridge been started? %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// configureBridge sets up how to reach the bridge from the WHATSAPP_BRIDGE_* settings, see
+// loadConfig
+func configureBridge() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if url := os.Getenv("WHATSAPP_BRIDGE_URL"); url != "" {
+		if socket, ok := strings.CutPrefix(url, "unix:"); ok {
+			// The host of the URLs doesn't matter, every connection goes to the socket
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			}
+			url = "http://bridge"
+		} else if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("invalid WHATSAPP_BRIDGE_URL %q: must start with http://, https:// or unix:", url)
+		}
+		WHATSAPP_API_BASE_URL = strings.TrimSuffix(url, "/") + "/api"
+	}
+
+	caFile := os.Getenv("WHATSAPP_BRIDGE_CA_FILE")
+	certFile := os.Getenv("WHATSAPP_BRIDGE_CERT_FILE")
+	keyFile := os.Getenv("WHATSAPP_BRIDGE_KEY_FILE")
+	if caFile != "" || certFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("failed to read WHATSAPP_BRIDGE_CA_FILE: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in WHATSAPP_BRIDGE_CA_FILE %s", caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load WHATSAPP_BRIDGE_CERT_FILE: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	bridgeClient = &http.Client{Transport: &bridgeTransport{
+		base:      transport,
+		token:     os.Getenv("WHATSAPP_BRIDGE_TOKEN"),
+		tokenFile: os.Getenv("WHATSAPP_BRIDGE_TOKEN_FILE"),
+	}}
+	return nil
+}
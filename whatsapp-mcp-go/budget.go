@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// charsPerToken is a rough average for the text tools return, used to turn max_tokens into
+// characters
+const charsPerToken = 4
+
+// budgetParams adds the max_chars and max_tokens parameters to a tool
+var budgetParams mcp.ToolOption = func(tool *mcp.Tool) {
+	mcp.WithNumber("max_chars", mcp.Description(fmt.Sprintf("Optional size limit of the result in characters (default %d, see WHATSAPP_MCP_MAX_CHARS). Long messages are shortened and what doesn't fit is left out, with a cursor to continue.", defaultMaxChars)))(tool)
+	mcp.WithNumber("max_tokens", mcp.Description(fmt.Sprintf("Optional size limit of the result in tokens, counted as %d characters each; the smaller of max_chars and max_tokens applies", charsPerToken)))(tool)
+}
+
+// outputBudget is how much a tool call may return. The zero value has no limit.
+type outputBudget struct {
+	maxChars        int // the whole result
+	maxMessageChars int // the text of one message
+}
+
+// newOutputBudget returns a budget of maxChars characters. One message may take a tenth of it,
+// within limits, so a single long message can't crowd out the rest.
+func newOutputBudget(maxChars int) outputBudget {
+	maxMessageChars := maxChars / 10
+	if maxMessageChars < 200 {
+		maxMessageChars = 200
+	} else if maxMessageChars > 4000 {
+		maxMessageChars = 4000
+	}
+	return outputBudget{maxChars: maxChars, maxMessageChars: maxMessageChars}
+}
+
+// parseBudget returns the budget requested in a tool call, or the server default
+func parseBudget(request mcp.CallToolRequest) (outputBudget, error) {
+	maxChars := defaultMaxChars
+	if chars := int(request.GetFloat("max_chars", 0)); chars != 0 {
+		maxChars = chars
+	}
+	if tokens := int(request.GetFloat("max_tokens", 0)); tokens != 0 && tokens*charsPerToken < maxChars {
+		maxChars = tokens * charsPerToken
+	}
+	if maxChars < 500 {
+		return outputBudget{}, fmt.Errorf("the budget must be at least 500 characters or %d tokens", 500/charsPerToken)
+	}
+	return newOutputBudget(maxChars), nil
+}
+
+// shorten cuts text to the size of one message, marking how much was left out. It returns
+// the number of characters cut.
+func (b outputBudget) shorten(text string) (string, int) {
+	runes := []rune(text)
+	if b.maxMessageChars == 0 || len(runes) <= b.maxMessageChars {
+		return text, 0
+	}
+	cut := len(runes) - b.maxMessageChars
+	return string(runes[:b.maxMessageChars]) + fmt.Sprintf("… [%d more characters]", cut), cut
+}
+
+// shortenMessages shortens the long texts and captions in a result
+func (b outputBudget) shortenMessages(result *messagesResult) {
+	shorten := func(msg *messageOutput) {
+		var cut int
+		msg.Text, cut = b.shorten(msg.Text)
+		msg.TruncatedChars += cut
+		if msg.Media != nil {
+			msg.Media.Caption, cut = b.shorten(msg.Media.Caption)
+			msg.TruncatedChars += cut
+		}
+	}
+	for i := range result.Messages {
+		match := &result.Messages[i]
+		shorten(&match.messageOutput)
+		for j := range match.ContextBefore {
+			shorten(&match.ContextBefore[j])
+		}
+		for j := range match.ContextAfter {
+			shorten(&match.ContextAfter[j])
+		}
+	}
+}
+
+// fit returns how many of n items, whose sizes size reports, fit in the budget. The first
+// item always does, so a result is never empty because of the budget.
+func (b outputBudget) fit(n int, size func(i int) int) int {
+	if b.maxChars == 0 {
+		return n
+	}
+	total := 0
+	for i := 0; i < n; i++ {
+		total += size(i)
+		if i > 0 && total > b.maxChars {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestParseBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments map[string]any
+		want      outputBudget
+		wantErr   bool
+	}{
+		{"default", nil, outputBudget{maxChars: defaultMaxChars, maxMessageChars: 1600}, false},
+		{"max_chars", map[string]any{"max_chars": 3000.0}, outputBudget{maxChars: 3000, maxMessageChars: 300}, false},
+		{"max_tokens", map[string]any{"max_tokens": 1000.0}, outputBudget{maxChars: 4000, maxMessageChars: 400}, false},
+		{"smaller of both", map[string]any{"max_chars": 3000.0, "max_tokens": 1000.0}, outputBudget{maxChars: 3000, maxMessageChars: 300}, false},
+		{"tokens below chars", map[string]any{"max_chars": 8000.0, "max_tokens": 1000.0}, outputBudget{maxChars: 4000, maxMessageChars: 400}, false},
+		{"message floor", map[string]any{"max_chars": 500.0}, outputBudget{maxChars: 500, maxMessageChars: 200}, false},
+		{"message ceiling", map[string]any{"max_chars": 100000.0}, outputBudget{maxChars: 100000, maxMessageChars: 4000}, false},
+		{"too small", map[string]any{"max_chars": 499.0}, outputBudget{}, true},
+		{"too few tokens", map[string]any{"max_tokens": 100.0}, outputBudget{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request mcp.CallToolRequest
+			request.Params.Arguments = tt.arguments
+			got, err := parseBudget(request)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseBudget = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseBudget = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputBudgetShorten(t *testing.T) {
+	budget := newOutputBudget(2000) // 200 characters per message
+	tests := []struct {
+		name string
+		text string
+		want string
+		cut  int
+	}{
+		{"short", "hello", "hello", 0},
+		{"exactly the limit", strings.Repeat("a", 200), strings.Repeat("a", 200), 0},
+		{"long", strings.Repeat("a", 250), strings.Repeat("a", 200) + "… [50 more characters]", 50},
+		// Characters, not bytes, and never half a character
+		{"multibyte", strings.Repeat("é", 210), strings.Repeat("é", 200) + "… [10 more characters]", 10},
+		{"emoji", strings.Repeat("👍", 201), strings.Repeat("👍", 200) + "… [1 more characters]", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cut := budget.shorten(tt.text)
+			if got != tt.want || cut != tt.cut {
+				t.Errorf("shorten = %q, %d, want %q, %d", got, cut, tt.want, tt.cut)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("shorten returned invalid UTF-8")
+			}
+		})
+	}
+
+	if got, cut := (outputBudget{}).shorten(strings.Repeat("a", 10000)); cut != 0 || len(got) != 10000 {
+		t.Errorf("the zero budget shortened text to %d characters", len(got))
+	}
+}
+
+func TestOutputBudgetFit(t *testing.T) {
+	sizes := []int{300, 300, 300, 300}
+	size := func(i int) int { return sizes[i] }
+	tests := []struct {
+		budget outputBudget
+		want   int
+	}{
+		{outputBudget{}, 4},
+		{outputBudget{maxChars: 1200}, 4},
+		{outputBudget{maxChars: 1199}, 3},
+		{outputBudget{maxChars: 600}, 2},
+		// The first item is always shown
+		{outputBudget{maxChars: 100}, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.budget.fit(len(sizes), size); got != tt.want {
+			t.Errorf("fit with %d characters = %d, want %d", tt.budget.maxChars, got, tt.want)
+		}
+	}
+	if got := (outputBudget{maxChars: 100}).fit(0, size); got != 0 {
+		t.Errorf("fit of nothing = %d", got)
+	}
+}
+
+func TestRenderChatsBudget(t *testing.T) {
+	var chats []Chat
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("Chat %d", i)
+		last := strings.Repeat("x", 1000)
+		at := testNow.Add(-time.Duration(i) * time.Minute)
+		chats = append(chats, Chat{JID: fmt.Sprintf("%d@s.whatsapp.net", i), Name: &name, LastMessageTime: &at, LastMessage: &last})
+	}
+	links := pageLinks{PrevCursor: "prev"}
+
+	result, err := renderChats(chats, links, newOutputBudget(2000), cursorChatsLastActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := result.Content[0].(mcp.TextContent).Text
+	if len(text) > 2000+500 {
+		t.Errorf("result is %d characters, want about 2000", len(text))
+	}
+
+	var decoded struct {
+		Chats      []Chat `json:"chats"`
+		Omitted    int    `json:"omitted"`
+		NextCursor string `json:"next_cursor"`
+		PrevCursor string `json:"prev_cursor"`
+	}
+	if err := json.Unmarshal([]byte(text), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	shown := len(decoded.Chats)
+	if shown == 0 || shown == len(chats) || decoded.Omitted != len(chats)-shown {
+		t.Fatalf("showed %d chats and omitted %d of %d", shown, decoded.Omitted, len(chats))
+	}
+	if !strings.HasSuffix(*decoded.Chats[0].LastMessage, "… [800 more characters]") {
+		t.Errorf("last message wasn't shortened: %q", *decoded.Chats[0].LastMessage)
+	}
+	if decoded.PrevCursor != "prev" {
+		t.Errorf("prev_cursor = %q, want the one passed in", decoded.PrevCursor)
+	}
+
+	// The next cursor continues after the last chat shown
+	cursor, err := decodeCursor(decoded.NextCursor, cursorChatsLastActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.ChatJID != chats[shown-1].JID || !cursor.Time.Equal(*chats[shown-1].LastMessageTime) {
+		t.Errorf("next cursor is at %s, want %s", cursor.ChatJID, chats[shown-1].JID)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// maxCompletions is how many suggestions a completion returns at most
+const maxCompletions = 20
+
+// chatCompletions suggests chats for the arguments of prompts and resource templates that
+// take one. Prompts get suggestions like "Name (jid)", which every chat argument accepts;
+// resource URIs get the bare JID.
+type chatCompletions struct{}
+
+func (chatCompletions) CompletePromptArgument(ctx context.Context, promptName string, argument mcp.CompleteArgument, context mcp.CompleteContext) (*mcp.Completion, error) {
+	if argument.Name != "chat" {
+		return &mcp.Completion{Values: []string{}}, nil
+	}
+	return completeChats(ctx, argument.Value, true)
+}
+
+func (chatCompletions) CompleteResourceArgument(ctx context.Context, uri string, argument mcp.CompleteArgument, context mcp.CompleteContext) (*mcp.Completion, error) {
+	if argument.Name != "jid" && argument.Name != "chat" {
+		return &mcp.Completion{Values: []string{}}, nil
+	}
+	return completeChats(ctx, argument.Value, false)
+}
+
+// completeChats returns the chats the client of ctx may access matching what was typed so far,
+// best match first and then the most recently active. With labels they are shown as
+// "Name (jid)", otherwise as JIDs.
+func completeChats(ctx context.Context, value string, labels bool) (*mcp.Completion, error) {
+	c := clientFromContext(ctx)
+	if !c.can(scopeRead) {
+		return &mcp.Completion{Values: []string{}}, nil
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT jid, name FROM chats ORDER BY last_message_time DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type candidate struct {
+		chat  Chat
+		score int
+	}
+	var candidates []candidate
+	value = strings.ToLower(strings.TrimSpace(value))
+	for rows.Next() {
+		var chat Chat
+		var name sql.NullString
+		if err := rows.Scan(&chat.JID, &name); err != nil {
+			return nil, err
+		}
+		if !c.canAccess(chat.JID) {
+			continue
+		}
+		if name.Valid {
+			chat.Name = &name.String
+		}
+		if score := chatMatchScore(value, name.String, chat.JID); score > 0 {
+			candidates = append(candidates, candidate{chat, score})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The stable sort keeps equally good matches in order of recency
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+
+	completion := &mcp.Completion{Values: []string{}, Total: len(candidates)}
+	for _, c := range candidates {
+		if len(completion.Values) == maxCompletions {
+			completion.HasMore = true
+			break
+		}
+		if labels {
+			completion.Values = append(completion.Values, chatTitle(&c.chat))
+		} else {
+			completion.Values = append(completion.Values, c.chat.JID)
+		}
+	}
+	return completion, nil
+}
+
+// chatMatchScore rates how well a chat matches the lowercase value typed so far, from 6 for
+// its exact name down to 1 for a name containing the letters in order, or 0 if it doesn't
+func chatMatchScore(value, name, jid string) int {
+	name = strings.ToLower(name)
+	jid = strings.ToLower(jid)
+	switch {
+	case value == "":
+		return 1
+	case name == value || jid == value:
+		return 6
+	case strings.HasPrefix(name, value) || strings.HasPrefix(jid, value):
+		return 5
+	case strings.Contains(" "+name, " "+value):
+		return 4
+	case strings.Contains(name, value) || strings.Contains(jid, value):
+		return 3
+	case strings.Contains(name+" ("+jid+")", value):
+		// A suggestion typed or pasted in full
+		return 2
+	case isSubsequence(value, name):
+		return 1
+	}
+	return 0
+}
+
+// isSubsequence reports whether the letters of value appear in s in the same order
+func isSubsequence(value, s string) bool {
+	rest := []rune(value)
+	for _, r := range s {
+		if len(rest) == 0 {
+			break
+		}
+		if r == rest[0] {
+			rest = rest[1:]
+		}
+	}
+	return len(rest) == 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// userLocation is the user's timezone. Dates in tool arguments without an explicit offset,
+// such as "2026-03-01" or "yesterday", are read in it.
+var userLocation = time.Local
+
+// defaultMaxChars is the size limit of a tool result in characters if the call doesn't set one
+var defaultMaxChars = 16000
+
+// pollInterval is how often the server checks messages.db for new messages to notify
+// resource subscribers of
+var pollInterval = 2 * time.Second
+
+// loadConfig reads the server settings from the environment:
+//
+//	WHATSAPP_MCP_TIMEZONE       IANA timezone of the user, e.g. "Europe/Amsterdam" (default: the system timezone)
+//	WHATSAPP_MCP_MAX_CHARS      default size limit of a tool result in characters (default 16000)
+//	WHATSAPP_MCP_POLL_INTERVAL  how often to check for new messages, e.g. "500ms" or "10s" (default 2s)
+//	WHATSAPP_BRIDGE_URL         where the bridge's REST API is, e.g. "https://host:8443" or "unix:/path/to/socket" (default http://localhost:8080)
+//	WHATSAPP_BRIDGE_TOKEN       the bridge's API token (default: read from WHATSAPP_BRIDGE_TOKEN_FILE)
+//	WHATSAPP_BRIDGE_TOKEN_FILE  the file the bridge keeps its API token in (default: api_token next to messages.db)
+//	WHATSAPP_BRIDGE_CA_FILE     CA certificate to verify the bridge's TLS certificate with (default: the system CAs)
+//	WHATSAPP_BRIDGE_CERT_FILE   client certificate for a bridge that requires one, with WHATSAPP_BRIDGE_KEY_FILE
+func loadConfig() error {
+	if name := os.Getenv("WHATSAPP_MCP_TIMEZONE"); name != "" {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			return fmt.Errorf("invalid WHATSAPP_MCP_TIMEZONE %q: %v", name, err)
+		}
+		userLocation = location
+	}
+	if value := os.Getenv("WHATSAPP_MCP_MAX_CHARS"); value != "" {
+		maxChars, err := strconv.Atoi(value)
+		if err != nil || maxChars < 500 {
+			return fmt.Errorf("invalid WHATSAPP_MCP_MAX_CHARS %q: must be a number of at least 500", value)
+		}
+		defaultMaxChars = maxChars
+	}
+	if value := os.Getenv("WHATSAPP_MCP_POLL_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 100*time.Millisecond {
+			return fmt.Errorf("invalid WHATSAPP_MCP_POLL_INTERVAL %q: must be a duration of at least 100ms", value)
+		}
+		pollInterval = interval
+	}
+	return configureBridge()
+}
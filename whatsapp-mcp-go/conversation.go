@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultConversationWindow is the time range of get_conversation if none is given
+const defaultConversationWindow = "past 24 hours"
+
+// conversationChunk is one chunk of a conversation: the messages in the structured form and
+// one transcript line per message
+type conversationChunk struct {
+	result *messagesResult
+	lines  []string
+}
+
+// getConversation returns the next chunk of a chat's messages in time order, starting at the
+// cursor or at after and ending before before, whose transcript fits in the budget. At least
+// one message is returned even if it alone is larger than the budget.
+func getConversation(chatJID string, after, before *time.Time, cursor *pageCursor, budget outputBudget, display timeDisplay) (*conversationChunk, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	whereClauses := []string{"messages.chat_jid = ?"}
+	params := []interface{}{chatJID}
+	if after != nil {
+		whereClauses = append(whereClauses, "messages.timestamp >= ?")
+		params = append(params, after.UTC())
+	}
+	if before != nil {
+		whereClauses = append(whereClauses, "messages.timestamp < ?")
+		params = append(params, before.UTC())
+	}
+
+	limit := conversationLimit(budget)
+	var keys []interface{}
+	if cursor != nil {
+		keys = []interface{}{cursorTime(cursor.Time), cursor.ChatJID, cursor.ID}
+	}
+	keyset, orderLimit, pageParams := keysetQuery([]string{"messages.timestamp", "messages.chat_jid", "messages.id"}, false, cursor, keys, limit, 0)
+	if keyset != "" {
+		whereClauses = append(whereClauses, keyset)
+	}
+
+	messages, err := querySearchResults(db, `
+		SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type
+		FROM messages
+		JOIN chats ON messages.chat_jid = chats.jid
+		WHERE `+strings.Join(whereClauses, " AND ")+" "+orderLimit, append(params, pageParams...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	result, err := buildMessagesResult(matchesOnly(messages), display)
+	if err != nil {
+		return nil, err
+	}
+
+	budget.shortenMessages(result)
+	chunk := &conversationChunk{result: result}
+	for _, match := range result.Messages {
+		chunk.lines = append(chunk.lines, formatConversationLine(match.messageOutput))
+	}
+	if shown := budget.fit(len(chunk.lines), func(i int) int { return len(chunk.lines[i]) }); shown < len(chunk.lines) {
+		result.Messages = result.Messages[:shown]
+		chunk.lines = chunk.lines[:shown]
+		more = true
+	}
+
+	if more && len(result.Messages) > 0 {
+		last := result.Messages[len(result.Messages)-1]
+		result.NextCursor = encodeCursor(pageCursor{List: cursorConversation, Time: &last.Timestamp, ChatJID: last.ChatJID, ID: last.ID})
+	}
+	return chunk, nil
+}
+
+// latestConversation returns the latest messages of a chat between after and before, in time
+// order, whose transcript fits in the budget, and how many earlier messages in the range it
+// left out. At least one message is returned if there are any.
+func latestConversation(chatJID string, after, before *time.Time, budget outputBudget, display timeDisplay) (*conversationChunk, int, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+
+	whereClauses := []string{"messages.chat_jid = ?"}
+	params := []interface{}{chatJID}
+	if after != nil {
+		whereClauses = append(whereClauses, "messages.timestamp >= ?")
+		params = append(params, after.UTC())
+	}
+	if before != nil {
+		whereClauses = append(whereClauses, "messages.timestamp < ?")
+		params = append(params, before.UTC())
+	}
+	where := strings.Join(whereClauses, " AND ")
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE "+where, params...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	messages, err := querySearchResults(db, `
+		SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type
+		FROM messages
+		JOIN chats ON messages.chat_jid = chats.jid
+		WHERE `+where+`
+		ORDER BY messages.timestamp DESC, messages.id DESC
+		LIMIT ?`, append(params, conversationLimit(budget))...)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	result, err := buildMessagesResult(matchesOnly(messages), display)
+	if err != nil {
+		return nil, 0, err
+	}
+	budget.shortenMessages(result)
+	chunk := &conversationChunk{result: result}
+	for _, match := range result.Messages {
+		chunk.lines = append(chunk.lines, formatConversationLine(match.messageOutput))
+	}
+
+	// Fit from the end, so the newest messages are kept
+	n := len(chunk.lines)
+	shown := budget.fit(n, func(i int) int { return len(chunk.lines[n-1-i]) })
+	result.Messages = result.Messages[n-shown:]
+	chunk.lines = chunk.lines[n-shown:]
+	return chunk, total - shown, nil
+}
+
+// conversationLimit is how many messages to load for a transcript in the budget. Even short
+// messages take up a line, so this is more than fits in nearly all chats.
+func conversationLimit(budget outputBudget) int {
+	limit := budget.maxChars / 16
+	if limit < 20 {
+		limit = 20
+	} else if limit > 1000 {
+		limit = 1000
+	}
+	return limit
+}
+
+// findChat looks up a chat by name, phone number or JID. A non-empty within limits names
+// to those chat JIDs.
+func findChat(value string, within []string) (*Chat, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	jid, err := resolveChat(db, value, within)
+	db.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := getChat(jid, false)
+	if err != nil {
+		return nil, err
+	}
+	if chat == nil {
+		return nil, fmt.Errorf("no chat %s", jid)
+	}
+	return chat, nil
+}
+
+// chatTitle names a chat by its name and JID, or just the JID if it has no name
+func chatTitle(chat *Chat) string {
+	if chat.Name != nil && *chat.Name != "" {
+		return fmt.Sprintf("%s (%s)", *chat.Name, chat.JID)
+	}
+	return chat.JID
+}
+
+// lastOwnMessage returns the position of the last message I sent in a chat, or nil if I never did
+func lastOwnMessage(chatJID string) (*pageCursor, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var timestampStr, id string
+	err = db.QueryRow(`
+		SELECT timestamp, id FROM messages
+		WHERE chat_jid = ? AND is_from_me = 1
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	`, chatJID).Scan(&timestampStr, &id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, timestampStr)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCursor{List: cursorConversation, Time: &timestamp, ChatJID: chatJID, ID: id}, nil
+}
+
+// formatConversationLine formats a message as one transcript entry, e.g.
+// "[14:05] Alice (replying to Bob: "lunch?"): [image photo.jpg, id 3EB0...] sure [👍 Bob]"
+func formatConversationLine(msg messageOutput) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", msg.Timestamp.Format("15:04"), msg.SenderName)
+	if msg.ReplyTo != nil {
+		if msg.ReplyTo.SenderName != "" {
+			fmt.Fprintf(&b, " (replying to %s: %q)", msg.ReplyTo.SenderName, truncateText(strings.ReplaceAll(msg.ReplyTo.Text, "\n", " "), 60))
+		} else {
+			b.WriteString(" (replying to an earlier message)")
+		}
+	}
+	b.WriteString(":")
+
+	if msg.Media != nil {
+		fmt.Fprintf(&b, " [%s", msg.Media.Type)
+		if msg.Media.Filename != "" {
+			fmt.Fprintf(&b, " %s", msg.Media.Filename)
+		}
+		fmt.Fprintf(&b, ", id %s]", msg.ID)
+	}
+	text := msg.Text
+	if text == "" && msg.Media != nil {
+		text = msg.Media.Caption
+	}
+	if text != "" {
+		b.WriteString(" " + strings.ReplaceAll(text, "\n", "\n    "))
+	}
+
+	if len(msg.Reactions) > 0 {
+		reactions := make([]string, len(msg.Reactions))
+		for i, reaction := range msg.Reactions {
+			reactions[i] = reaction.Emoji + " " + reaction.SenderName
+		}
+		fmt.Fprintf(&b, " [%s]", strings.Join(reactions, ", "))
+	}
+	return b.String() + "\n"
+}
+
+// formatConversation formats a chunk as a transcript with a line wherever the day changes.
+// next says how to read on from a cursor.
+func formatConversation(chunk *conversationChunk, chatName string, next func(cursor string) string, display timeDisplay) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Conversation in %s\n", chatName)
+	for _, note := range chunk.result.Notes {
+		b.WriteString(note + "\n")
+	}
+	if len(chunk.result.Dates) > 0 {
+		fmt.Fprintf(&b, "Dates: %s\n", strings.Join(chunk.result.Dates, "; "))
+	}
+
+	if len(chunk.lines) == 0 {
+		b.WriteString("No messages to display.\n")
+	}
+	lastDay := ""
+	for i, match := range chunk.result.Messages {
+		if day := display.day(match.Timestamp); day != lastDay {
+			fmt.Fprintf(&b, "--- %s ---\n", day)
+			lastDay = day
+		}
+		b.WriteString(chunk.lines[i])
+	}
+
+	if chunk.result.NextCursor != "" {
+		fmt.Fprintf(&b, "\nThe transcript continues, %s\n", next(chunk.result.NextCursor))
+	} else {
+		b.WriteString("\nEnd of the conversation in this time range.\n")
+	}
+	return b.String()
+}
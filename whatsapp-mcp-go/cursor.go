@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Lists that support cursors. A cursor only continues the list, and sort order, it came from.
+const (
+	cursorMessages        = "messages"
+	cursorChatsLastActive = "chats:last_active"
+	cursorChatsName       = "chats:name"
+	cursorContactChats    = "contact_chats"
+	cursorConversation    = "conversation"
+	cursorSearch          = "search"
+	cursorSemanticSearch  = "semantic_search"
+)
+
+// cursorParam lets a list tool continue from a previous call
+var cursorParam = mcp.WithString("cursor", mcp.Description("Optional next_cursor or prev_cursor from a previous call to continue from. Unlike page, cursors don't skip or repeat items when new messages arrive in between."))
+
+// pageCursor is the position of a row in a list ordered by a unique key. Rows are compared by
+// their key values, so a cursor stays valid while rows are added, unlike an offset.
+type pageCursor struct {
+	List     string     `json:"l"`
+	Backward bool       `json:"b,omitempty"` // towards the start of the list
+	Time     *time.Time `json:"t,omitempty"`
+	Name     string     `json:"n,omitempty"`
+	ChatJID  string     `json:"c"`
+	ID       string     `json:"i,omitempty"`
+	Offset   int        `json:"o,omitempty"` // position in lists ranked by relevance, which have no stable key
+}
+
+// pageLinks are the cursors to the pages around a page of results
+type pageLinks struct {
+	NextCursor string `json:"next_cursor,omitempty" jsonschema:"Cursor to the next page; missing on the last page"`
+	PrevCursor string `json:"prev_cursor,omitempty" jsonschema:"Cursor to the previous page; also picks up items added since"`
+}
+
+// encodeCursor returns the opaque form of a cursor
+func encodeCursor(cursor pageCursor) string {
+	if cursor.Time != nil {
+		t := cursor.Time.UTC()
+		cursor.Time = &t
+	}
+	content, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// decodeCursor reads a cursor given to a tool, which must belong to the given list
+func decodeCursor(value, list string) (*pageCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor, pass next_cursor or prev_cursor from a previous call unchanged")
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(content, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor, pass next_cursor or prev_cursor from a previous call unchanged")
+	}
+	if cursor.List != list {
+		return nil, fmt.Errorf("the cursor belongs to another list or sort order")
+	}
+	return &cursor, nil
+}
+
+// chatsCursorList returns the cursor list of list_chats in a sort order
+func chatsCursorList(sortBy string) string {
+	if sortBy == "name" {
+		return cursorChatsName
+	}
+	return cursorChatsLastActive
+}
+
+// chatCursor returns the position of a chat in a list of chats
+func chatCursor(list string, chat Chat) pageCursor {
+	cursor := pageCursor{List: list, Time: chat.LastMessageTime, ChatJID: chat.JID}
+	if list == cursorChatsName {
+		cursor.Time = nil
+		if chat.Name != nil {
+			cursor.Name = *chat.Name
+		}
+	}
+	return cursor
+}
+
+// keysetQuery builds the condition, order and limit that select a page of a list ordered by
+// columns. Without a cursor it falls back to an offset for the deprecated page argument. The
+// query asks for one row more than limit to find out whether there are more.
+func keysetQuery(columns []string, descending bool, cursor *pageCursor, keys []interface{}, limit, page int) (condition, orderLimit string, params []interface{}) {
+	backward := cursor != nil && cursor.Backward
+	// Paging backward walks the list in reverse, paginate restores the order
+	reverse := descending != backward
+
+	direction := "ASC"
+	if reverse {
+		direction = "DESC"
+	}
+	order := make([]string, len(columns))
+	for i, column := range columns {
+		order[i] = column + " " + direction
+	}
+
+	if cursor == nil {
+		return "", "ORDER BY " + strings.Join(order, ", ") + " LIMIT ? OFFSET ?", []interface{}{limit + 1, page * limit}
+	}
+
+	operator := ">"
+	if reverse {
+		operator = "<"
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	condition = fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), operator, placeholders)
+	return condition, "ORDER BY " + strings.Join(order, ", ") + " LIMIT ?", append(keys, limit+1)
+}
+
+// offsetLinks returns the cursors around results offset to offset+n of a list ranked by
+// relevance. A full page may be followed by more.
+func offsetLinks(list string, offset, limit, n int) pageLinks {
+	var links pageLinks
+	if n >= limit {
+		links.NextCursor = encodeCursor(pageCursor{List: list, Offset: offset + n})
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links.PrevCursor = encodeCursor(pageCursor{List: list, Offset: prev})
+	}
+	return links
+}
+
+// cursorTime is the value a cursor compares a timestamp column with. Timestamps are stored as
+// UTC text, and a missing one sorts before all others.
+func cursorTime(t *time.Time) interface{} {
+	if t == nil {
+		return ""
+	}
+	return t.UTC()
+}
+
+// paginate trims the rows a keysetQuery returned to a page in list order and returns the
+// cursors around it. There is always a previous cursor, so callers can check for newer rows
+// later, but only a next cursor if there are more rows.
+func paginate[T any](rows []T, limit int, cursor *pageCursor, keyOf func(T) pageCursor) ([]T, pageLinks) {
+	backward := cursor != nil && cursor.Backward
+	more := len(rows) > limit
+	if more {
+		rows = rows[:limit]
+	}
+	if backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	var links pageLinks
+	if len(rows) == 0 {
+		// Nothing newer yet: the same position can be polled again
+		if backward {
+			links.PrevCursor = encodeCursor(*cursor)
+		}
+		return rows, links
+	}
+
+	first := keyOf(rows[0])
+	first.Backward = true
+	links.PrevCursor = encodeCursor(first)
+	if more || backward {
+		last := keyOf(rows[len(rows)-1])
+		links.NextCursor = encodeCursor(last)
+	}
+	return rows, links
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeysetQuery(t *testing.T) {
+	columns := []string{"messages.timestamp", "messages.id"}
+	keys := []interface{}{"2026-03-04 15:00:00+00:00", "m1"}
+	tests := []struct {
+		name       string
+		descending bool
+		cursor     *pageCursor
+		page       int
+		condition  string
+		orderLimit string
+		params     []interface{}
+	}{
+		{"first page", true, nil, 0,
+			"", "ORDER BY messages.timestamp DESC, messages.id DESC LIMIT ? OFFSET ?", []interface{}{11, 0}},
+		{"deprecated page number", false, nil, 2,
+			"", "ORDER BY messages.timestamp ASC, messages.id ASC LIMIT ? OFFSET ?", []interface{}{11, 20}},
+		{"descending forward", true, &pageCursor{}, 0,
+			"(messages.timestamp, messages.id) < (?, ?)", "ORDER BY messages.timestamp DESC, messages.id DESC LIMIT ?", []interface{}{keys[0], keys[1], 11}},
+		{"descending backward", true, &pageCursor{Backward: true}, 0,
+			"(messages.timestamp, messages.id) > (?, ?)", "ORDER BY messages.timestamp ASC, messages.id ASC LIMIT ?", []interface{}{keys[0], keys[1], 11}},
+		{"ascending forward", false, &pageCursor{}, 0,
+			"(messages.timestamp, messages.id) > (?, ?)", "ORDER BY messages.timestamp ASC, messages.id ASC LIMIT ?", []interface{}{keys[0], keys[1], 11}},
+		{"ascending backward", false, &pageCursor{Backward: true}, 0,
+			"(messages.timestamp, messages.id) < (?, ?)", "ORDER BY messages.timestamp DESC, messages.id DESC LIMIT ?", []interface{}{keys[0], keys[1], 11}},
+		{"cursor wins over page", true, &pageCursor{}, 3,
+			"(messages.timestamp, messages.id) < (?, ?)", "ORDER BY messages.timestamp DESC, messages.id DESC LIMIT ?", []interface{}{keys[0], keys[1], 11}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cursorKeys []interface{}
+			if tt.cursor != nil {
+				cursorKeys = append(cursorKeys, keys...)
+			}
+			condition, orderLimit, params := keysetQuery(columns, tt.descending, tt.cursor, cursorKeys, 10, tt.page)
+			if condition != tt.condition {
+				t.Errorf("condition = %q, want %q", condition, tt.condition)
+			}
+			if orderLimit != tt.orderLimit {
+				t.Errorf("orderLimit = %q, want %q", orderLimit, tt.orderLimit)
+			}
+			if !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("params = %v, want %v", params, tt.params)
+			}
+		})
+	}
+}
+
+// testRow is a row of the list the pagination tests walk
+type testRow struct {
+	Time time.Time
+	ID   string
+}
+
+// queryTestPage reads a page of the items table, newest first, the way the list tools do
+func queryTestPage(t *testing.T, db *sql.DB, limit int, cursor *pageCursor) ([]testRow, pageLinks) {
+	t.Helper()
+	var keys []interface{}
+	if cursor != nil {
+		keys = []interface{}{cursorTime(cursor.Time), cursor.ID}
+	}
+	condition, orderLimit, params := keysetQuery([]string{"timestamp", "id"}, true, cursor, keys, limit, 0)
+	query := "SELECT timestamp, id FROM items"
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+	rows, err := db.Query(query+" "+orderLimit, params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var page []testRow
+	for rows.Next() {
+		var row testRow
+		if err := rows.Scan(&row.Time, &row.ID); err != nil {
+			t.Fatal(err)
+		}
+		page = append(page, row)
+	}
+	return paginate(page, limit, cursor, func(row testRow) pageCursor {
+		return pageCursor{List: cursorMessages, Time: &row.Time, ID: row.ID}
+	})
+}
+
+// nextTestCursor decodes a cursor returned by queryTestPage
+func nextTestCursor(t *testing.T, value string) *pageCursor {
+	t.Helper()
+	cursor, err := decodeCursor(value, cursorMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cursor
+}
+
+func TestPaginate(t *testing.T) {
+	db := openTestDB(t, "CREATE TABLE items (timestamp TIMESTAMP, id TEXT)")
+	insert := func(minute int, id string) {
+		t.Helper()
+		if _, err := db.Exec("INSERT INTO items (timestamp, id) VALUES (?, ?)", testNow.Add(time.Duration(minute)*time.Minute), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Seven rows, two pairs of which share a time and are ordered by ID
+	var want []string
+	for i, minute := range []int{-1, -2, -2, -3, -4, -4, -5} {
+		id := fmt.Sprintf("r%d", 7-i)
+		insert(minute, id)
+		want = append(want, id)
+	}
+
+	// Walk forward to the end
+	var got []string
+	var cursor *pageCursor
+	var links pageLinks
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatal("paging forward didn't end")
+		}
+		var page []testRow
+		page, links = queryTestPage(t, db, 3, cursor)
+		for _, row := range page {
+			got = append(got, row.ID)
+		}
+		if links.PrevCursor == "" {
+			t.Error("a page has no previous cursor")
+		}
+		if links.NextCursor == "" {
+			break
+		}
+		cursor = nextTestCursor(t, links.NextCursor)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("paging forward = %v, want %v", got, want)
+	}
+
+	// And back from the last page to the start
+	got = nil
+	last, _ := queryTestPage(t, db, 3, cursor)
+	for _, row := range last {
+		got = append(got, row.ID)
+	}
+	prev := links.PrevCursor
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatal("paging backward didn't end")
+		}
+		page, links := queryTestPage(t, db, 3, nextTestCursor(t, prev))
+		if len(page) == 0 {
+			break
+		}
+		var ids []string
+		for _, row := range page {
+			ids = append(ids, row.ID)
+		}
+		got = append(ids, got...)
+		if links.NextCursor == "" {
+			t.Error("a page before the last has no next cursor")
+		}
+		prev = links.PrevCursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("paging backward = %v, want %v", got, want)
+	}
+
+	// Paging back from the first page picks up rows added since, and polling an empty
+	// page keeps the position
+	first, links := queryTestPage(t, db, 3, nil)
+	if first[0].ID != "r7" {
+		t.Fatalf("first page starts at %s, want r7", first[0].ID)
+	}
+	empty, emptyLinks := queryTestPage(t, db, 3, nextTestCursor(t, links.PrevCursor))
+	if len(empty) != 0 || emptyLinks.PrevCursor != links.PrevCursor || emptyLinks.NextCursor != "" {
+		t.Errorf("polling for newer rows = %v, %+v, want nothing and the same cursor", empty, emptyLinks)
+	}
+	insert(0, "r8")
+	newer, _ := queryTestPage(t, db, 3, nextTestCursor(t, links.PrevCursor))
+	if len(newer) != 1 || newer[0].ID != "r8" {
+		t.Errorf("paging back from the first page = %v, want r8", newer)
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	at := testNow
+	encoded := encodeCursor(pageCursor{List: cursorMessages, Time: &at, ChatJID: "123@s.whatsapp.net", ID: "m1"})
+	cursor, err := decodeCursor(encoded, cursorMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.Time.Equal(at) || cursor.ChatJID != "123@s.whatsapp.net" || cursor.ID != "m1" || cursor.Backward {
+		t.Errorf("decodeCursor(encodeCursor(...)) = %+v", cursor)
+	}
+
+	if cursor, err := decodeCursor("", cursorMessages); cursor != nil || err != nil {
+		t.Errorf("decodeCursor of no cursor = %v, %v, want nil", cursor, err)
+	}
+	for _, value := range []string{"not a cursor!", "bm90IGpzb24"} {
+		if _, err := decodeCursor(value, cursorMessages); err == nil {
+			t.Errorf("decodeCursor(%q) accepted an invalid cursor", value)
+		}
+	}
+	if _, err := decodeCursor(encoded, cursorChatsName); err == nil {
+		t.Error("decodeCursor accepted a cursor of another list")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindow is the span of time a date expression refers to. End is exclusive, and
+// expressions naming an exact time, such as "3 hours ago", have Start equal to End.
+type timeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// dateExpressionHelp lists the date formats parseTimeExpression accepts
+const dateExpressionHelp = `2026-03-01, 2026-03, "2026-03-01 14:00", RFC3339, "march 3", today, yesterday, ` +
+	`"this morning", "last night", "yesterday 3pm", monday, "last friday", "3 days ago", "past 2 hours", ` +
+	`"last 7 days", "this week", "last month", march`
+
+// dateEchoLayout shows how a date was read
+const dateEchoLayout = "Mon 2006-01-02 15:04 MST"
+
+var (
+	ordinalPattern = regexp.MustCompile(`(\d)(st|nd|rd|th)\b`)
+	agoPattern     = regexp.MustCompile(`^(?:(\d+) ?|an? )([a-z]+)(?: ago)?$`)
+	rollingPattern = regexp.MustCompile(`^(?:past|last) (?:(\d+) ?)?([a-z]+)$`)
+	clockPattern   = regexp.MustCompile(`^(?:(.+) )?(\d{1,2})(?::(\d{2}))? ?(am|pm)?$`)
+)
+
+// Parts of a day, as hours after midnight. The night runs into the next morning.
+var dayParts = map[string][2]int{
+	"morning":   {6, 12},
+	"afternoon": {12, 18},
+	"evening":   {18, 24},
+	"night":     {18, 30},
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday, "tues": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday, "thur": time.Thursday, "thurs": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+// parseTimeExpression reads a date or time as written by a person or a model: exact times,
+// dates, local times without an offset, relative times and named periods. Anything without
+// an explicit offset is read in now's timezone, and the window is returned in that timezone.
+func parseTimeExpression(value string, now time.Time) (timeWindow, error) {
+	window, ok := parseExactTime(strings.TrimSpace(value), now.Location())
+	if !ok {
+		window, ok = parseTimeWindow(normalizeDateExpression(value), now)
+	}
+	if !ok {
+		return timeWindow{}, fmt.Errorf("can't read %q as a date, use e.g. %s", value, dateExpressionHelp)
+	}
+	return timeWindow{Start: window.Start.In(now.Location()), End: window.End.In(now.Location())}, nil
+}
+
+// parseDateFilter reads the value of an after:, before: or during: filter. It returns the
+// bounds the filter sets and a note on how the value was read.
+func parseDateFilter(operator, value string, now time.Time) (after, before *time.Time, note string, err error) {
+	window, err := parseTimeExpression(value, now)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	switch operator {
+	case "after":
+		// On or after the start of the period, so after:yesterday includes all of yesterday
+		return &window.Start, nil, fmt.Sprintf("after:%q = on or after %s", value, window.Start.Format(dateEchoLayout)), nil
+	case "before":
+		return nil, &window.Start, fmt.Sprintf("before:%q = before %s", value, window.Start.Format(dateEchoLayout)), nil
+	default:
+		if window.Start.Equal(window.End) {
+			return nil, nil, "", fmt.Errorf("%q is an exact time, use a period such as a day or a week", value)
+		}
+		return &window.Start, &window.End, fmt.Sprintf("during:%q = %s to %s", value, window.Start.Format(dateEchoLayout), window.End.Format(dateEchoLayout)), nil
+	}
+}
+
+// normalizeDateExpression lowercases an expression and drops the noise people add to dates
+func normalizeDateExpression(value string) string {
+	value = strings.ToLower(value)
+	value = strings.NewReplacer("_", " ", ",", " ").Replace(value)
+	value = ordinalPattern.ReplaceAllString(value, "$1")
+
+	var words []string
+	for _, word := range strings.Fields(value) {
+		if word != "at" && word != "on" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// parseExactTime parses numeric dates and times, which are case sensitive
+func parseExactTime(value string, location *time.Location) (timeWindow, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return timeWindow{Start: t, End: t}, true
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return timeWindow{Start: t, End: t}, true
+		}
+	}
+	for _, layout := range []string{"2006-01-02", "2006/01/02"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return timeWindow{Start: t, End: t.AddDate(0, 0, 1)}, true
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01", value, location); err == nil {
+		return timeWindow{Start: t, End: t.AddDate(0, 1, 0)}, true
+	}
+	if len(value) == 4 {
+		if t, err := time.ParseInLocation("2006", value, location); err == nil {
+			return timeWindow{Start: t, End: t.AddDate(1, 0, 0)}, true
+		}
+	}
+	return timeWindow{}, false
+}
+
+// parseTimeWindow parses a normalised expression relative to now
+func parseTimeWindow(s string, now time.Time) (timeWindow, bool) {
+	if window, ok := parseExactTime(s, now.Location()); ok {
+		return window, true
+	}
+
+	today := startOfDay(now)
+	day := func(t time.Time) timeWindow { return timeWindow{Start: t, End: t.AddDate(0, 0, 1)} }
+
+	switch s {
+	case "now":
+		return timeWindow{Start: now, End: now}, true
+	case "today":
+		return day(today), true
+	case "yesterday":
+		return day(today.AddDate(0, 0, -1)), true
+	case "tomorrow":
+		return day(today.AddDate(0, 0, 1)), true
+	case "tonight":
+		return dayPart(today, "night"), true
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return timeWindow{}, false
+	}
+	last := words[len(words)-1]
+	prefix := ""
+	if len(words) == 2 {
+		prefix = words[0]
+	}
+
+	// Calendar periods: this week, last month, next year. Weeks start on Monday.
+	if len(words) == 2 && (prefix == "this" || prefix == "last" || prefix == "previous" || prefix == "next") {
+		offset := map[string]int{"this": 0, "last": -1, "previous": -1, "next": 1}[prefix]
+		switch last {
+		case "week":
+			start := today.AddDate(0, 0, -((int(now.Weekday())+6)%7)+7*offset)
+			return timeWindow{Start: start, End: start.AddDate(0, 0, 7)}, true
+		case "month":
+			start := time.Date(now.Year(), now.Month()+time.Month(offset), 1, 0, 0, 0, 0, now.Location())
+			return timeWindow{Start: start, End: start.AddDate(0, 1, 0)}, true
+		case "year":
+			start := time.Date(now.Year()+offset, 1, 1, 0, 0, 0, 0, now.Location())
+			return timeWindow{Start: start, End: start.AddDate(1, 0, 0)}, true
+		}
+	}
+
+	// Parts of a day: this morning, yesterday evening, last night
+	if _, ok := dayParts[last]; ok && len(words) <= 2 {
+		switch prefix {
+		case "", "this", "today":
+			return dayPart(today, last), true
+		case "yesterday", "last":
+			return dayPart(today.AddDate(0, 0, -1), last), true
+		case "tomorrow", "next":
+			return dayPart(today.AddDate(0, 0, 1), last), true
+		}
+	}
+
+	// Weekdays: monday is the last Monday up to today, last monday the one before today
+	if weekday, ok := weekdays[last]; ok && len(words) <= 2 {
+		back := (int(now.Weekday()) - int(weekday) + 7) % 7
+		switch prefix {
+		case "":
+			return day(today.AddDate(0, 0, -back)), true
+		case "last", "previous":
+			if back == 0 {
+				back = 7
+			}
+			return day(today.AddDate(0, 0, -back)), true
+		case "this":
+			return day(today.AddDate(0, 0, -((int(now.Weekday())+6)%7)+(int(weekday)+6)%7)), true
+		case "next":
+			ahead := (int(weekday) - int(now.Weekday()) + 7) % 7
+			if ahead == 0 {
+				ahead = 7
+			}
+			return day(today.AddDate(0, 0, ahead)), true
+		}
+	}
+
+	// Rolling periods up to now: past 2 hours, last 7 days, past week
+	if m := rollingPattern.FindStringSubmatch(s); m != nil {
+		n := 1
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if start, ok := addUnits(now, -n, m[2]); ok {
+			return timeWindow{Start: start, End: now}, true
+		}
+	}
+
+	// Relative times: 3 days ago, an hour ago, 2w
+	if m := agoPattern.FindStringSubmatch(s); m != nil {
+		n := 1
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if t, ok := addUnits(now, -n, m[2]); ok {
+			return timeWindow{Start: t, End: t}, true
+		}
+	}
+
+	if window, ok := parseNamedDate(s, now); ok {
+		return window, true
+	}
+
+	// A time on a day: yesterday 3pm, monday 9:30, 14:00
+	if m := clockPattern.FindStringSubmatch(s); m != nil && (m[3] != "" || m[4] != "") {
+		base := day(today)
+		if m[1] != "" {
+			var ok bool
+			if base, ok = parseTimeWindow(m[1], now); !ok || !base.End.Equal(base.Start.AddDate(0, 0, 1)) {
+				return timeWindow{}, false
+			}
+		}
+		hour, _ := strconv.Atoi(m[2])
+		minute, _ := strconv.Atoi(m[3])
+		switch {
+		case m[4] != "" && (hour < 1 || hour > 12):
+			return timeWindow{}, false
+		case m[4] == "pm" && hour < 12:
+			hour += 12
+		case m[4] == "am" && hour == 12:
+			hour = 0
+		}
+		if hour > 23 || minute > 59 {
+			return timeWindow{}, false
+		}
+		t := time.Date(base.Start.Year(), base.Start.Month(), base.Start.Day(), hour, minute, 0, 0, now.Location())
+		return timeWindow{Start: t, End: t}, true
+	}
+
+	return timeWindow{}, false
+}
+
+// parseNamedDate parses dates and months written with month names: march 3, 3 march 2025,
+// march, march 2025, last march. Without a year they refer to the most recent one.
+func parseNamedDate(s string, now time.Time) (timeWindow, bool) {
+	location := now.Location()
+
+	for _, layout := range []string{"January 2 2006", "Jan 2 2006", "2 January 2006", "2 Jan 2006"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			return timeWindow{Start: t, End: t.AddDate(0, 0, 1)}, true
+		}
+	}
+	for _, layout := range []string{"January 2", "Jan 2", "2 January", "2 Jan"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			t = time.Date(now.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+			if t.After(now) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return timeWindow{Start: t, End: t.AddDate(0, 0, 1)}, true
+		}
+	}
+	for _, layout := range []string{"January 2006", "Jan 2006"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			return timeWindow{Start: t, End: t.AddDate(0, 1, 0)}, true
+		}
+	}
+
+	name := strings.TrimPrefix(s, "last ")
+	for _, layout := range []string{"January", "Jan"} {
+		if t, err := time.ParseInLocation(layout, name, location); err == nil {
+			year := now.Year()
+			if t.Month() > now.Month() || (name != s && t.Month() == now.Month()) {
+				year--
+			}
+			start := time.Date(year, t.Month(), 1, 0, 0, 0, 0, location)
+			return timeWindow{Start: start, End: start.AddDate(0, 1, 0)}, true
+		}
+	}
+	return timeWindow{}, false
+}
+
+// addUnits adds n of a unit such as "days", "h" or "weeks" to t
+func addUnits(t time.Time, n int, unit string) (time.Time, bool) {
+	switch unit {
+	case "s", "sec", "secs", "second", "seconds":
+		return t.Add(time.Duration(n) * time.Second), true
+	case "m", "min", "mins", "minute", "minutes":
+		return t.Add(time.Duration(n) * time.Minute), true
+	case "h", "hr", "hrs", "hour", "hours":
+		return t.Add(time.Duration(n) * time.Hour), true
+	case "d", "day", "days":
+		return t.AddDate(0, 0, n), true
+	case "w", "wk", "wks", "week", "weeks":
+		return t.AddDate(0, 0, 7*n), true
+	case "mo", "month", "months":
+		return t.AddDate(0, n, 0), true
+	case "y", "yr", "yrs", "year", "years":
+		return t.AddDate(n, 0, 0), true
+	}
+	return t, false
+}
+
+// startOfDay returns midnight at the start of t's day in t's timezone
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// dayPart returns a part of the day starting at midnight day
+func dayPart(day time.Time, part string) timeWindow {
+	hours := dayParts[part]
+	return timeWindow{
+		Start: time.Date(day.Year(), day.Month(), day.Day(), hours[0], 0, 0, 0, day.Location()),
+		End:   time.Date(day.Year(), day.Month(), day.Day(), hours[1], 0, 0, 0, day.Location()),
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testZone is an hour ahead of UTC, so dates read in UTC by mistake are off
+var testZone = time.FixedZone("CET", 3600)
+
+// inTestZone returns a time in testZone
+func inTestZone(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, testZone)
+}
+
+func TestParseTimeExpression(t *testing.T) {
+	now := testNow.In(testZone) // Wednesday 2026-03-04 16:00 CET
+	at := func(t time.Time) timeWindow { return timeWindow{Start: t, End: t} }
+	days := func(year int, month time.Month, day, n int) timeWindow {
+		start := inTestZone(year, month, day, 0, 0)
+		return timeWindow{Start: start, End: start.AddDate(0, 0, n)}
+	}
+
+	tests := []struct {
+		value string
+		want  timeWindow
+	}{
+		// Exact and numeric dates
+		{"2026-03-01T14:00:00Z", at(inTestZone(2026, 3, 1, 15, 0))},
+		{"2026-03-01T14:00:00+05:00", at(inTestZone(2026, 3, 1, 10, 0))},
+		{"2026-03-01T14:00", at(inTestZone(2026, 3, 1, 14, 0))},
+		{"2026-03-01 14:00:30", at(time.Date(2026, 3, 1, 14, 0, 30, 0, testZone))},
+		{"2026-03-01 14:00", at(inTestZone(2026, 3, 1, 14, 0))},
+		{"2026-03-01", days(2026, 3, 1, 1)},
+		{"2026/03/01", days(2026, 3, 1, 1)},
+		{"2026-02", timeWindow{inTestZone(2026, 2, 1, 0, 0), inTestZone(2026, 3, 1, 0, 0)}},
+		{"2025", timeWindow{inTestZone(2025, 1, 1, 0, 0), inTestZone(2026, 1, 1, 0, 0)}},
+
+		// Days and parts of days
+		{"now", at(now)},
+		{"today", days(2026, 3, 4, 1)},
+		{"Yesterday", days(2026, 3, 3, 1)},
+		{"tomorrow", days(2026, 3, 5, 1)},
+		{"tonight", timeWindow{inTestZone(2026, 3, 4, 18, 0), inTestZone(2026, 3, 5, 6, 0)}},
+		{"this morning", timeWindow{inTestZone(2026, 3, 4, 6, 0), inTestZone(2026, 3, 4, 12, 0)}},
+		{"yesterday evening", timeWindow{inTestZone(2026, 3, 3, 18, 0), inTestZone(2026, 3, 4, 0, 0)}},
+		{"last night", timeWindow{inTestZone(2026, 3, 3, 18, 0), inTestZone(2026, 3, 4, 6, 0)}},
+
+		// Weekdays, relative to a Wednesday
+		{"monday", days(2026, 3, 2, 1)},
+		{"on Friday", days(2026, 2, 27, 1)},
+		{"wednesday", days(2026, 3, 4, 1)},
+		{"last wednesday", days(2026, 2, 25, 1)},
+		{"last fri", days(2026, 2, 27, 1)},
+		{"this friday", days(2026, 3, 6, 1)},
+		{"next wed", days(2026, 3, 11, 1)},
+
+		// Calendar periods, weeks starting on Monday
+		{"this week", days(2026, 3, 2, 7)},
+		{"last week", days(2026, 2, 23, 7)},
+		{"previous month", timeWindow{inTestZone(2026, 2, 1, 0, 0), inTestZone(2026, 3, 1, 0, 0)}},
+		{"next month", timeWindow{inTestZone(2026, 4, 1, 0, 0), inTestZone(2026, 5, 1, 0, 0)}},
+		{"last year", timeWindow{inTestZone(2025, 1, 1, 0, 0), inTestZone(2026, 1, 1, 0, 0)}},
+
+		// Rolling periods and relative times
+		{"past 2 hours", timeWindow{now.Add(-2 * time.Hour), now}},
+		{"last 7 days", timeWindow{now.AddDate(0, 0, -7), now}},
+		{"past week", timeWindow{now.AddDate(0, 0, -7), now}},
+		{"3 days ago", at(now.AddDate(0, 0, -3))},
+		{"an hour ago", at(now.Add(-time.Hour))},
+		{"2w", at(now.AddDate(0, 0, -14))},
+		{"90 mins ago", at(now.Add(-90 * time.Minute))},
+
+		// Month names, without a year the most recent one
+		{"march 3", days(2026, 3, 3, 1)},
+		{"March 3rd, 2025", days(2025, 3, 3, 1)},
+		{"3 mar 2025", days(2025, 3, 3, 1)},
+		{"march 5", days(2025, 3, 5, 1)},
+		{"march", timeWindow{inTestZone(2026, 3, 1, 0, 0), inTestZone(2026, 4, 1, 0, 0)}},
+		{"last march", timeWindow{inTestZone(2025, 3, 1, 0, 0), inTestZone(2025, 4, 1, 0, 0)}},
+		{"december", timeWindow{inTestZone(2025, 12, 1, 0, 0), inTestZone(2026, 1, 1, 0, 0)}},
+		{"jan 2026", timeWindow{inTestZone(2026, 1, 1, 0, 0), inTestZone(2026, 2, 1, 0, 0)}},
+
+		// Times on a day
+		{"3pm", at(inTestZone(2026, 3, 4, 15, 0))},
+		{"14:00", at(inTestZone(2026, 3, 4, 14, 0))},
+		{"at 12am", at(inTestZone(2026, 3, 4, 0, 0))},
+		{"12pm", at(inTestZone(2026, 3, 4, 12, 0))},
+		{"yesterday 3pm", at(inTestZone(2026, 3, 3, 15, 0))},
+		{"monday at 9:30", at(inTestZone(2026, 3, 2, 9, 30))},
+		{"march 3 9am", at(inTestZone(2026, 3, 3, 9, 0))},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeExpression(tt.value, now)
+		if err != nil {
+			t.Errorf("parseTimeExpression(%q): %v", tt.value, err)
+			continue
+		}
+		if !got.Start.Equal(tt.want.Start) || !got.End.Equal(tt.want.End) {
+			t.Errorf("parseTimeExpression(%q) = %v to %v, want %v to %v", tt.value, got.Start, got.End, tt.want.Start, tt.want.End)
+		}
+		if got.Start.Location() != testZone || got.End.Location() != testZone {
+			t.Errorf("parseTimeExpression(%q) is in %v, want the timezone of now", tt.value, got.Start.Location())
+		}
+	}
+}
+
+func TestParseTimeExpressionErrors(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"someday",
+		"13pm",
+		"0am",
+		"25:00",
+		"10:75",
+		"this week 3pm", // a time needs a single day
+		"3 fortnights ago",
+		"2026-13-01",
+	} {
+		if got, err := parseTimeExpression(value, testNow); err == nil {
+			t.Errorf("parseTimeExpression(%q) = %v to %v, want an error", value, got.Start, got.End)
+		}
+	}
+}
+
+func TestParseDateFilter(t *testing.T) {
+	tests := []struct {
+		operator, value string
+		after, before   *time.Time
+		wantErr         bool
+	}{
+		{"after", "yesterday", timePtr(time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)), nil, false},
+		{"before", "yesterday", nil, timePtr(time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)), false},
+		{"during", "yesterday", timePtr(time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)), timePtr(time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC)), false},
+		{"after", "2 hours ago", timePtr(testNow.Add(-2 * time.Hour)), nil, false},
+		{"during", "2 hours ago", nil, nil, true},
+		{"during", "whenever", nil, nil, true},
+	}
+	for _, tt := range tests {
+		after, before, note, err := parseDateFilter(tt.operator, tt.value, testNow)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseDateFilter(%s, %q) = %v, %v, want an error", tt.operator, tt.value, after, before)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDateFilter(%s, %q): %v", tt.operator, tt.value, err)
+			continue
+		}
+		if !equalTimes(after, tt.after) || !equalTimes(before, tt.before) {
+			t.Errorf("parseDateFilter(%s, %q) = %v, %v, want %v, %v", tt.operator, tt.value, after, before, tt.after, tt.before)
+		}
+		if note == "" {
+			t.Errorf("parseDateFilter(%s, %q) didn't say how it read the date", tt.operator, tt.value)
+		}
+	}
+}
@@ -28,11 +28,11 @@ func runExample() {
 	fmt.Println("\n2. Getting last interaction with a specific contact:")
 	// Replace with an actual JID from your WhatsApp (e.g., "1234567890@s.whatsapp.net")
 	contactJID := "REPLACE_WITH_ACTUAL_JID@s.whatsapp.net"
-	lastInteraction, err := getLastInteraction(contactJID)
+	lastInteraction, err := getLastInteraction(contactJID, nil)
 	if err != nil {
 		log.Printf("Error getting last interaction: %v", err)
-	} else if lastInteraction != "" {
-		fmt.Printf("Last interaction: %s", lastInteraction)
+	} else if lastInteraction != nil {
+		fmt.Printf("Last interaction: %s", transcriptOf([]MessageContext{{Message: *lastInteraction}}))
 	} else {
 		fmt.Println("No interactions found with this contact")
 	}
@@ -59,27 +59,37 @@ func runExample() {
 // getLastMessageFromAnyChat gets the most recent message from any chat
 func getLastMessageFromAnyChat() (string, error) {
 	// Use the listMessages function with limit 1 to get the most recent message
-	messages, err := listMessages(nil, nil, nil, nil, nil, 1, 0, false, 0, 0)
+	groups, _, err := listMessages(&searchQuery{}, 1, 0, nil, false, 0, 0)
 	if err != nil {
 		return "", err
 	}
 
-	return messages, nil
+	return transcriptOf(groups), nil
 }
 
 // getRecentMessages gets the last N messages from all chats
 func getRecentMessages(limit int) (string, error) {
-	messages, err := listMessages(nil, nil, nil, nil, nil, limit, 0, true, 2, 2)
+	groups, _, err := listMessages(&searchQuery{}, limit, 0, nil, true, 2, 2)
 	if err != nil {
 		return "", err
 	}
 
-	return messages, nil
+	return transcriptOf(groups), nil
+}
+
+// transcriptOf formats messages and their context like the list_messages tool's text output
+func transcriptOf(groups []MessageContext) string {
+	display, _ := newTimeDisplay("")
+	result, err := buildMessagesResult(groups, display)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return formatMessagesText(result, display, renderOptions{transcript: true, showChatInfo: true})
 }
 
 // getActiveChattsWithLastMessages gets the most active chats with their last messages
 func getActiveChattsWithLastMessages(limit int) ([]Chat, error) {
-	chats, err := listChats(nil, limit, 0, true, "last_active")
+	chats, _, err := listChats(nil, limit, 0, nil, true, "last_active", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -249,12 +259,12 @@ func simulateListMessagesTool(request *MockCallToolRequest) string {
 	contextBefore := int(request.GetFloat("context_before", 1))
 	contextAfter := int(request.GetFloat("context_after", 1))
 
-	messages, err := listMessages(nil, nil, nil, nil, nil, limit, page, includeContext, contextBefore, contextAfter)
+	groups, _, err := listMessages(&searchQuery{}, limit, page, nil, includeContext, contextBefore, contextAfter)
 	if err != nil {
 		return fmt.Sprintf("Error: %v", err)
 	}
 
-	return messages
+	return transcriptOf(groups)
 }
 
 // Usage instructions
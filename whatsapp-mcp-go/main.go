@@ -4,11 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
@@ -49,6 +53,7 @@ type Chat struct {
 	LastMessage     *string    `json:"last_message,omitempty"`
 	LastSender      *string    `json:"last_sender,omitempty"`
 	LastIsFromMe    *bool      `json:"last_is_from_me,omitempty"`
+	LastMessageAgo  string     `json:"last_message_ago,omitempty"`
 }
 
 func (c *Chat) IsGroup() bool {
@@ -84,6 +89,47 @@ func openDB() (*sql.DB, error) {
 	return db, nil
 }
 
+// Range of messages.db schema versions (see whatsapp-bridge/migrations.go) this server can read
+const (
+	minSchemaVersion = 10
+	maxSchemaVersion = 10
+)
+
+// checkSchemaVersion makes sure the bridge database uses a schema this server understands
+func checkSchemaVersion() error {
+	absPath, err := filepath.Abs(getMessagesDBPath())
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %v", err)
+	}
+	if _, err := os.Stat(absPath); os.IsNotExist(err) {
+		// Nothing to check until the bridge has created the database
+		log.Printf("Message database %s does not exist yet, start the WhatsApp bridge first", absPath)
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+absPath+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		version = 0
+	} else if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	if version < minSchemaVersion {
+		return fmt.Errorf("message database schema version %d is too old (need %d to %d), start the latest WhatsApp bridge once to upgrade it", version, minSchemaVersion, maxSchemaVersion)
+	}
+	if version > maxSchemaVersion {
+		return fmt.Errorf("message database schema version %d is newer than this server supports (%d to %d), please update the MCP server", version, minSchemaVersion, maxSchemaVersion)
+	}
+	return nil
+}
+
 func getSenderName(senderJID string) string {
 	db, err := openDB()
 	if err != nil {
@@ -115,41 +161,6 @@ func getSenderName(senderJID string) string {
 	return senderJID
 }
 
-func formatMessage(message Message, showChatInfo bool) string {
-	output := ""
-
-	if showChatInfo && message.ChatName != nil {
-		output += fmt.Sprintf("[%s] Chat: %s ", message.Timestamp.Format("2006-01-02 15:04:05"), *message.ChatName)
-	} else {
-		output += fmt.Sprintf("[%s] ", message.Timestamp.Format("2006-01-02 15:04:05"))
-	}
-
-	contentPrefix := ""
-	if message.MediaType != nil && *message.MediaType != "" {
-		contentPrefix = fmt.Sprintf("[%s - Message ID: %s - Chat JID: %s] ", *message.MediaType, message.ID, message.ChatJID)
-	}
-
-	senderName := "Me"
-	if !message.IsFromMe {
-		senderName = getSenderName(message.Sender)
-	}
-
-	output += fmt.Sprintf("From: %s: %s%s\n", senderName, contentPrefix, message.Content)
-	return output
-}
-
-func formatMessagesList(messages []Message, showChatInfo bool) string {
-	output := ""
-	if len(messages) == 0 {
-		return "No messages to display."
-	}
-
-	for _, message := range messages {
-		output += formatMessage(message, showChatInfo)
-	}
-	return output
-}
-
 // Tool implementations
 func searchContacts(query string) ([]Contact, error) {
 	db, err := openDB()
@@ -195,70 +206,59 @@ func searchContacts(query string) ([]Contact, error) {
 	return contacts, nil
 }
 
-func listMessages(after, before, senderPhoneNumber, chatJID, query *string, limit, page int, includeContext bool, contextBefore, contextAfter int) (string, error) {
+// listMessages returns a page of the messages matching a query, newest first, each with the
+// messages around it if includeContext is set. The page starts at cursor, or at the
+// deprecated page number if there is none.
+func listMessages(query *searchQuery, limit, page int, cursor *pageCursor, includeContext bool, contextBefore, contextAfter int) ([]MessageContext, pageLinks, error) {
 	db, err := openDB()
 	if err != nil {
-		return "", err
+		return nil, pageLinks{}, err
 	}
 	defer db.Close()
 
-	// Build base query
-	queryParts := []string{
-		"SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type",
-		"FROM messages",
-		"JOIN chats ON messages.chat_jid = chats.jid",
+	filter, err := resolveMessageFilter(db, query)
+	if err != nil {
+		return nil, pageLinks{}, err
 	}
 
-	var whereClauses []string
-	var params []interface{}
-
-	// Add filters
-	if after != nil {
-		afterTime, err := time.Parse(time.RFC3339, *after)
-		if err != nil {
-			return "", fmt.Errorf("invalid date format for 'after': %s. Please use ISO-8601 format", *after)
-		}
-		whereClauses = append(whereClauses, "messages.timestamp > ?")
-		params = append(params, afterTime)
+	var keys []interface{}
+	if cursor != nil {
+		keys = []interface{}{cursorTime(cursor.Time), cursor.ChatJID, cursor.ID}
 	}
+	keyset, orderLimit, pageParams := keysetQuery([]string{"messages.timestamp", "messages.chat_jid", "messages.id"}, true, cursor, keys, limit, page)
 
-	if before != nil {
-		beforeTime, err := time.Parse(time.RFC3339, *before)
-		if err != nil {
-			return "", fmt.Errorf("invalid date format for 'before': %s. Please use ISO-8601 format", *before)
+	// Build base query
+	buildQuery := func(useFTS bool) (string, []interface{}) {
+		queryParts := []string{
+			"SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type",
+			"FROM messages",
+			"JOIN chats ON messages.chat_jid = chats.jid",
 		}
-		whereClauses = append(whereClauses, "messages.timestamp < ?")
-		params = append(params, beforeTime)
-	}
 
-	if senderPhoneNumber != nil {
-		whereClauses = append(whereClauses, "messages.sender = ?")
-		params = append(params, *senderPhoneNumber)
-	}
+		whereClauses, params := filter.whereClauses(useFTS)
+		if keyset != "" {
+			whereClauses = append(whereClauses, keyset)
+		}
+		if len(whereClauses) > 0 {
+			queryParts = append(queryParts, "WHERE "+strings.Join(whereClauses, " AND "))
+		}
 
-	if chatJID != nil {
-		whereClauses = append(whereClauses, "messages.chat_jid = ?")
-		params = append(params, *chatJID)
-	}
+		// Add pagination
+		queryParts = append(queryParts, orderLimit)
+		params = append(params, pageParams...)
 
-	if query != nil {
-		whereClauses = append(whereClauses, "LOWER(messages.content) LIKE LOWER(?)")
-		params = append(params, "%"+*query+"%")
+		return strings.Join(queryParts, " "), params
 	}
 
-	if len(whereClauses) > 0 {
-		queryParts = append(queryParts, "WHERE "+strings.Join(whereClauses, " AND "))
+	sqlQuery, params := buildQuery(filter.usesFTS())
+	rows, err := db.Query(sqlQuery, params...)
+	if err != nil && filter.usesFTS() && isFTSUnavailableError(err) {
+		// Without the full-text index, match words as substrings
+		sqlQuery, params = buildQuery(false)
+		rows, err = db.Query(sqlQuery, params...)
 	}
-
-	// Add pagination
-	offset := page * limit
-	queryParts = append(queryParts, "ORDER BY messages.timestamp DESC")
-	queryParts = append(queryParts, "LIMIT ? OFFSET ?")
-	params = append(params, limit, offset)
-
-	rows, err := db.Query(strings.Join(queryParts, " "), params...)
 	if err != nil {
-		return "", err
+		return nil, pageLinks{}, err
 	}
 	defer rows.Close()
 
@@ -270,12 +270,12 @@ func listMessages(after, before, senderPhoneNumber, chatJID, query *string, limi
 
 		err := rows.Scan(&timestampStr, &msg.Sender, &chatName, &msg.Content, &msg.IsFromMe, &msg.ChatJID, &msg.ID, &mediaType)
 		if err != nil {
-			return "", err
+			return nil, pageLinks{}, err
 		}
 
 		msg.Timestamp, err = time.Parse(time.RFC3339, timestampStr)
 		if err != nil {
-			return "", err
+			return nil, pageLinks{}, err
 		}
 
 		if chatName.Valid {
@@ -288,25 +288,31 @@ func listMessages(after, before, senderPhoneNumber, chatJID, query *string, limi
 		messages = append(messages, msg)
 	}
 
-	if includeContext && len(messages) > 0 {
-		// Add context for each message
-		var messagesWithContext []Message
-		for _, msg := range messages {
-			context, err := getMessageContext(msg.ID, contextBefore, contextAfter)
+	messages, links := paginate(messages, limit, cursor, func(msg Message) pageCursor {
+		return pageCursor{List: cursorMessages, Time: &msg.Timestamp, ChatJID: msg.ChatJID, ID: msg.ID}
+	})
+
+	groups := make([]MessageContext, 0, len(messages))
+	for _, msg := range messages {
+		if includeContext {
+			// Add context for each message
+			context, err := getMessageContext(msg.ChatJID, msg.ID, contextBefore, contextAfter, nil)
 			if err != nil {
 				continue
 			}
-			messagesWithContext = append(messagesWithContext, context.Before...)
-			messagesWithContext = append(messagesWithContext, context.Message)
-			messagesWithContext = append(messagesWithContext, context.After...)
+			groups = append(groups, *context)
+		} else {
+			groups = append(groups, MessageContext{Message: msg})
 		}
-		return formatMessagesList(messagesWithContext, true), nil
 	}
-
-	return formatMessagesList(messages, true), nil
+	return groups, links, nil
 }
 
-func getMessageContext(messageID string, before, after int) (*MessageContext, error) {
+// getMessageContext returns a message with the messages before and after it in the same
+// chat, both oldest first. Message IDs are only unique within a chat, so without a chat JID
+// the most recent message with the ID is used. A non-empty within only looks in those chat
+// JIDs, so messages elsewhere are not found.
+func getMessageContext(chatJID, messageID string, before, after int, within []string) (*MessageContext, error) {
 	db, err := openDB()
 	if err != nil {
 		return nil, err
@@ -318,12 +324,22 @@ func getMessageContext(messageID string, before, after int) (*MessageContext, er
 	var timestampStr, chatJIDStr string
 	var chatName, mediaType sql.NullString
 
+	params := []interface{}{messageID, chatJID, chatJID}
+	var conditions string
+	if len(within) > 0 {
+		clause, jids := chatsIn("messages.chat_jid", within)
+		conditions = " AND " + clause
+		params = append(params, jids...)
+	}
+
 	err = db.QueryRow(`
 		SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.chat_jid, messages.media_type
 		FROM messages
 		JOIN chats ON messages.chat_jid = chats.jid
-		WHERE messages.id = ?
-	`, messageID).Scan(&timestampStr, &msg.Sender, &chatName, &msg.Content, &msg.IsFromMe, &msg.ChatJID, &msg.ID, &chatJIDStr, &mediaType)
+		WHERE messages.id = ? AND (? = '' OR messages.chat_jid = ?)`+conditions+`
+		ORDER BY messages.timestamp DESC
+		LIMIT 1
+	`, params...).Scan(&timestampStr, &msg.Sender, &chatName, &msg.Content, &msg.IsFromMe, &msg.ChatJID, &msg.ID, &chatJIDStr, &mediaType)
 
 	if err != nil {
 		return nil, fmt.Errorf("message with ID %s not found", messageID)
@@ -349,7 +365,7 @@ func getMessageContext(messageID string, before, after int) (*MessageContext, er
 		WHERE messages.chat_jid = ? AND messages.timestamp < ?
 		ORDER BY messages.timestamp DESC
 		LIMIT ?
-	`, chatJIDStr, timestampStr, before)
+	`, chatJIDStr, msg.Timestamp.UTC(), before)
 	if err != nil {
 		return nil, err
 	}
@@ -380,6 +396,10 @@ func getMessageContext(messageID string, before, after int) (*MessageContext, er
 
 		beforeMessages = append(beforeMessages, beforeMsg)
 	}
+	// The query finds the closest messages first, context reads oldest first
+	for i, j := 0, len(beforeMessages)-1; i < j; i, j = i+1, j-1 {
+		beforeMessages[i], beforeMessages[j] = beforeMessages[j], beforeMessages[i]
+	}
 
 	// Get messages after
 	afterRows, err := db.Query(`
@@ -389,7 +409,7 @@ func getMessageContext(messageID string, before, after int) (*MessageContext, er
 		WHERE messages.chat_jid = ? AND messages.timestamp > ?
 		ORDER BY messages.timestamp ASC
 		LIMIT ?
-	`, chatJIDStr, timestampStr, after)
+	`, chatJIDStr, msg.Timestamp.UTC(), after)
 	if err != nil {
 		return nil, err
 	}
@@ -428,10 +448,13 @@ func getMessageContext(messageID string, before, after int) (*MessageContext, er
 	}, nil
 }
 
-func listChats(query *string, limit, page int, includeLastMessage bool, sortBy string) ([]Chat, error) {
+// listChats returns a page of chats, most recently active first or by name. The page starts
+// at cursor, or at the deprecated page number if there is none. A non-empty within limits
+// the list to those chat JIDs.
+func listChats(query *string, limit, page int, cursor *pageCursor, includeLastMessage bool, sortBy string, within []string) ([]Chat, pageLinks, error) {
 	db, err := openDB()
 	if err != nil {
-		return nil, err
+		return nil, pageLinks{}, err
 	}
 	defer db.Close()
 
@@ -451,6 +474,9 @@ func listChats(query *string, limit, page int, includeLastMessage bool, sortBy s
 			LEFT JOIN messages ON chats.jid = messages.chat_jid 
 			AND chats.last_message_time = messages.timestamp
 		`)
+	} else {
+		// The last message columns stay NULL
+		queryParts = append(queryParts, "LEFT JOIN messages ON 0")
 	}
 
 	var whereClauses []string
@@ -460,26 +486,42 @@ func listChats(query *string, limit, page int, includeLastMessage bool, sortBy s
 		whereClauses = append(whereClauses, "(LOWER(chats.name) LIKE LOWER(?) OR chats.jid LIKE ?)")
 		params = append(params, "%"+*query+"%", "%"+*query+"%")
 	}
-
-	if len(whereClauses) > 0 {
-		queryParts = append(queryParts, "WHERE "+strings.Join(whereClauses, " AND "))
+	if len(within) > 0 {
+		clause, jids := chatsIn("chats.jid", within)
+		whereClauses = append(whereClauses, clause)
+		params = append(params, jids...)
 	}
 
-	// Add sorting
-	orderBy := "chats.last_message_time DESC"
-	if sortBy == "name" {
-		orderBy = "chats.name"
+	// Add sorting and pagination. The JID breaks ties so every chat has its own position.
+	list := chatsCursorList(sortBy)
+	columns := []string{"COALESCE(chats.last_message_time, '')", "chats.jid"}
+	descending := true
+	if list == cursorChatsName {
+		columns = []string{"COALESCE(chats.name, '')", "chats.jid"}
+		descending = false
+	}
+	var keys []interface{}
+	if cursor != nil {
+		if list == cursorChatsName {
+			keys = []interface{}{cursor.Name, cursor.ChatJID}
+		} else {
+			keys = []interface{}{cursorTime(cursor.Time), cursor.ChatJID}
+		}
+	}
+	keyset, orderLimit, pageParams := keysetQuery(columns, descending, cursor, keys, limit, page)
+	if keyset != "" {
+		whereClauses = append(whereClauses, keyset)
 	}
-	queryParts = append(queryParts, "ORDER BY "+orderBy)
 
-	// Add pagination
-	offset := page * limit
-	queryParts = append(queryParts, "LIMIT ? OFFSET ?")
-	params = append(params, limit, offset)
+	if len(whereClauses) > 0 {
+		queryParts = append(queryParts, "WHERE "+strings.Join(whereClauses, " AND "))
+	}
+	queryParts = append(queryParts, orderLimit)
+	params = append(params, pageParams...)
 
 	rows, err := db.Query(strings.Join(queryParts, " "), params...)
 	if err != nil {
-		return nil, err
+		return nil, pageLinks{}, err
 	}
 	defer rows.Close()
 
@@ -491,7 +533,7 @@ func listChats(query *string, limit, page int, includeLastMessage bool, sortBy s
 
 		err := rows.Scan(&chat.JID, &name, &lastMessageTimeStr, &lastMessage, &lastSender, &lastIsFromMe)
 		if err != nil {
-			return nil, err
+			return nil, pageLinks{}, err
 		}
 
 		if name.Valid {
@@ -515,7 +557,10 @@ func listChats(query *string, limit, page int, includeLastMessage bool, sortBy s
 		chats = append(chats, chat)
 	}
 
-	return chats, nil
+	chats, links := paginate(chats, limit, cursor, func(chat Chat) pageCursor {
+		return chatCursor(list, chat)
+	})
+	return chats, links, nil
 }
 
 func getChat(chatJID string, includeLastMessage bool) (*Chat, error) {
@@ -541,6 +586,9 @@ func getChat(chatJID string, includeLastMessage bool) (*Chat, error) {
 			LEFT JOIN messages m ON c.jid = m.chat_jid 
 			AND c.last_message_time = m.timestamp
 		`
+	} else {
+		// The last message columns stay NULL
+		query += " LEFT JOIN messages m ON 0"
 	}
 
 	query += " WHERE c.jid = ?"
@@ -632,15 +680,34 @@ func getDirectChatByContact(senderPhoneNumber string) (*Chat, error) {
 	return &chat, nil
 }
 
-func getContactChats(jid string, limit, page int) ([]Chat, error) {
+// getContactChats returns a page of the chats a contact has written in, most recently active
+// first, with each chat's last message. The page starts at cursor, or at the deprecated page
+// number if there is none. A non-empty within limits the list to those chat JIDs.
+func getContactChats(jid string, limit, page int, cursor *pageCursor, within []string) ([]Chat, pageLinks, error) {
 	db, err := openDB()
 	if err != nil {
-		return nil, err
+		return nil, pageLinks{}, err
 	}
 	defer db.Close()
 
+	var keys []interface{}
+	if cursor != nil {
+		keys = []interface{}{cursorTime(cursor.Time), cursor.ChatJID}
+	}
+	params := []interface{}{jid, jid}
+	var conditions string
+	if len(within) > 0 {
+		clause, jids := chatsIn("c.jid", within)
+		conditions += " AND " + clause
+		params = append(params, jids...)
+	}
+	keyset, orderLimit, pageParams := keysetQuery([]string{"COALESCE(c.last_message_time, '')", "c.jid"}, true, cursor, keys, limit, page)
+	if keyset != "" {
+		conditions += " AND " + keyset
+	}
+	params = append(params, pageParams...)
 	rows, err := db.Query(`
-		SELECT DISTINCT
+		SELECT
 			c.jid,
 			c.name,
 			c.last_message_time,
@@ -648,13 +715,13 @@ func getContactChats(jid string, limit, page int) ([]Chat, error) {
 			m.sender as last_sender,
 			m.is_from_me as last_is_from_me
 		FROM chats c
-		JOIN messages m ON c.jid = m.chat_jid
-		WHERE m.sender = ? OR c.jid = ?
-		ORDER BY c.last_message_time DESC
-		LIMIT ? OFFSET ?
-	`, jid, jid, limit, page*limit)
+		LEFT JOIN messages m ON c.jid = m.chat_jid
+			AND c.last_message_time = m.timestamp
+		WHERE (c.jid = ? OR EXISTS (SELECT 1 FROM messages s WHERE s.chat_jid = c.jid AND s.sender = ?))
+		`+conditions+`
+		`+orderLimit, params...)
 	if err != nil {
-		return nil, err
+		return nil, pageLinks{}, err
 	}
 	defer rows.Close()
 
@@ -666,7 +733,7 @@ func getContactChats(jid string, limit, page int) ([]Chat, error) {
 
 		err := rows.Scan(&chat.JID, &name, &lastMessageTimeStr, &lastMessage, &lastSender, &lastIsFromMe)
 		if err != nil {
-			return nil, err
+			return nil, pageLinks{}, err
 		}
 
 		if name.Valid {
@@ -690,13 +757,18 @@ func getContactChats(jid string, limit, page int) ([]Chat, error) {
 		chats = append(chats, chat)
 	}
 
-	return chats, nil
+	chats, links := paginate(chats, limit, cursor, func(chat Chat) pageCursor {
+		return chatCursor(cursorContactChats, chat)
+	})
+	return chats, links, nil
 }
 
-func getLastInteraction(jid string) (string, error) {
+// getLastInteraction returns the most recent message involving a contact, or nil if there is
+// none. A non-empty within only looks at those chat JIDs.
+func getLastInteraction(jid string, within []string) (*Message, error) {
 	db, err := openDB()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer db.Close()
 
@@ -704,6 +776,14 @@ func getLastInteraction(jid string) (string, error) {
 	var timestampStr string
 	var chatName, mediaType sql.NullString
 
+	params := []interface{}{jid, jid}
+	var conditions string
+	if len(within) > 0 {
+		clause, jids := chatsIn("c.jid", within)
+		conditions = " AND " + clause
+		params = append(params, jids...)
+	}
+
 	err = db.QueryRow(`
 		SELECT 
 			m.timestamp,
@@ -716,21 +796,21 @@ func getLastInteraction(jid string) (string, error) {
 			m.media_type
 		FROM messages m
 		JOIN chats c ON m.chat_jid = c.jid
-		WHERE m.sender = ? OR c.jid = ?
+		WHERE (m.sender = ? OR c.jid = ?)`+conditions+`
 		ORDER BY m.timestamp DESC
 		LIMIT 1
-	`, jid, jid).Scan(&timestampStr, &msg.Sender, &chatName, &msg.Content, &msg.IsFromMe, &msg.ChatJID, &msg.ID, &mediaType)
+	`, params...).Scan(&timestampStr, &msg.Sender, &chatName, &msg.Content, &msg.IsFromMe, &msg.ChatJID, &msg.ID, &mediaType)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", nil
+			return nil, nil
 		}
-		return "", err
+		return nil, err
 	}
 
 	msg.Timestamp, err = time.Parse(time.RFC3339, timestampStr)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if chatName.Valid {
@@ -740,15 +820,93 @@ func getLastInteraction(jid string) (string, error) {
 		msg.MediaType = &mediaType.String
 	}
 
-	return formatMessage(msg, false), nil
+	return &msg, nil
+}
+
+// getMessage returns a message by chat and ID, or nil if there is none
+func getMessage(chatJID, messageID string) (*Message, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	messages, err := querySearchResults(db, `
+		SELECT messages.timestamp, messages.sender, chats.name, messages.content, messages.is_from_me, chats.jid, messages.id, messages.media_type
+		FROM messages
+		JOIN chats ON messages.chat_jid = chats.jid
+		WHERE messages.chat_jid = ? AND messages.id = ?
+	`, chatJID, messageID)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// sendProgress reports progress of a long running tool call if the client asked for it
+func sendProgress(ctx context.Context, request mcp.CallToolRequest, progress, total float64, message string) {
+	if request.Params.Meta == nil || request.Params.Meta.ProgressToken == nil {
+		return
+	}
+
+	srv := server.ServerFromContext(ctx)
+	if srv == nil {
+		return
+	}
+
+	params := map[string]any{
+		"progressToken": request.Params.Meta.ProgressToken,
+		"progress":      progress,
+	}
+	if total > 0 {
+		params["total"] = total
+	}
+	if message != "" {
+		params["message"] = message
+	}
+
+	if err := srv.SendNotificationToClient(ctx, "notifications/progress", params); err != nil {
+		log.Printf("Failed to send progress notification: %v", err)
+	}
 }
 
 func main() {
+	transport := flag.String("transport", transportStdio, "How clients connect: stdio, sse or http")
+	addr := flag.String("addr", defaultListenAddr, "Address to listen on with the sse and http transports")
+	authPath := flag.String("auth", "", "Config file with the tokens clients of the sse and http transports must send")
+	flag.Parse()
+
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := checkSchemaVersion(); err != nil {
+		log.Fatalf("Incompatible database: %v", err)
+	}
+	var auth *authenticator
+	if *authPath != "" {
+		var err error
+		if auth, err = loadAuth(*authPath); err != nil {
+			log.Fatalf("Invalid auth config %s: %v", *authPath, err)
+		}
+	}
+
 	// Create MCP server
+	hooks := &server.Hooks{}
+	hooks.AddAfterListResources(hideResources)
 	s := server.NewMCPServer(
 		"whatsapp",
 		"1.0.0",
 		server.WithToolCapabilities(true),
+		server.WithResourceCapabilities(true, true),
+		server.WithPromptCapabilities(false),
+		server.WithCompletions(),
+		server.WithPromptCompletionProvider(chatCompletions{}),
+		server.WithResourceCompletionProvider(chatCompletions{}),
+		server.WithHooks(hooks),
+		server.WithToolHandlerMiddleware(authorizeTool),
+		server.WithToolFilter(accessibleTools),
+		server.WithResourceHandlerMiddleware(authorizeResource),
+		server.WithPromptHandlerMiddleware(authorizePrompt),
 	)
 
 	// Register search_contacts tool
@@ -769,6 +927,15 @@ func main() {
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
 		}
+		if c := clientFromContext(ctx); c.limited() {
+			var accessible []Contact
+			for _, contact := range contacts {
+				if c.canAccess(contact.JID) {
+					accessible = append(accessible, contact)
+				}
+			}
+			contacts = accessible
+		}
 
 		content, err := json.Marshal(contacts)
 		if err != nil {
@@ -780,48 +947,225 @@ func main() {
 
 	// Register list_messages tool
 	listMessagesTool := mcp.NewTool("list_messages",
-		mcp.WithDescription("Get WhatsApp messages matching specified criteria with optional context."),
-		mcp.WithString("after", mcp.Description("Optional ISO-8601 formatted string to only return messages after this date")),
-		mcp.WithString("before", mcp.Description("Optional ISO-8601 formatted string to only return messages before this date")),
-		mcp.WithString("sender_phone_number", mcp.Description("Optional phone number to filter messages by sender")),
-		mcp.WithString("chat_jid", mcp.Description("Optional chat JID to filter messages by chat")),
-		mcp.WithString("query", mcp.Description("Optional search term to filter messages by content")),
+		mcp.WithDescription("Get WhatsApp messages matching specified criteria with optional context, newest first."),
+		mcp.WithString("q", mcp.Description("Optional search query, e.g. from:alice in:\"Project X\" has:image after:yesterday during:\"last week\" is:reply \"exact phrase\" -excluded. Syntax: "+searchQuerySyntax)),
+		mcp.WithString("after", mcp.Description("Deprecated, use after: in q. Optional date or time to only return messages on or after, in the same formats as q")),
+		mcp.WithString("before", mcp.Description("Deprecated, use before: in q. Optional date or time to only return messages before, in the same formats as q")),
+		mcp.WithString("sender_phone_number", mcp.Description("Deprecated, use from: in q. Optional phone number to filter messages by sender")),
+		mcp.WithString("chat_jid", mcp.Description("Deprecated, use in: in q. Optional chat JID to filter messages by chat")),
+		mcp.WithString("query", mcp.Description("Deprecated, use q. Optional search term to filter messages by content")),
 		mcp.WithNumber("limit", mcp.Description("Maximum number of messages to return (default 20)")),
-		mcp.WithNumber("page", mcp.Description("Page number for pagination (default 0)")),
+		cursorParam,
+		mcp.WithNumber("page", mcp.Description("Deprecated, use cursor. Page number for pagination (default 0)")),
 		mcp.WithBoolean("include_context", mcp.Description("Whether to include messages before and after matches (default true)")),
 		mcp.WithNumber("context_before", mcp.Description("Number of messages to include before each match (default 1)")),
 		mcp.WithNumber("context_after", mcp.Description("Number of messages to include after each match (default 1)")),
+		timezoneParam,
+		outputFormatParam(formatText),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
 	)
 	s.AddTool(listMessagesTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		var after, before, senderPhoneNumber, chatJID, query *string
 		limit := int(request.GetFloat("limit", 20))
 		page := int(request.GetFloat("page", 0))
 		includeContext := request.GetBool("include_context", true)
 		contextBefore := int(request.GetFloat("context_before", 1))
 		contextAfter := int(request.GetFloat("context_after", 1))
 
-		if val := request.GetString("after", ""); val != "" {
-			after = &val
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatText)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		now := display.now
+		query, err := parseSearchQuery(request.GetString("q", ""), now)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Invalid query: %v. Syntax: %s", err, searchQuerySyntax)), nil
+		}
+
+		// The separate filter parameters predate q and are kept as aliases
+		for _, name := range []string{"after", "before"} {
+			if val := request.GetString(name, ""); val != "" {
+				if err := query.addDateFilter(name, val, now); err != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("Error: invalid '%s': %v", name, err)), nil
+				}
+			}
 		}
-		if val := request.GetString("before", ""); val != "" {
-			before = &val
+		if err := query.checkDates(); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 		if val := request.GetString("sender_phone_number", ""); val != "" {
-			senderPhoneNumber = &val
+			query.From = append(query.From, val)
 		}
 		if val := request.GetString("chat_jid", ""); val != "" {
-			chatJID = &val
+			query.In = append(query.In, val)
 		}
 		if val := request.GetString("query", ""); val != "" {
-			query = &val
+			query.Contains = append(query.Contains, val)
+		}
+		query.Within = clientFromContext(ctx).allowedChats()
+		cursor, err := decodeCursor(request.GetString("cursor", ""), cursorMessages)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		groups, links, err := listMessages(query, limit, page, cursor, includeContext, contextBefore, contextAfter)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		// Show how the dates were read so a misread date is easy to spot
+		result, err := renderMessages(groups, format, display, renderOptions{
+			transcript: true, showChatInfo: true, dates: query.Dates, links: links, budget: budget,
+			continueAt: func(shown int, last matchOutput) string {
+				return encodeCursor(pageCursor{List: cursorMessages, Time: &last.Timestamp, ChatJID: last.ChatJID, ID: last.ID})
+			},
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		return result, nil
+	})
+
+	// Register search_messages tool
+	searchMessagesTool := mcp.NewTool("search_messages",
+		mcp.WithDescription("Full-text search over WhatsApp message text, media captions and document names, ranked by relevance with the matching words highlighted. Matching ignores case and accents."),
+		mcp.WithString("query",
+			mcp.Required(),
+			mcp.Description("Search query. Words must all match; use \"exact phrase\", prefix* matching, OR, NOT and parentheses for more control, e.g. \"team dinner\" OR lunch NOT cancel*"),
+		),
+		mcp.WithString("chat_jid", mcp.Description("Optional chat JID to only search one chat")),
+		mcp.WithNumber("limit", mcp.Description("Maximum number of messages to return (default 20)")),
+		cursorParam,
+		mcp.WithNumber("page", mcp.Description("Deprecated, use cursor. Page number for pagination (default 0)")),
+		timezoneParam,
+		outputFormatParam(formatText),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
+	)
+	s.AddTool(searchMessagesTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		query := request.GetString("query", "")
+		if query == "" {
+			return mcp.NewToolResultError("query parameter is required"), nil
+		}
+		limit := int(request.GetFloat("limit", 20))
+		page := int(request.GetFloat("page", 0))
+
+		var chatJID *string
+		if val := labelJID(request.GetString("chat_jid", "")); val != "" {
+			chatJID = &val
+		}
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatText)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		messages, err := listMessages(after, before, senderPhoneNumber, chatJID, query, limit, page, includeContext, contextBefore, contextAfter)
+		offset := page * limit
+		cursor, err := decodeCursor(request.GetString("cursor", ""), cursorSearch)
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
+		if cursor != nil {
+			offset = cursor.Offset
+		}
 
-		return mcp.NewToolResultText(messages), nil
+		messages, notes, err := searchMessages(query, chatJID, limit, offset)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		result, err := renderMessages(matchesOnly(messages), format, display, renderOptions{
+			showChatInfo: true, notes: notes, links: offsetLinks(cursorSearch, offset, limit, len(messages)), budget: budget,
+			continueAt: func(shown int, last matchOutput) string {
+				return encodeCursor(pageCursor{List: cursorSearch, Offset: offset + shown})
+			},
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		return result, nil
+	})
+
+	// Register semantic_search tool
+	semanticSearchTool := mcp.NewTool("semantic_search",
+		mcp.WithDescription("Search WhatsApp messages by meaning, e.g. \"did anyone mention the delivery delay\" also finds \"shipment is late\". Combines the bridge's local embedding index with keyword matches; falls back to keyword matches if the bridge has no embeddings backend configured."),
+		mcp.WithString("query",
+			mcp.Required(),
+			mcp.Description("What to look for, in natural language"),
+		),
+		mcp.WithString("chat_jid", mcp.Description("Optional chat JID to only search one chat")),
+		mcp.WithNumber("limit", mcp.Description("Maximum number of messages to return (default 20)")),
+		cursorParam,
+		mcp.WithNumber("page", mcp.Description("Deprecated, use cursor. Page number for pagination (default 0)")),
+		timezoneParam,
+		outputFormatParam(formatText),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
+	)
+	s.AddTool(semanticSearchTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		query := request.GetString("query", "")
+		if query == "" {
+			return mcp.NewToolResultError("query parameter is required"), nil
+		}
+		limit := int(request.GetFloat("limit", 20))
+		page := int(request.GetFloat("page", 0))
+
+		var chatJID *string
+		if val := labelJID(request.GetString("chat_jid", "")); val != "" {
+			chatJID = &val
+		}
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatText)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		offset := page * limit
+		cursor, err := decodeCursor(request.GetString("cursor", ""), cursorSemanticSearch)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		if cursor != nil {
+			offset = cursor.Offset
+		}
+
+		messages, notes, err := hybridSearch(query, chatJID, limit, offset)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		result, err := renderMessages(matchesOnly(messages), format, display, renderOptions{
+			showChatInfo: true, notes: notes, links: offsetLinks(cursorSemanticSearch, offset, limit, len(messages)), budget: budget,
+			continueAt: func(shown int, last matchOutput) string {
+				return encodeCursor(pageCursor{List: cursorSemanticSearch, Offset: offset + shown})
+			},
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		return result, nil
 	})
 
 	// Register list_chats tool
@@ -829,9 +1173,13 @@ func main() {
 		mcp.WithDescription("Get WhatsApp chats matching specified criteria."),
 		mcp.WithString("query", mcp.Description("Optional search term to filter chats by name or JID")),
 		mcp.WithNumber("limit", mcp.Description("Maximum number of chats to return (default 20)")),
-		mcp.WithNumber("page", mcp.Description("Page number for pagination (default 0)")),
+		cursorParam,
+		mcp.WithNumber("page", mcp.Description("Deprecated, use cursor. Page number for pagination (default 0)")),
 		mcp.WithBoolean("include_last_message", mcp.Description("Whether to include the last message in each chat (default true)")),
 		mcp.WithString("sort_by", mcp.Description("Field to sort results by, either \"last_active\" or \"name\" (default \"last_active\")")),
+		timezoneParam,
+		budgetParams,
+		mcp.WithOutputSchema[chatsResult](),
 	)
 	s.AddTool(listChatsTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		var query *string
@@ -844,17 +1192,33 @@ func main() {
 			query = &val
 		}
 
-		chats, err := listChats(query, limit, page, includeLastMessage, sortBy)
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		content, err := json.Marshal(chats)
+		cursor, err := decodeCursor(request.GetString("cursor", ""), chatsCursorList(sortBy))
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("JSON marshal error: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText(string(content)), nil
+		chats, links, err := listChats(query, limit, page, cursor, includeLastMessage, sortBy, clientFromContext(ctx).allowedChats())
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+		}
+		for i := range chats {
+			display.chat(&chats[i])
+		}
+
+		result, err := renderChats(chats, links, budget, chatsCursorList(sortBy))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return result, nil
 	})
 
 	// Register get_chat tool
@@ -862,15 +1226,21 @@ func main() {
 		mcp.WithDescription("Get WhatsApp chat metadata by JID."),
 		mcp.WithString("chat_jid", mcp.Required(), mcp.Description("The JID of the chat to retrieve")),
 		mcp.WithBoolean("include_last_message", mcp.Description("Whether to include the last message (default true)")),
+		timezoneParam,
 	)
 	s.AddTool(getChatTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		chatJID := request.GetString("chat_jid", "")
+		chatJID := labelJID(request.GetString("chat_jid", ""))
 		if chatJID == "" {
 			return mcp.NewToolResultError("chat_jid parameter is required"), nil
 		}
 
 		includeLastMessage := request.GetBool("include_last_message", true)
 
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
 		chat, err := getChat(chatJID, includeLastMessage)
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
@@ -879,6 +1249,7 @@ func main() {
 		if chat == nil {
 			return mcp.NewToolResultText("null"), nil
 		}
+		display.chat(chat)
 
 		content, err := json.Marshal(chat)
 		if err != nil {
@@ -892,21 +1263,28 @@ func main() {
 	getDirectChatTool := mcp.NewTool("get_direct_chat_by_contact",
 		mcp.WithDescription("Get WhatsApp chat metadata by sender phone number."),
 		mcp.WithString("sender_phone_number", mcp.Required(), mcp.Description("The phone number to search for")),
+		timezoneParam,
 	)
 	s.AddTool(getDirectChatTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		senderPhoneNumber := request.GetString("sender_phone_number", "")
+		senderPhoneNumber := labelJID(request.GetString("sender_phone_number", ""))
 		if senderPhoneNumber == "" {
 			return mcp.NewToolResultError("sender_phone_number parameter is required"), nil
 		}
 
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
 		chat, err := getDirectChatByContact(senderPhoneNumber)
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
 		}
 
-		if chat == nil {
+		if chat == nil || !clientFromContext(ctx).canAccess(chat.JID) {
 			return mcp.NewToolResultText("null"), nil
 		}
+		display.chat(chat)
 
 		content, err := json.Marshal(chat)
 		if err != nil {
@@ -921,10 +1299,14 @@ func main() {
 		mcp.WithDescription("Get all WhatsApp chats involving the contact."),
 		mcp.WithString("jid", mcp.Required(), mcp.Description("The contact's JID to search for")),
 		mcp.WithNumber("limit", mcp.Description("Maximum number of chats to return (default 20)")),
-		mcp.WithNumber("page", mcp.Description("Page number for pagination (default 0)")),
+		cursorParam,
+		mcp.WithNumber("page", mcp.Description("Deprecated, use cursor. Page number for pagination (default 0)")),
+		timezoneParam,
+		budgetParams,
+		mcp.WithOutputSchema[chatsResult](),
 	)
 	s.AddTool(getContactChatsTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		jid := request.GetString("jid", "")
+		jid := labelJID(request.GetString("jid", ""))
 		if jid == "" {
 			return mcp.NewToolResultError("jid parameter is required"), nil
 		}
@@ -932,48 +1314,90 @@ func main() {
 		limit := int(request.GetFloat("limit", 20))
 		page := int(request.GetFloat("page", 0))
 
-		chats, err := getContactChats(jid, limit, page)
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		content, err := json.Marshal(chats)
+		cursor, err := decodeCursor(request.GetString("cursor", ""), cursorContactChats)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("JSON marshal error: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText(string(content)), nil
+		chats, links, err := getContactChats(jid, limit, page, cursor, clientFromContext(ctx).allowedChats())
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+		}
+		for i := range chats {
+			display.chat(&chats[i])
+		}
+
+		result, err := renderChats(chats, links, budget, cursorContactChats)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return result, nil
 	})
 
 	// Register get_last_interaction tool
 	getLastInteractionTool := mcp.NewTool("get_last_interaction",
 		mcp.WithDescription("Get most recent WhatsApp message involving the contact."),
 		mcp.WithString("jid", mcp.Required(), mcp.Description("The JID of the contact to search for")),
+		timezoneParam,
+		outputFormatParam(formatText),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
 	)
 	s.AddTool(getLastInteractionTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		jid := request.GetString("jid", "")
+		jid := labelJID(request.GetString("jid", ""))
 		if jid == "" {
 			return mcp.NewToolResultError("jid parameter is required"), nil
 		}
 
-		message, err := getLastInteraction(jid)
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatText)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		if message == "" {
-			return mcp.NewToolResultText("null"), nil
+		message, err := getLastInteraction(jid, clientFromContext(ctx).allowedChats())
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText(message), nil
+		var groups []MessageContext
+		if message != nil {
+			groups = append(groups, MessageContext{Message: *message})
+		}
+		result, err := renderMessages(groups, format, display, renderOptions{transcript: true, budget: budget})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		return result, nil
 	})
 
 	// Register get_message_context tool
 	getMessageContextTool := mcp.NewTool("get_message_context",
 		mcp.WithDescription("Get context around a specific WhatsApp message."),
 		mcp.WithString("message_id", mcp.Required(), mcp.Description("The ID of the message to get context for")),
+		mcp.WithString("chat_jid", mcp.Description("The JID of the chat containing the message; recommended, since message IDs are only unique within a chat")),
 		mcp.WithNumber("before", mcp.Description("Number of messages to include before the target message (default 5)")),
 		mcp.WithNumber("after", mcp.Description("Number of messages to include after the target message (default 5)")),
+		timezoneParam,
+		outputFormatParam(formatJSON),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
 	)
 	s.AddTool(getMessageContextTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		messageID := request.GetString("message_id", "")
@@ -984,17 +1408,138 @@ func main() {
 		before := int(request.GetFloat("before", 5))
 		after := int(request.GetFloat("after", 5))
 
-		context, err := getMessageContext(messageID, before, after)
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatJSON)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		content, err := json.Marshal(context)
+		chatJID := labelJID(request.GetString("chat_jid", ""))
+		if chatJID != "" {
+			if err := checkChatAccess(ctx, chatJID); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+			}
+		}
+
+		// Messages in chats the client may not access are not found, so the error can't
+		// reveal that they exist
+		context, err := getMessageContext(chatJID, messageID, before, after, clientFromContext(ctx).allowedChats())
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("JSON marshal error: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText(string(content)), nil
+		result, err := renderMessages([]MessageContext{*context}, format, display, renderOptions{transcript: true, budget: budget})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		return result, nil
+	})
+
+	// Register get_conversation tool
+	getConversationTool := mcp.NewTool("get_conversation",
+		mcp.WithDescription("Read a chat as a chronological transcript over a time range, without duplicates, with speaker names, media placeholders, replies and reactions. Long conversations are split into chunks; pass next_cursor back to continue."),
+		mcp.WithString("chat", mcp.Required(), mcp.Description("Chat name, phone number or JID")),
+		mcp.WithString("after", mcp.Description("Optional date or time to start at, in the same formats as list_messages, e.g. \"yesterday 9am\" (default: the past 24 hours)")),
+		mcp.WithString("before", mcp.Description("Optional date or time to stop before")),
+		mcp.WithString("during", mcp.Description("Optional period to read instead of after and before, e.g. \"today\" or \"last week\"")),
+		mcp.WithBoolean("since_my_last_message", mcp.Description("Start right after the last message I sent in the chat (default false)")),
+		mcp.WithString("cursor", mcp.Description("Optional next_cursor from a previous call to continue the transcript, with the same chat and time range")),
+		timezoneParam,
+		outputFormatParam(formatText),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
+	)
+	s.AddTool(getConversationTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		chatValue := request.GetString("chat", "")
+		if chatValue == "" {
+			return mcp.NewToolResultError("chat parameter is required"), nil
+		}
+		sinceMine := request.GetBool("since_my_last_message", false)
+
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatText)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		window := &searchQuery{}
+		for _, name := range []string{"after", "before", "during"} {
+			if val := request.GetString(name, ""); val != "" {
+				if err := window.addDateFilter(name, val, display.now); err != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("Error: invalid '%s': %v", name, err)), nil
+				}
+			}
+		}
+
+		chat, err := findChat(chatValue, clientFromContext(ctx).allowedChats())
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		start, err := decodeCursor(request.GetString("cursor", ""), cursorConversation)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		if start != nil && (start.Backward || start.ChatJID != chat.JID) {
+			return mcp.NewToolResultError("Error: the cursor belongs to another chat"), nil
+		}
+
+		var notes []string
+		if start == nil && sinceMine {
+			if start, err = lastOwnMessage(chat.JID); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+			}
+			if start != nil {
+				notes = append(notes, fmt.Sprintf("Since your last message (%s)", display.timestamp(*start.Time)))
+			} else {
+				notes = append(notes, "You haven't sent a message in this chat.")
+			}
+		}
+		if start == nil && window.After == nil {
+			window.addDateFilter("after", defaultConversationWindow, display.now)
+		}
+		if err := window.checkDates(); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		chunk, err := getConversation(chat.JID, window.After, window.Before, start, budget, display)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+		}
+		chunk.result.Dates = window.Dates
+		chunk.result.Notes = notes
+
+		chatName := chatTitle(chat)
+		var text string
+		switch format {
+		case formatJSON:
+			content, err := json.Marshal(chunk.result)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("JSON marshal error: %v", err)), nil
+			}
+			text = string(content)
+		case formatMarkdown:
+			text = fmt.Sprintf("### %s\n\n", escapeMarkdown(chatName)) + formatMessagesMarkdown(chunk.result, display, renderOptions{transcript: true, dates: window.Dates, notes: notes, links: chunk.result.pageLinks})
+		default:
+			text = formatConversation(chunk, chatName, func(cursor string) string {
+				return "call again with cursor " + cursor
+			}, display)
+		}
+
+		return mcp.NewToolResultStructured(chunk.result, text), nil
 	})
 
 	// Register send_message tool
@@ -1004,7 +1549,7 @@ func main() {
 		mcp.WithString("message", mcp.Required(), mcp.Description("The message text to send")),
 	)
 	s.AddTool(sendMessageTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		recipient := request.GetString("recipient", "")
+		recipient := labelJID(request.GetString("recipient", ""))
 		if recipient == "" {
 			return mcp.NewToolResultError("recipient parameter is required"), nil
 		}
@@ -1029,6 +1574,95 @@ func main() {
 		return mcp.NewToolResultText(string(content)), nil
 	})
 
+	// Register wait_for_message tool
+	waitForMessageTool := mcp.NewTool("wait_for_message",
+		mcp.WithDescription("Wait for a new WhatsApp message, e.g. the reply to a message just sent, and return the first one that arrives after the call starts and matches the filters. Sends progress notifications while waiting."),
+		mcp.WithString("chat", mcp.Description("Optional chat name, phone number or JID the message must arrive in")),
+		mcp.WithString("sender", mcp.Description("Optional contact name, phone number or JID the message must come from")),
+		mcp.WithString("pattern", mcp.Description("Optional case-insensitive regular expression the text or caption must match, e.g. \"\\d+ ?min\"")),
+		mcp.WithString("media_type", mcp.Description("Optional kind of message: image, video, audio, document, sticker, media (any of these) or link")),
+		mcp.WithBoolean("include_own", mcp.Description("Whether messages I send count too (default false)")),
+		mcp.WithNumber("timeout", mcp.Description(fmt.Sprintf("Seconds to wait before giving up (default %d, maximum %d)", int(defaultWaitTimeout.Seconds()), int(maxWaitTimeout.Seconds())))),
+		timezoneParam,
+		outputFormatParam(formatText),
+		budgetParams,
+		mcp.WithOutputSchema[messagesResult](),
+	)
+	s.AddTool(waitForMessageTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		format, err := parseOutputFormat(request, formatText)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		budget, err := parseBudget(request)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		timeout, err := parseWaitTimeout(request.GetFloat("timeout", 0))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		query := &searchQuery{Within: clientFromContext(ctx).allowedChats()}
+		if val := request.GetString("chat", ""); val != "" {
+			query.In = []string{val}
+		}
+		if val := request.GetString("sender", ""); val != "" {
+			query.From = []string{val}
+		}
+		if val := strings.ToLower(request.GetString("media_type", "")); val != "" {
+			if !containsString(searchHasValues, val) {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: invalid 'media_type' %q, use one of %s", val, strings.Join(searchHasValues, ", "))), nil
+			}
+			query.Has = []string{val}
+		}
+		if !request.GetBool("include_own", false) {
+			query.Is = []string{"to_me"}
+		}
+		var pattern *regexp.Regexp
+		if val := request.GetString("pattern", ""); val != "" {
+			if pattern, err = regexp.Compile("(?i)" + val); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: invalid 'pattern': %v", err)), nil
+			}
+		}
+
+		db, err := openDB()
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+		}
+		filter, err := resolveMessageFilter(db, query)
+		db.Close()
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		message, err := waitForMessage(ctx, filter, pattern, timeout, func(waited time.Duration) {
+			sendProgress(ctx, request, waited.Seconds(), timeout.Seconds(), fmt.Sprintf("Waited %s for a message", waited.Round(time.Second)))
+		})
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return mcp.NewToolResultError("Error: the wait was cancelled"), nil
+		}
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Database error: %v", err)), nil
+		}
+
+		options := renderOptions{showChatInfo: true, budget: budget}
+		var groups []MessageContext
+		if message != nil {
+			groups = append(groups, MessageContext{Message: *message})
+		} else {
+			options.notes = []string{fmt.Sprintf("No matching message arrived within %s.", timeout)}
+		}
+		result, err := renderMessages(groups, format, display, options)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+		return result, nil
+	})
+
 	// Register send_file tool
 	sendFileTool := mcp.NewTool("send_file",
 		mcp.WithDescription("Send a file such as a picture, raw audio, video or document via WhatsApp to the specified recipient. For group messages use the JID."),
@@ -1036,7 +1670,7 @@ func main() {
 		mcp.WithString("media_path", mcp.Required(), mcp.Description("The absolute path to the media file to send (image, video, document)")),
 	)
 	s.AddTool(sendFileTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		recipient := request.GetString("recipient", "")
+		recipient := labelJID(request.GetString("recipient", ""))
 		if recipient == "" {
 			return mcp.NewToolResultError("recipient parameter is required"), nil
 		}
@@ -1045,6 +1679,10 @@ func main() {
 		if mediaPath == "" {
 			return mcp.NewToolResultError("media_path parameter is required"), nil
 		}
+		mediaPath, err := checkMediaPath(ctx, recipient, mediaPath)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
 
 		success, statusMessage := sendFile(recipient, mediaPath)
 
@@ -1068,7 +1706,7 @@ func main() {
 		mcp.WithString("media_path", mcp.Required(), mcp.Description("The absolute path to the audio file to send (will be converted to Opus .ogg if it's not a .ogg file)")),
 	)
 	s.AddTool(sendAudioTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		recipient := request.GetString("recipient", "")
+		recipient := labelJID(request.GetString("recipient", ""))
 		if recipient == "" {
 			return mcp.NewToolResultError("recipient parameter is required"), nil
 		}
@@ -1077,6 +1715,10 @@ func main() {
 		if mediaPath == "" {
 			return mcp.NewToolResultError("media_path parameter is required"), nil
 		}
+		mediaPath, err := checkMediaPath(ctx, recipient, mediaPath)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
 
 		success, statusMessage := sendAudioMessage(recipient, mediaPath)
 
@@ -1095,9 +1737,11 @@ func main() {
 
 	// Register download_media tool
 	downloadMediaTool := mcp.NewTool("download_media",
-		mcp.WithDescription("Download media from a WhatsApp message and get the local file path."),
+		mcp.WithDescription("Download media from a WhatsApp message and get the local file path. Set inline to true to get the media itself back as image, audio or resource content."),
 		mcp.WithString("message_id", mcp.Required(), mcp.Description("The ID of the message containing the media")),
 		mcp.WithString("chat_jid", mcp.Required(), mcp.Description("The JID of the chat containing the message")),
+		mcp.WithBoolean("inline", mcp.Description("Whether to return the media content inline instead of only the local file path (default false)")),
+		mcp.WithNumber("max_image_dimension", mcp.Description("Maximum width or height in pixels for inline images, larger images are downscaled (default 1568)")),
 	)
 	s.AddTool(downloadMediaTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		messageID := request.GetString("message_id", "")
@@ -1105,13 +1749,22 @@ func main() {
 			return mcp.NewToolResultError("message_id parameter is required"), nil
 		}
 
-		chatJID := request.GetString("chat_jid", "")
+		chatJID := labelJID(request.GetString("chat_jid", ""))
 		if chatJID == "" {
 			return mcp.NewToolResultError("chat_jid parameter is required"), nil
 		}
 
 		filePath := downloadMedia(messageID, chatJID)
 
+		if filePath != "" && request.GetBool("inline", false) {
+			maxImageDimension := int(request.GetFloat("max_image_dimension", defaultMaxImageDimension))
+			result, err := buildInlineMediaResult(filePath, chatJID, messageID, maxImageDimension)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+			}
+			return result, nil
+		}
+
 		var result map[string]interface{}
 		if filePath != "" {
 			result = map[string]interface{}{
@@ -1134,7 +1787,122 @@ func main() {
 		return mcp.NewToolResultText(string(content)), nil
 	})
 
-	if err := server.ServeStdio(s); err != nil {
+	// Register download_chat_media tool
+	downloadChatMediaTool := mcp.NewTool("download_chat_media",
+		mcp.WithDescription("Download all media of a WhatsApp chat, optionally filtered by media type and time window, into a directory or zip archive with a manifest. Repeating the same call resumes an interrupted download."),
+		mcp.WithString("chat_jid", mcp.Required(), mcp.Description("The JID of the chat to download media from")),
+		mcp.WithString("media_types", mcp.Description("Optional comma-separated list of media types to include: image, video, audio, document, sticker (default all)")),
+		mcp.WithString("after", mcp.Description("Optional date or time to only include media sent on or after it, e.g. 2026-03-01, yesterday, \"3 days ago\" or an RFC3339 time")),
+		mcp.WithString("before", mcp.Description("Optional date or time to only include media sent before it, in the same formats as after")),
+		mcp.WithString("format", mcp.Description("Output format, either \"directory\" or \"zip\" (default \"directory\")")),
+		mcp.WithNumber("concurrency", mcp.Description("Number of parallel downloads (default 4, maximum 16)")),
+		timezoneParam,
+	)
+	s.AddTool(downloadChatMediaTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		chatJID := labelJID(request.GetString("chat_jid", ""))
+		if chatJID == "" {
+			return mcp.NewToolResultError("chat_jid parameter is required"), nil
+		}
+
+		payload := DownloadChatMediaRequest{
+			ChatJID:     chatJID,
+			Format:      request.GetString("format", "directory"),
+			Concurrency: int(request.GetFloat("concurrency", 4)),
+		}
+
+		display, err := newTimeDisplay(request.GetString("timezone", ""))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		// The bridge takes exact RFC3339 times
+		now := display.now
+		var dates []string
+		for _, name := range []string{"after", "before"} {
+			val := request.GetString(name, "")
+			if val == "" {
+				continue
+			}
+			after, before, note, err := parseDateFilter(name, val, now)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Error: invalid '%s': %v", name, err)), nil
+			}
+			if after != nil {
+				payload.After = after.Format(time.RFC3339)
+			}
+			if before != nil {
+				payload.Before = before.Format(time.RFC3339)
+			}
+			dates = append(dates, note)
+		}
+		for _, mediaType := range strings.Split(request.GetString("media_types", ""), ",") {
+			if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+				payload.MediaTypes = append(payload.MediaTypes, mediaType)
+			}
+		}
+
+		var failures []string
+		result, err := downloadChatMedia(ctx, payload, func(event DownloadChatMediaEvent) {
+			if event.Status == "failed" {
+				failures = append(failures, fmt.Sprintf("%s: %s", event.MessageID, event.Error))
+			}
+			message := ""
+			if event.Type == "item" {
+				message = fmt.Sprintf("%s %s", event.Status, event.MessageID)
+			}
+			sendProgress(ctx, request, float64(event.Done), float64(event.Total), message)
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		summary := map[string]interface{}{
+			"success":  result.Failed == 0,
+			"total":    result.Total,
+			"failed":   result.Failed,
+			"output":   result.Output,
+			"manifest": result.Manifest,
+		}
+		if len(failures) > 0 {
+			summary["failures"] = failures
+		}
+		if len(dates) > 0 {
+			summary["dates"] = dates
+		}
+
+		content, err := json.Marshal(summary)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("JSON marshal error: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(string(content)), nil
+	})
+
+	// Register media_storage_report tool
+	mediaStorageReportTool := mcp.NewTool("media_storage_report",
+		mcp.WithDescription("Report how much disk space downloaded WhatsApp media uses, broken down by media type and chat, together with the bridge's retention policy and the last garbage collection run."),
+	)
+	s.AddTool(mediaStorageReportTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		report, err := getMediaStats()
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(report), nil
+	})
+
+	registerResources(s)
+	registerPrompts(s)
+	watcher, err := newResourceWatcher(s, hooks)
+	if err != nil {
+		log.Fatalf("Failed to watch for new messages: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watcher.run(ctx, pollInterval)
+
+	if err := serve(ctx, s, *transport, *addr, auth); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "image/gif"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Limits for media returned inline in tool results
+const (
+	defaultMaxImageDimension = 1568
+	maxInlineMediaBytes      = 10 * 1024 * 1024
+	maxPDFTextChars          = 50000
+)
+
+// mediaMimeTypes covers the extensions the bridge uses for downloaded media,
+// which are not all present in the system MIME tables
+var mediaMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".mp4":  "video/mp4",
+	".pdf":  "application/pdf",
+}
+
+// detectMediaMimeType determines the MIME type of a downloaded media file
+// from its extension, falling back to sniffing the content
+func detectMediaMimeType(path string, data []byte) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType, ok := mediaMimeTypes[ext]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		// Strip parameters such as "; charset=utf-8"
+		return strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	}
+	return strings.SplitN(http.DetectContentType(data), ";", 2)[0]
+}
+
+// mediaResourceURI builds the URI used to identify a message's media in tool results
+func mediaResourceURI(chatJID, messageID string) string {
+	return fmt.Sprintf("whatsapp://media/%s/%s", chatJID, messageID)
+}
+
+// downscaleImage decodes an image and re-encodes it so that neither side exceeds maxDimension.
+// Images that already fit are returned unchanged.
+func downscaleImage(data []byte, mimeType string, maxDimension int) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	// Only JPEG, PNG and GIF are widely accepted by MCP clients, so anything
+	// else (e.g. WebP stickers) is always re-encoded
+	passthrough := mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif"
+	if passthrough && cfg.Width <= maxDimension && cfg.Height <= maxDimension {
+		return data, mimeType, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	width, height := cfg.Width, cfg.Height
+	if width > maxDimension || height > maxDimension {
+		if width >= height {
+			height = height * maxDimension / width
+			width = maxDimension
+		} else {
+			width = width * maxDimension / height
+			height = maxDimension
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var buf bytes.Buffer
+	// Keep PNG for images that may carry transparency, JPEG for everything else
+	if mimeType == "image/png" || mimeType == "image/webp" || mimeType == "image/gif" {
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, "", fmt.Errorf("failed to encode image: %v", err)
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %v", err)
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
+
+// extractPDFText extracts the text of a PDF using pdftotext (poppler-utils) if it is installed
+func extractPDFText(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "pdftotext", "-layout", "-enc", "UTF-8", path, "-")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract PDF text. You likely need to install pdftotext: %v", err)
+	}
+
+	text := strings.TrimSpace(string(output))
+	// Cut on a character boundary, multibyte text would otherwise end in invalid UTF-8
+	if runes := []rune(text); len(runes) > maxPDFTextChars {
+		text = string(runes[:maxPDFTextChars]) + "\n[... text truncated ...]"
+	}
+	return text, nil
+}
+
+// buildInlineMediaResult reads a downloaded media file and returns it as MCP content:
+// images as ImageContent, audio as AudioContent and everything else as an embedded resource.
+// PDFs additionally get their extracted text when pdftotext is available.
+func buildInlineMediaResult(path, chatJID, messageID string, maxImageDimension int) (*mcp.CallToolResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat media file: %v", err)
+	}
+	// Don't read files into memory that are too large to return anyway
+	if info.Size() > maxInlineMediaBytes {
+		return nil, fmt.Errorf("media file is too large to return inline (%d bytes, limit %d)", info.Size(), maxInlineMediaBytes)
+	}
+
+	if maxImageDimension <= 0 {
+		maxImageDimension = defaultMaxImageDimension
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media file: %v", err)
+	}
+
+	mimeType := detectMediaMimeType(path, data)
+	summary := fmt.Sprintf("Media from message %s in chat %s (%s, %d bytes, saved at %s)", messageID, chatJID, mimeType, info.Size(), path)
+
+	if strings.HasPrefix(mimeType, "image/") {
+		// Formats we can't decode fall through and are returned as a plain resource
+		imageData, imageMimeType, err := downscaleImage(data, mimeType, maxImageDimension)
+		if err == nil {
+			if len(imageData) > maxInlineMediaBytes {
+				return nil, fmt.Errorf("image is too large to return inline (%d bytes)", len(imageData))
+			}
+			return &mcp.CallToolResult{
+				Content: []mcp.Content{
+					mcp.NewTextContent(summary),
+					mcp.NewImageContent(base64.StdEncoding.EncodeToString(imageData), imageMimeType),
+				},
+			}, nil
+		}
+	}
+
+	if len(data) > maxInlineMediaBytes {
+		return nil, fmt.Errorf("media file is too large to return inline (%d bytes, limit %d)", len(data), maxInlineMediaBytes)
+	}
+
+	content := []mcp.Content{mcp.NewTextContent(summary)}
+
+	if strings.HasPrefix(mimeType, "audio/") {
+		content = append(content, mcp.NewAudioContent(base64.StdEncoding.EncodeToString(data), mimeType))
+		return &mcp.CallToolResult{Content: content}, nil
+	}
+
+	if mimeType == "application/pdf" {
+		if text, err := extractPDFText(path); err == nil && text != "" {
+			content = append(content, mcp.NewTextContent("Extracted PDF text:\n"+text))
+		}
+	}
+
+	content = append(content, mcp.NewEmbeddedResource(mcp.BlobResourceContents{
+		URI:      mediaResourceURI(chatJID, messageID),
+		MIMEType: mimeType,
+		Blob:     base64.StdEncoding.EncodeToString(data),
+	}))
+
+	return &mcp.CallToolResult{Content: content}, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildInlineMediaResultRejectsLargeFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A sparse file, so the test doesn't write 10 MB
+	if err := f.Truncate(maxInlineMediaBytes + 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = buildInlineMediaResult(path, "123@s.whatsapp.net", "m1", 0)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("buildInlineMediaResult of a file over the limit = %v, want a too large error", err)
+	}
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Output formats of the message tools
+const (
+	formatText     = "text"
+	formatMarkdown = "markdown"
+	formatJSON     = "json"
+)
+
+// outputFormatParam adds the format parameter to a message tool
+func outputFormatParam(defaultFormat string) mcp.ToolOption {
+	return mcp.WithString("format",
+		mcp.Description(fmt.Sprintf("Output format: \"text\", \"markdown\" or \"json\" (default %q). Every format also returns the messages as structured content.", defaultFormat)),
+		mcp.Enum(formatText, formatMarkdown, formatJSON),
+	)
+}
+
+// messagesResult is the structured result of every tool that returns messages. It is
+// declared as the tools' output schema.
+type messagesResult struct {
+	Messages []matchOutput `json:"messages" jsonschema:"Matching messages in result order"`
+	Dates    []string      `json:"dates,omitempty" jsonschema:"How the dates in the query were read"`
+	Notes    []string      `json:"notes,omitempty" jsonschema:"Remarks about the search such as fallbacks"`
+	Omitted  int           `json:"omitted,omitempty" jsonschema:"Matches left out to stay within the size limit; next_cursor continues after the last one shown"`
+	pageLinks
+}
+
+// chatsResult is the structured result of the tools that list chats
+type chatsResult struct {
+	Chats   []Chat `json:"chats"`
+	Omitted int    `json:"omitted,omitempty" jsonschema:"Chats left out to stay within the size limit; next_cursor continues after the last one shown"`
+	pageLinks
+}
+
+// matchOutput is a message in a result, with the messages around it when context was asked for
+type matchOutput struct {
+	messageOutput
+	ContextBefore []messageOutput `json:"context_before,omitempty" jsonschema:"Earlier messages in the same chat oldest first"`
+	ContextAfter  []messageOutput `json:"context_after,omitempty" jsonschema:"Later messages in the same chat oldest first"`
+}
+
+// messageOutput is the structured form of a message
+type messageOutput struct {
+	ID         string           `json:"id"`
+	ChatJID    string           `json:"chat_jid"`
+	ChatName   string           `json:"chat_name,omitempty"`
+	SenderJID  string           `json:"sender_jid"`
+	SenderName string           `json:"sender_name"`
+	IsFromMe   bool             `json:"is_from_me"`
+	Timestamp  time.Time        `json:"timestamp"`
+	Ago        string           `json:"ago"`
+	Text       string           `json:"text"`
+	Snippet    string           `json:"snippet,omitempty" jsonschema:"Matching part of the text with the search terms in **bold**"`
+	Media      *mediaOutput     `json:"media,omitempty"`
+	ReplyTo    *replyOutput     `json:"reply_to,omitempty"`
+	Reactions  []reactionOutput `json:"reactions,omitempty"`
+
+	TruncatedChars int `json:"truncated_chars,omitempty" jsonschema:"Characters cut from the text and caption to stay within the size limit"`
+}
+
+// mediaOutput describes a message's attachment
+type mediaOutput struct {
+	Type     string `json:"type" jsonschema:"One of image, video, audio, document or sticker"`
+	Filename string `json:"filename,omitempty"`
+	Mimetype string `json:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty" jsonschema:"Size in bytes"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Duration int    `json:"duration,omitempty" jsonschema:"Length of audio and video in seconds"`
+	Caption  string `json:"caption,omitempty"`
+}
+
+// replyOutput is the message a message replies to. Only the ID is known if the quoted
+// message isn't stored.
+type replyOutput struct {
+	ID         string `json:"id"`
+	SenderJID  string `json:"sender_jid,omitempty"`
+	SenderName string `json:"sender_name,omitempty"`
+	Text       string `json:"text,omitempty"`
+}
+
+// reactionOutput is an emoji reaction to a message
+type reactionOutput struct {
+	Emoji      string    `json:"emoji"`
+	SenderJID  string    `json:"sender_jid"`
+	SenderName string    `json:"sender_name"`
+	IsFromMe   bool      `json:"is_from_me"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// renderOptions controls how messages are rendered
+type renderOptions struct {
+	transcript   bool // time-ordered messages, separated by day
+	showChatInfo bool
+	dates        []string
+	notes        []string
+	links        pageLinks
+	budget       outputBudget
+
+	// continueAt returns the cursor to the matches after the first shown ones, if the budget
+	// leaves some out. Without it there is no way to continue.
+	continueAt func(shown int, last matchOutput) string
+}
+
+// parseOutputFormat returns the format requested in a tool call
+func parseOutputFormat(request mcp.CallToolRequest, defaultFormat string) (string, error) {
+	format := strings.ToLower(request.GetString("format", defaultFormat))
+	switch format {
+	case formatText, formatMarkdown, formatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, use text, markdown or json", format)
+	}
+}
+
+// renderMessages builds the result of a message tool: the messages in the requested format as
+// text content, and always as structured content. Both are shaped to fit the budget.
+func renderMessages(groups []MessageContext, format string, display timeDisplay, options renderOptions) (*mcp.CallToolResult, error) {
+	result, err := buildMessagesResult(groups, display)
+	if err != nil {
+		return nil, err
+	}
+	result.Dates = options.dates
+	result.Notes = options.notes
+
+	options.budget.shortenMessages(result)
+	shown := options.budget.fit(len(result.Messages), func(i int) int {
+		return matchSize(result.Messages[i], format, display, options)
+	})
+	if shown < len(result.Messages) {
+		result.Omitted = len(result.Messages) - shown
+		result.Messages = result.Messages[:shown]
+		options.links.NextCursor = ""
+		if options.continueAt != nil {
+			options.links.NextCursor = options.continueAt(shown, result.Messages[shown-1])
+		}
+	}
+	result.pageLinks = options.links
+
+	var text string
+	switch format {
+	case formatJSON:
+		content, err := json.Marshal(result)
+		if err != nil {
+			return nil, fmt.Errorf("JSON marshal error: %v", err)
+		}
+		text = string(content)
+	case formatMarkdown:
+		text = formatMessagesMarkdown(result, display, options)
+	default:
+		text = formatMessagesText(result, display, options)
+	}
+
+	return mcp.NewToolResultStructured(result, text), nil
+}
+
+// matchSize estimates how much a match adds to a result in a format
+func matchSize(match matchOutput, format string, display timeDisplay, options renderOptions) int {
+	if format == formatJSON {
+		content, _ := json.Marshal(match)
+		return len(content)
+	}
+
+	var b strings.Builder
+	for _, msg := range match.messages() {
+		if format == formatMarkdown {
+			writeMessageMarkdown(&b, msg, false, display, options)
+		} else {
+			writeMessageText(&b, msg, display, options)
+		}
+	}
+	return b.Len()
+}
+
+// messages returns a match with its context in time order
+func (m matchOutput) messages() []messageOutput {
+	messages := make([]messageOutput, 0, len(m.ContextBefore)+1+len(m.ContextAfter))
+	messages = append(messages, m.ContextBefore...)
+	messages = append(messages, m.messageOutput)
+	return append(messages, m.ContextAfter...)
+}
+
+// outputEntry is one message, or a run of attachments one sender sent in a row, which is
+// shown as a single line
+type outputEntry struct {
+	messages []messageOutput
+	isMatch  bool
+}
+
+// minMediaRun is the number of attachments in a row from which they are collapsed
+const minMediaRun = 3
+
+// messageBlocks splits a result into the sequences of messages shown together: each match
+// with its context, or all matches if none has context. It returns whether there is context.
+func messageBlocks(result *messagesResult, display timeDisplay) ([][]outputEntry, bool) {
+	grouped := false
+	for _, match := range result.Messages {
+		if len(match.ContextBefore) > 0 || len(match.ContextAfter) > 0 {
+			grouped = true
+		}
+	}
+
+	var blocks [][]outputEntry
+	if !grouped {
+		messages := make([]messageOutput, len(result.Messages))
+		for i, match := range result.Messages {
+			messages[i] = match.messageOutput
+		}
+		return [][]outputEntry{collapseMedia(messages, nil, display)}, false
+	}
+	for _, match := range result.Messages {
+		blocks = append(blocks, collapseMedia(match.messages(), &match.messageOutput, display))
+	}
+	return blocks, true
+}
+
+// collapseMedia turns messages into entries, collapsing runs of bare attachments from the same
+// sender on the same day. The match, if given, is always shown on its own.
+func collapseMedia(messages []messageOutput, match *messageOutput, display timeDisplay) []outputEntry {
+	bare := func(msg messageOutput) bool {
+		return msg.Media != nil && msg.Text == "" && msg.Media.Caption == "" && msg.ReplyTo == nil && len(msg.Reactions) == 0 &&
+			(match == nil || msg.ID != match.ID || msg.ChatJID != match.ChatJID)
+	}
+	isMatch := func(msg messageOutput) bool {
+		return match != nil && msg.ID == match.ID && msg.ChatJID == match.ChatJID
+	}
+
+	var entries []outputEntry
+	for i := 0; i < len(messages); {
+		end := i + 1
+		if bare(messages[i]) {
+			for end < len(messages) && bare(messages[end]) &&
+				messages[end].SenderJID == messages[i].SenderJID && messages[end].ChatJID == messages[i].ChatJID &&
+				display.day(messages[end].Timestamp) == display.day(messages[i].Timestamp) {
+				end++
+			}
+		}
+		if end-i >= minMediaRun {
+			entries = append(entries, outputEntry{messages: messages[i:end]})
+			i = end
+			continue
+		}
+		entries = append(entries, outputEntry{messages: messages[i : i+1], isMatch: isMatch(messages[i])})
+		i++
+	}
+	return entries
+}
+
+// describeMedia counts the attachments in a run, e.g. "3 images, 1 video"
+func describeMedia(messages []messageOutput) string {
+	var types []string
+	counts := make(map[string]int)
+	for _, msg := range messages {
+		if counts[msg.Media.Type] == 0 {
+			types = append(types, msg.Media.Type)
+		}
+		counts[msg.Media.Type]++
+	}
+
+	parts := make([]string, len(types))
+	for i, mediaType := range types {
+		name := mediaType
+		if mediaType == "audio" {
+			name = "audio message"
+		}
+		if counts[mediaType] > 1 {
+			name += "s"
+		}
+		parts[i] = fmt.Sprintf("%d %s", counts[mediaType], name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// messageIDs lists the IDs of messages
+func messageIDs(messages []messageOutput) []string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+// formatMessagesText renders a result as plain text, one line per message
+func formatMessagesText(result *messagesResult, display timeDisplay, options renderOptions) string {
+	var b strings.Builder
+	for _, note := range options.notes {
+		b.WriteString(note + "\n")
+	}
+	if len(options.dates) > 0 {
+		fmt.Fprintf(&b, "Dates: %s\n", strings.Join(options.dates, "; "))
+	}
+	if len(result.Messages) == 0 {
+		b.WriteString("No messages to display.")
+	}
+
+	blocks, _ := messageBlocks(result, display)
+	lastDay := ""
+	for _, block := range blocks {
+		for _, entry := range block {
+			first := entry.messages[0]
+			if options.transcript {
+				if day := display.day(first.Timestamp); day != lastDay {
+					fmt.Fprintf(&b, "--- %s ---\n", day)
+					lastDay = day
+				}
+			}
+			if len(entry.messages) == 1 {
+				writeMessageText(&b, first, display, options)
+				continue
+			}
+			writeMessageHeaderText(&b, first, display, options)
+			fmt.Fprintf(&b, "%s [Message IDs: %s - Chat JID: %s]\n", describeMedia(entry.messages), strings.Join(messageIDs(entry.messages), ", "), first.ChatJID)
+		}
+	}
+
+	if result.Omitted > 0 {
+		fmt.Fprintf(&b, "\n%s\n", omittedNote(result.Omitted, "messages", options))
+	}
+	b.WriteString(formatPageLinks(options.links))
+	return b.String()
+}
+
+// writeMessageHeaderText writes the time, chat and sender a message line starts with
+func writeMessageHeaderText(b *strings.Builder, msg messageOutput, display timeDisplay, options renderOptions) {
+	if options.showChatInfo && msg.ChatName != "" {
+		fmt.Fprintf(b, "[%s] Chat: %s ", display.timestamp(msg.Timestamp), msg.ChatName)
+	} else {
+		fmt.Fprintf(b, "[%s] ", display.timestamp(msg.Timestamp))
+	}
+	fmt.Fprintf(b, "From: %s: ", msg.SenderName)
+}
+
+// writeMessageText writes a message as one line of text
+func writeMessageText(b *strings.Builder, msg messageOutput, display timeDisplay, options renderOptions) {
+	writeMessageHeaderText(b, msg, display, options)
+	if msg.Media != nil {
+		fmt.Fprintf(b, "[%s - Message ID: %s - Chat JID: %s] ", msg.Media.Type, msg.ID, msg.ChatJID)
+	}
+	if msg.Snippet != "" {
+		b.WriteString(msg.Snippet)
+	} else {
+		b.WriteString(msg.Text)
+	}
+	b.WriteString("\n")
+}
+
+// omittedNote tells how many items the budget left out and how to get them
+func omittedNote(omitted int, items string, options renderOptions) string {
+	note := fmt.Sprintf("%d more %s left out to stay within %d characters.", omitted, items, options.budget.maxChars)
+	if options.links.NextCursor != "" {
+		return note + " Use the next page cursor to continue."
+	}
+	return note + " Ask for fewer or raise max_chars to see them."
+}
+
+// renderChats builds the result of a tool that lists chats, which is JSON in both the text
+// and the structured content. Chats that don't fit the budget are left out, continuing at
+// the position list gives the last chat shown.
+func renderChats(chats []Chat, links pageLinks, budget outputBudget, list string) (*mcp.CallToolResult, error) {
+	if chats == nil {
+		chats = []Chat{}
+	}
+	for i := range chats {
+		if chats[i].LastMessage != nil {
+			text, _ := budget.shorten(*chats[i].LastMessage)
+			chats[i].LastMessage = &text
+		}
+	}
+
+	result := chatsResult{Chats: chats}
+	shown := budget.fit(len(chats), func(i int) int {
+		content, _ := json.Marshal(chats[i])
+		return len(content)
+	})
+	if shown < len(chats) {
+		result.Omitted = len(chats) - shown
+		result.Chats = chats[:shown]
+		links.NextCursor = encodeCursor(chatCursor(list, chats[shown-1]))
+	}
+	result.pageLinks = links
+	content, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshal error: %v", err)
+	}
+	return mcp.NewToolResultStructured(result, string(content)), nil
+}
+
+// formatPageLinks lists the cursors to the pages around a text result
+func formatPageLinks(links pageLinks) string {
+	output := ""
+	if links.NextCursor != "" {
+		output += fmt.Sprintf("\nNext page: cursor %s", links.NextCursor)
+	}
+	if links.PrevCursor != "" {
+		output += fmt.Sprintf("\nPrevious page: cursor %s", links.PrevCursor)
+	}
+	if output != "" {
+		output += "\n"
+	}
+	return output
+}
+
+// matchesOnly wraps messages that have no context around them
+func matchesOnly(messages []Message) []MessageContext {
+	groups := make([]MessageContext, len(messages))
+	for i, msg := range messages {
+		groups[i] = MessageContext{Message: msg}
+	}
+	return groups
+}
+
+// buildMessagesResult turns messages into their structured form, loading their media,
+// replies and reactions
+func buildMessagesResult(groups []MessageContext, display timeDisplay) (*messagesResult, error) {
+	var keys []messageKey
+	for _, group := range groups {
+		for _, msg := range group.Before {
+			keys = append(keys, messageKey{msg.ID, msg.ChatJID})
+		}
+		keys = append(keys, messageKey{group.Message.ID, group.Message.ChatJID})
+		for _, msg := range group.After {
+			keys = append(keys, messageKey{msg.ID, msg.ChatJID})
+		}
+	}
+
+	details, err := loadMessageDetails(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	senderName := func(sender string, isFromMe bool) string {
+		if isFromMe {
+			return "Me"
+		}
+		if _, ok := names[sender]; !ok {
+			names[sender] = getSenderName(sender)
+		}
+		return names[sender]
+	}
+
+	convert := func(msg Message) messageOutput {
+		output := messageOutput{
+			ID:         msg.ID,
+			ChatJID:    msg.ChatJID,
+			SenderJID:  senderJID(msg.Sender),
+			SenderName: senderName(msg.Sender, msg.IsFromMe),
+			IsFromMe:   msg.IsFromMe,
+			Timestamp:  msg.Timestamp.In(display.location),
+			Ago:        display.ago(msg.Timestamp),
+			Text:       msg.Content,
+		}
+		if msg.ChatName != nil {
+			output.ChatName = *msg.ChatName
+		}
+
+		detail := details[messageKey{msg.ID, msg.ChatJID}]
+		if detail == nil {
+			return output
+		}
+		if detail.text != msg.Content {
+			// Search results carry a highlighted snippet of the text, or of the caption or file name
+			output.Text = detail.text
+			if strings.Contains(msg.Content, "**") {
+				output.Snippet = msg.Content
+			}
+		}
+		output.Media = detail.media
+		if detail.replyTo != nil {
+			reply := *detail.replyTo
+			if reply.SenderJID != "" {
+				reply.SenderName = senderName(reply.SenderJID, detail.replyIsFromMe)
+				reply.SenderJID = senderJID(reply.SenderJID)
+			}
+			output.ReplyTo = &reply
+		}
+		for _, reaction := range detail.reactions {
+			reaction.SenderName = senderName(reaction.SenderJID, reaction.IsFromMe)
+			reaction.SenderJID = senderJID(reaction.SenderJID)
+			reaction.Timestamp = reaction.Timestamp.In(display.location)
+			output.Reactions = append(output.Reactions, reaction)
+		}
+		return output
+	}
+
+	result := &messagesResult{Messages: []matchOutput{}}
+	for _, group := range groups {
+		match := matchOutput{messageOutput: convert(group.Message)}
+		for _, msg := range group.Before {
+			match.ContextBefore = append(match.ContextBefore, convert(msg))
+		}
+		for _, msg := range group.After {
+			match.ContextAfter = append(match.ContextAfter, convert(msg))
+		}
+		result.Messages = append(result.Messages, match)
+	}
+	return result, nil
+}
+
+// messageKey identifies a message; message IDs are only unique within a chat
+type messageKey struct {
+	id      string
+	chatJID string
+}
+
+// messageDetails is what the structured output adds to a message row
+type messageDetails struct {
+	text          string
+	media         *mediaOutput
+	replyTo       *replyOutput
+	replyIsFromMe bool
+	reactions     []reactionOutput
+}
+
+// loadMessageDetails loads the full text, media, quoted message and reactions of messages.
+// Sender fields hold the stored sender until buildMessagesResult resolves them.
+func loadMessageDetails(keys []messageKey) (map[messageKey]*messageDetails, error) {
+	details := make(map[messageKey]*messageDetails)
+	if len(keys) == 0 {
+		return details, nil
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// Stay well below SQLite's limit on query parameters
+	const batchSize = 200
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := loadMessageDetailsBatch(db, keys[start:end], details); err != nil {
+			return nil, err
+		}
+	}
+	return details, nil
+}
+
+func loadMessageDetailsBatch(db *sql.DB, keys []messageKey, details map[messageKey]*messageDetails) error {
+	conditions := make([]string, len(keys))
+	params := make([]interface{}, 0, 2*len(keys))
+	for i, key := range keys {
+		conditions[i] = "(m.id = ? AND m.chat_jid = ?)"
+		params = append(params, key.id, key.chatJID)
+	}
+	where := strings.Join(conditions, " OR ")
+
+	rows, err := db.Query(`
+		SELECT m.id, m.chat_jid, COALESCE(m.content, ''), COALESCE(m.media_type, ''), COALESCE(m.filename, ''),
+			COALESCE(m.mimetype, ''), COALESCE(m.file_length, 0), COALESCE(m.width, 0), COALESCE(m.height, 0),
+			COALESCE(m.duration, 0), COALESCE(m.caption, ''), COALESCE(m.reply_to_id, ''),
+			q.sender, q.is_from_me, COALESCE(NULLIF(q.content, ''), NULLIF(q.caption, ''), q.filename, '')
+		FROM messages m
+		LEFT JOIN messages q ON q.id = m.reply_to_id AND q.chat_jid = m.chat_jid
+		WHERE `+where, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key messageKey
+		detail := &messageDetails{}
+		var media mediaOutput
+		var replyToID string
+		var quotedSender, quotedText sql.NullString
+		var quotedFromMe sql.NullBool
+		if err := rows.Scan(&key.id, &key.chatJID, &detail.text, &media.Type, &media.Filename,
+			&media.Mimetype, &media.Size, &media.Width, &media.Height,
+			&media.Duration, &media.Caption, &replyToID,
+			&quotedSender, &quotedFromMe, &quotedText); err != nil {
+			return err
+		}
+
+		if media.Type != "" {
+			detail.media = &media
+		}
+		if replyToID != "" {
+			detail.replyTo = &replyOutput{ID: replyToID}
+			if quotedSender.Valid {
+				detail.replyTo.SenderJID = quotedSender.String
+				detail.replyTo.Text = truncateText(quotedText.String, 200)
+				detail.replyIsFromMe = quotedFromMe.Bool
+			}
+		}
+		details[key] = detail
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	reactionRows, err := db.Query(`
+		SELECT m.message_id, m.chat_jid, m.emoji, m.sender, m.is_from_me, m.timestamp
+		FROM message_reactions m
+		WHERE `+strings.ReplaceAll(where, "m.id", "m.message_id")+`
+		ORDER BY m.timestamp`, params...)
+	if err != nil {
+		return err
+	}
+	defer reactionRows.Close()
+
+	for reactionRows.Next() {
+		var key messageKey
+		var reaction reactionOutput
+		if err := reactionRows.Scan(&key.id, &key.chatJID, &reaction.Emoji, &reaction.SenderJID, &reaction.IsFromMe, &reaction.Timestamp); err != nil {
+			return err
+		}
+		if detail := details[key]; detail != nil {
+			detail.reactions = append(detail.reactions, reaction)
+		}
+	}
+	return reactionRows.Err()
+}
+
+// formatMessagesMarkdown renders a result as markdown
+func formatMessagesMarkdown(result *messagesResult, display timeDisplay, options renderOptions) string {
+	var b strings.Builder
+	for _, note := range options.notes {
+		fmt.Fprintf(&b, "> %s\n", note)
+	}
+	if len(options.dates) > 0 {
+		fmt.Fprintf(&b, "> Dates: %s\n", strings.Join(options.dates, "; "))
+	}
+	// Transcripts start with a day heading, which adds its own blank line
+	if b.Len() > 0 && (!options.transcript || len(result.Messages) == 0) {
+		b.WriteString("\n")
+	}
+	if len(result.Messages) == 0 {
+		b.WriteString("_No messages to display._\n")
+		writePageLinksMarkdown(&b, options.links)
+		return b.String()
+	}
+
+	blocks, grouped := messageBlocks(result, display)
+	lastDay := ""
+	for i, block := range blocks {
+		if grouped && i > 0 {
+			b.WriteString("\n---\n")
+			lastDay = ""
+		}
+		for _, entry := range block {
+			first := entry.messages[0]
+			if options.transcript {
+				if day := display.day(first.Timestamp); day != lastDay {
+					if b.Len() > 0 {
+						b.WriteString("\n")
+					}
+					fmt.Fprintf(&b, "#### %s\n\n", day)
+					lastDay = day
+				}
+			}
+			if len(entry.messages) == 1 {
+				writeMessageMarkdown(&b, first, grouped && entry.isMatch, display, options)
+				continue
+			}
+			fmt.Fprintf(&b, "- **%s** %s", escapeMarkdown(first.SenderName), markdownTime(first, display, options))
+			if options.showChatInfo && first.ChatName != "" {
+				fmt.Fprintf(&b, " in _%s_", escapeMarkdown(first.ChatName))
+			}
+			fmt.Fprintf(&b, ": 📎 %s (messages `%s` in chat `%s`)\n", describeMedia(entry.messages), strings.Join(messageIDs(entry.messages), "`, `"), first.ChatJID)
+		}
+	}
+	if result.Omitted > 0 {
+		fmt.Fprintf(&b, "\n_%s_\n", omittedNote(result.Omitted, "messages", options))
+	}
+	writePageLinksMarkdown(&b, options.links)
+	return b.String()
+}
+
+// writePageLinksMarkdown lists the cursors to the pages around a markdown result
+func writePageLinksMarkdown(b *strings.Builder, links pageLinks) {
+	if links.NextCursor != "" {
+		fmt.Fprintf(b, "\nNext page: cursor `%s`\n", links.NextCursor)
+	}
+	if links.PrevCursor != "" {
+		fmt.Fprintf(b, "\nPrevious page: cursor `%s`\n", links.PrevCursor)
+	}
+}
+
+// writeMessageMarkdown renders one message as a list item
+func writeMessageMarkdown(b *strings.Builder, msg messageOutput, isMatch bool, display timeDisplay, options renderOptions) {
+	when := markdownTime(msg, display, options)
+
+	marker := "-"
+	if isMatch {
+		marker = "- ▶"
+	}
+	fmt.Fprintf(b, "%s **%s** %s", marker, escapeMarkdown(msg.SenderName), when)
+	if options.showChatInfo && msg.ChatName != "" {
+		fmt.Fprintf(b, " in _%s_", escapeMarkdown(msg.ChatName))
+	}
+
+	text := msg.Text
+	if msg.Snippet != "" {
+		text = msg.Snippet
+	}
+	if text != "" {
+		fmt.Fprintf(b, ": %s", strings.ReplaceAll(text, "\n", "\n  "))
+	}
+	b.WriteString("\n")
+
+	if msg.ReplyTo != nil {
+		if msg.ReplyTo.SenderName != "" {
+			fmt.Fprintf(b, "  - ↩ replying to **%s**: %s\n", escapeMarkdown(msg.ReplyTo.SenderName), strings.ReplaceAll(msg.ReplyTo.Text, "\n", " "))
+		} else {
+			fmt.Fprintf(b, "  - ↩ replying to message `%s`\n", msg.ReplyTo.ID)
+		}
+	}
+	if msg.Media != nil {
+		fmt.Fprintf(b, "  - 📎 %s", msg.Media.Type)
+		if msg.Media.Filename != "" {
+			fmt.Fprintf(b, " `%s`", msg.Media.Filename)
+		}
+		fmt.Fprintf(b, " (message `%s`, chat `%s`)", msg.ID, msg.ChatJID)
+		if msg.Media.Caption != "" && msg.Media.Caption != text {
+			fmt.Fprintf(b, ": %s", msg.Media.Caption)
+		}
+		b.WriteString("\n")
+	}
+	if len(msg.Reactions) > 0 {
+		reactions := make([]string, len(msg.Reactions))
+		for i, reaction := range msg.Reactions {
+			reactions[i] = reaction.Emoji + " " + escapeMarkdown(reaction.SenderName)
+		}
+		fmt.Fprintf(b, "  - %s\n", strings.Join(reactions, ", "))
+	}
+}
+
+// markdownTime is the time shown with a message in markdown; transcripts already have day headings
+func markdownTime(msg messageOutput, display timeDisplay, options renderOptions) string {
+	if options.transcript {
+		return msg.Timestamp.Format("15:04")
+	}
+	return display.timestamp(msg.Timestamp)
+}
+
+// escapeMarkdown escapes the characters that would change the formatting of a name
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer(`*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// senderJID turns a stored sender, which is either a JID or just the user part of one,
+// into a JID
+func senderJID(sender string) string {
+	if sender == "" || strings.Contains(sender, "@") {
+		return sender
+	}
+	return sender + "@s.whatsapp.net"
+}
+
+// truncateText shortens text to at most max runes
+func truncateText(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
+}
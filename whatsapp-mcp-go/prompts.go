@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Limits of the prompts that cover several chats
+const (
+	promptMinChatChars  = 1000 // the smallest share of the budget a chat's transcript gets
+	promptMaxTranscript = 10   // chats whose messages are included
+	promptMaxListed     = 40   // chats listed with their message counts
+)
+
+// registerPrompts adds prompts for common workflows, filled in from the database
+func registerPrompts(s *server.MCPServer) {
+	s.AddPrompt(mcp.NewPrompt("summarize_chat",
+		mcp.WithPromptDescription("Summarize a chat over a period: what it was about, decisions, open questions and what needs my reply"),
+		mcp.WithArgument("chat", mcp.RequiredArgument(), mcp.ArgumentDescription("Chat name, phone number or JID")),
+		mcp.WithArgument("since", mcp.ArgumentDescription("Date or time to start at, e.g. yesterday, \"3 days ago\" or 2026-03-01 (default: the past 24 hours)")),
+	), summarizeChatPrompt)
+	s.AddPrompt(mcp.NewPrompt("draft_reply",
+		mcp.WithPromptDescription("Draft my next message in a chat, in the tone of the conversation, without sending it"),
+		mcp.WithArgument("chat", mcp.RequiredArgument(), mcp.ArgumentDescription("Chat name, phone number or JID")),
+		mcp.WithArgument("intent", mcp.ArgumentDescription("What the reply should say or achieve, e.g. \"decline politely\"")),
+	), draftReplyPrompt)
+	s.AddPrompt(mcp.NewPrompt("catch_up",
+		mcp.WithPromptDescription("Catch up on all chats with new messages: what happened and what needs my attention first"),
+		mcp.WithArgument("since", mcp.ArgumentDescription("Date or time to catch up from, e.g. \"this morning\" or yesterday (default: the past 24 hours)")),
+	), catchUpPrompt)
+	s.AddPrompt(mcp.NewPrompt("extract_action_items",
+		mcp.WithPromptDescription("List the tasks, commitments and deadlines agreed in a chat, with owners"),
+		mcp.WithArgument("chat", mcp.RequiredArgument(), mcp.ArgumentDescription("Chat name, phone number or JID")),
+		mcp.WithArgument("range", mcp.ArgumentDescription("Period to look at, e.g. \"this week\", \"last month\" or \"past 3 days\" (default: the past 7 days)")),
+	), extractActionItemsPrompt)
+	s.AddPrompt(mcp.NewPrompt("weekly_digest",
+		mcp.WithPromptDescription("A digest of the past week across all chats: highlights, decisions and open threads per chat"),
+		mcp.WithArgument("range", mcp.ArgumentDescription("Period to cover instead of the past 7 days, e.g. \"last week\"")),
+	), weeklyDigestPrompt)
+}
+
+func summarizeChatPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+	chat, err := promptChat(ctx, request.Params.Arguments["chat"])
+	if err != nil {
+		return nil, err
+	}
+	window, err := promptWindow("since", "after", request.Params.Arguments["since"], defaultConversationWindow, display)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript, err := promptTranscript(chat, window, defaultMaxChars, display)
+	if err != nil {
+		return nil, err
+	}
+	return promptResult(fmt.Sprintf("Summary of %s", chatTitle(chat)),
+		"Summarize this WhatsApp conversation. Start with two or three sentences on what it was about. "+
+			"Then list the decisions made, the open questions, and anything that needs my attention or a reply from me. "+
+			"Refer to people by name. Messages from \"Me\" are mine.",
+		transcript), nil
+}
+
+func draftReplyPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+	chat, err := promptChat(ctx, request.Params.Arguments["chat"])
+	if err != nil {
+		return nil, err
+	}
+	window, err := promptWindow("range", "after", "", "past 7 days", display)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript, err := promptTranscript(chat, window, defaultMaxChars/2, display)
+	if err != nil {
+		return nil, err
+	}
+	instructions := "Draft my next WhatsApp message in this conversation. Answer what is still open for me, and match the language, tone and length of my earlier messages. Messages from \"Me\" are mine."
+	if intent := request.Params.Arguments["intent"]; intent != "" {
+		instructions += fmt.Sprintf(" The reply should: %s.", strings.TrimSuffix(intent, "."))
+	}
+	instructions += fmt.Sprintf(" Show me the draft and don't send it. If I approve it, send it with send_message to %s.", chat.JID)
+	return promptResult(fmt.Sprintf("Reply to %s", chatTitle(chat)), instructions, transcript), nil
+}
+
+func catchUpPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+	window, err := promptWindow("since", "after", request.Params.Arguments["since"], defaultConversationWindow, display)
+	if err != nil {
+		return nil, err
+	}
+
+	chats, err := activeChats(ctx, window.After, window.Before)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	// Only chats where someone else wrote need catching up on
+	var incoming []chatActivity
+	for _, activity := range chats {
+		if activity.messages > activity.mine {
+			incoming = append(incoming, activity)
+		}
+	}
+
+	content, err := promptChats(incoming, window, display)
+	if err != nil {
+		return nil, err
+	}
+	return promptResult("Catch up on WhatsApp",
+		"Catch me up on these WhatsApp chats. Put first what needs my reply or action, with who is waiting and since when. "+
+			"Then summarize the rest in a line or two per chat, and skip chats with nothing of substance. Messages from \"Me\" are mine.",
+		content), nil
+}
+
+func extractActionItemsPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+	chat, err := promptChat(ctx, request.Params.Arguments["chat"])
+	if err != nil {
+		return nil, err
+	}
+	window, err := promptWindow("range", "during", request.Params.Arguments["range"], "past 7 days", display)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript, err := promptTranscript(chat, window, defaultMaxChars, display)
+	if err != nil {
+		return nil, err
+	}
+	return promptResult(fmt.Sprintf("Action items in %s", chatTitle(chat)),
+		"List the action items in this WhatsApp conversation: tasks, promises and requests that someone agreed to or was asked to do. "+
+			"For each give the owner, the deadline if one was mentioned, whether it looks done, and the time of the message it comes from. "+
+			"Put my own items first. Messages from \"Me\" are mine. If there are none, say so.",
+		transcript), nil
+}
+
+func weeklyDigestPrompt(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+	window, err := promptWindow("range", "during", request.Params.Arguments["range"], "past 7 days", display)
+	if err != nil {
+		return nil, err
+	}
+
+	chats, err := activeChats(ctx, window.After, window.Before)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	// The busiest chats get their messages included
+	sort.SliceStable(chats, func(i, j int) bool { return chats[i].messages > chats[j].messages })
+
+	content, err := promptChats(chats, window, display)
+	if err != nil {
+		return nil, err
+	}
+	return promptResult("WhatsApp digest",
+		"Write a digest of my WhatsApp chats over this period. Start with the overall highlights. "+
+			"Then give a short section per chat that matters, with what happened, the decisions and the open threads. "+
+			"End with what I still need to follow up on. Messages from \"Me\" are mine.",
+		content), nil
+}
+
+// promptResult builds a prompt of one user message: the instructions followed by the data
+func promptResult(description, instructions, content string) *mcp.GetPromptResult {
+	return mcp.NewGetPromptResult(description, []mcp.PromptMessage{
+		mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(instructions+"\n\n"+content)),
+	})
+}
+
+// promptChat looks up the chat of a prompt, which the client must have access to
+func promptChat(ctx context.Context, value string) (*Chat, error) {
+	chat, err := findChat(value, clientFromContext(ctx).allowedChats())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkChatAccess(ctx, chat.JID); err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
+
+// promptWindow reads the time window of a prompt from an argument, or from defaultValue if
+// it isn't given. operator is the list_messages operator the argument works like.
+func promptWindow(name, operator, value, defaultValue string, display timeDisplay) (*searchQuery, error) {
+	if value == "" {
+		value = defaultValue
+	}
+	window := &searchQuery{}
+	if err := window.addDateFilter(operator, value, display.now); err != nil {
+		return nil, fmt.Errorf("invalid '%s': %v", name, err)
+	}
+	if err := window.checkDates(); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// promptTranscript formats the latest messages of a chat in a window, within maxChars
+func promptTranscript(chat *Chat, window *searchQuery, maxChars int, display timeDisplay) (string, error) {
+	chunk, omitted, err := latestConversation(chat.JID, window.After, window.Before, newOutputBudget(maxChars), display)
+	if err != nil {
+		return "", fmt.Errorf("database error: %v", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Chat: %s\n", chatTitle(chat))
+	if len(window.Dates) > 0 {
+		fmt.Fprintf(&b, "Period: %s\n", strings.Join(window.Dates, "; "))
+	}
+	if omitted > 0 {
+		fmt.Fprintf(&b, "(%d earlier messages in this period are left out, get_conversation can read them)\n", omitted)
+	}
+	if len(chunk.lines) == 0 {
+		b.WriteString("No messages in this period.\n")
+	}
+	lastDay := ""
+	for i, match := range chunk.result.Messages {
+		if day := display.day(match.Timestamp); day != lastDay {
+			fmt.Fprintf(&b, "--- %s ---\n", day)
+			lastDay = day
+		}
+		b.WriteString(chunk.lines[i])
+	}
+	return b.String(), nil
+}
+
+// promptChats lists the active chats of a window with their message counts, followed by the
+// transcripts of the first ones, which share the budget
+func promptChats(chats []chatActivity, window *searchQuery, display timeDisplay) (string, error) {
+	var b strings.Builder
+	if len(window.Dates) > 0 {
+		fmt.Fprintf(&b, "Period: %s\n", strings.Join(window.Dates, "; "))
+	}
+	if len(chats) == 0 {
+		b.WriteString("No chats have messages in this period.\n")
+		return b.String(), nil
+	}
+
+	fmt.Fprintf(&b, "%d chats have messages in this period:\n", len(chats))
+	for i, activity := range chats {
+		if i == promptMaxListed {
+			fmt.Fprintf(&b, "- and %d more\n", len(chats)-i)
+			break
+		}
+		fmt.Fprintf(&b, "- %s: %d messages, %d from me, the last %s\n", chatTitle(&activity.chat), activity.messages, activity.mine, display.timestamp(activity.last))
+	}
+
+	transcripts := chats
+	if len(transcripts) > promptMaxTranscript {
+		transcripts = transcripts[:promptMaxTranscript]
+	}
+	maxChars := defaultMaxChars / len(transcripts)
+	if maxChars < promptMinChatChars {
+		maxChars = promptMinChatChars
+	}
+	for _, activity := range transcripts {
+		transcript, err := promptTranscript(&activity.chat, window, maxChars, display)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("\n" + transcript)
+	}
+	if len(chats) > len(transcripts) {
+		fmt.Fprintf(&b, "\nThe messages of the other %d chats are left out, get_conversation can read them.\n", len(chats)-len(transcripts))
+	}
+	return b.String(), nil
+}
+
+// chatActivity is how much a chat was used in a period
+type chatActivity struct {
+	chat     Chat
+	messages int
+	mine     int
+	last     time.Time
+}
+
+// activeChats returns the chats the client of ctx may access with messages between after
+// and before, most recently active first
+func activeChats(ctx context.Context, after, before *time.Time) ([]chatActivity, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var whereClauses []string
+	var params []interface{}
+	if after != nil {
+		whereClauses = append(whereClauses, "messages.timestamp >= ?")
+		params = append(params, after.UTC())
+	}
+	if before != nil {
+		whereClauses = append(whereClauses, "messages.timestamp < ?")
+		params = append(params, before.UTC())
+	}
+	where := ""
+	if len(whereClauses) > 0 {
+		where = "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+
+	rows, err := db.Query(`
+		SELECT chats.jid, chats.name, COUNT(*), SUM(messages.is_from_me), MAX(messages.timestamp)
+		FROM messages
+		JOIN chats ON messages.chat_jid = chats.jid
+		`+where+`
+		GROUP BY chats.jid
+		ORDER BY MAX(messages.timestamp) DESC`, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []chatActivity
+	for rows.Next() {
+		var activity chatActivity
+		var name *string
+		var last string
+		if err := rows.Scan(&activity.chat.JID, &name, &activity.messages, &activity.mine, &last); err != nil {
+			return nil, err
+		}
+		if !clientFromContext(ctx).canAccess(activity.chat.JID) {
+			continue
+		}
+		activity.chat.Name = name
+		// MAX() loses the column type, so the time comes back in the format it's stored in
+		activity.last, err = time.Parse("2006-01-02 15:04:05.999999999-07:00", last)
+		if err != nil {
+			if activity.last, err = time.Parse(time.RFC3339, last); err != nil {
+				return nil, err
+			}
+		}
+		chats = append(chats, activity)
+	}
+	return chats, rows.Err()
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// searchQuery is the parsed form of a list_messages q string such as
+//
+//	from:alice in:"Project X" has:image after:yesterday is:reply "exact phrase" -excluded
+//
+// Names are kept as written; resolveMessageFilter turns them into JIDs. Dates are resolved
+// when parsing.
+type searchQuery struct {
+	Terms    []string // words and phrases that must appear
+	Excluded []string // words and phrases that must not appear
+	From     []string // sender names, phone numbers, JIDs or "me"
+	In       []string // chat names, phone numbers or JIDs
+	Has      []string // media types, "media" or "link"
+	Is       []string // from_me, to_me, reply, group, direct
+	Before   *time.Time
+	After    *time.Time
+	Dates    []string // how each date was read, to echo back to the caller
+
+	// Contains holds substrings from the deprecated query parameter of list_messages
+	Contains []string
+
+	// Within limits the results to these chat JIDs, for clients that may only access them
+	Within []string
+}
+
+// Values accepted by the has: and is: operators
+var (
+	searchHasValues = []string{"image", "video", "audio", "document", "sticker", "media", "link"}
+	searchIsValues  = []string{"from_me", "to_me", "reply", "group", "direct"}
+)
+
+// searchQuerySyntax is shown in errors and the tool description
+const searchQuerySyntax = `words and "exact phrases" must all match, -word excludes; ` +
+	`from:<name|phone|me> in:<chat name|phone|jid> has:<image|video|audio|document|sticker|media|link> ` +
+	`is:<from_me|to_me|reply|group|direct> after:<date> before:<date> during:<period>; ` +
+	`dates can be e.g. ` + dateExpressionHelp + `, quote them when they contain spaces`
+
+// parseSearchQuery parses a q string. Relative dates are resolved against now, in now's timezone.
+func parseSearchQuery(q string, now time.Time) (*searchQuery, error) {
+	tokens, err := tokenizeSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &searchQuery{}
+	for _, token := range tokens {
+		if token.operator == "" {
+			if token.negated {
+				query.Excluded = append(query.Excluded, token.value)
+			} else {
+				query.Terms = append(query.Terms, token.value)
+			}
+			continue
+		}
+
+		if token.negated {
+			return nil, fmt.Errorf("-%s: is not supported, only words and phrases can be excluded", token.operator)
+		}
+		if token.value == "" {
+			return nil, fmt.Errorf("%s: needs a value", token.operator)
+		}
+
+		switch token.operator {
+		case "from":
+			query.From = append(query.From, token.value)
+		case "in":
+			query.In = append(query.In, token.value)
+		case "has":
+			value := strings.ToLower(token.value)
+			if !containsString(searchHasValues, value) {
+				return nil, fmt.Errorf("has:%s is not supported, use one of %s", token.value, strings.Join(searchHasValues, ", "))
+			}
+			query.Has = append(query.Has, value)
+		case "is":
+			value := strings.ToLower(strings.ReplaceAll(token.value, "-", "_"))
+			if !containsString(searchIsValues, value) {
+				return nil, fmt.Errorf("is:%s is not supported, use one of %s", token.value, strings.Join(searchIsValues, ", "))
+			}
+			query.Is = append(query.Is, value)
+		case "before", "after", "during":
+			if err := query.addDateFilter(token.operator, token.value, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := query.checkDates(); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// addDateFilter narrows the query's time window by an after:, before: or during: filter
+func (q *searchQuery) addDateFilter(operator, value string, now time.Time) error {
+	after, before, note, err := parseDateFilter(operator, value, now)
+	if err != nil {
+		return fmt.Errorf("%s: %v", operator, err)
+	}
+	if after != nil && (q.After == nil || after.After(*q.After)) {
+		q.After = after
+	}
+	if before != nil && (q.Before == nil || before.Before(*q.Before)) {
+		q.Before = before
+	}
+	q.Dates = append(q.Dates, note)
+	return nil
+}
+
+// checkDates rejects a time window that can't contain any message
+func (q *searchQuery) checkDates() error {
+	if q.Before != nil && q.After != nil && !q.After.Before(*q.Before) {
+		return fmt.Errorf("the time window is empty: %s", strings.Join(q.Dates, ", "))
+	}
+	return nil
+}
+
+// searchToken is one word, phrase or operator of a q string
+type searchToken struct {
+	operator string // "" for plain words and phrases
+	value    string
+	negated  bool
+}
+
+// searchOperators are the operators recognised before a colon. Anything else with a colon,
+// such as a URL, is treated as a plain word.
+var searchOperators = []string{"from", "in", "has", "is", "before", "after", "during"}
+
+// tokenizeSearchQuery splits a q string into words, quoted phrases and operators
+func tokenizeSearchQuery(q string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(q)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var token searchToken
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			token.negated = true
+			i++
+		}
+
+		// An operator is a known name followed by a colon
+		start := i
+		for i < len(runes) && (unicode.IsLetter(runes[i]) || runes[i] == '_') {
+			i++
+		}
+		if i < len(runes) && runes[i] == ':' && containsString(searchOperators, strings.ToLower(string(runes[start:i]))) {
+			token.operator = strings.ToLower(string(runes[start:i]))
+			i++
+		} else {
+			i = start
+		}
+
+		// The value is either a quoted phrase or runs until the next space
+		if i < len(runes) && runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated quote in %q", q)
+			}
+			token.value = string(runes[i+1 : end])
+			i = end + 1
+		} else {
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			token.value = string(runes[start:i])
+		}
+
+		if token.operator == "" && strings.TrimSpace(token.value) == "" {
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// messageFilter is a search query with names resolved, ready to be turned into SQL
+type messageFilter struct {
+	Terms      []string
+	Excluded   []string
+	Contains   []string // substrings matched with LIKE (the deprecated query parameter)
+	Senders    [][]string
+	ChatJIDs   []string
+	Within     []string
+	MediaTypes []string
+	HasMedia   bool
+	HasLink    bool
+	FromMe     *bool
+	IsReply    bool
+	IsGroup    *bool
+	Before     *time.Time
+	After      *time.Time
+}
+
+// resolveMessageFilter resolves the names in a parsed query through contacts and chats
+func resolveMessageFilter(db *sql.DB, query *searchQuery) (*messageFilter, error) {
+	filter := &messageFilter{
+		Terms:    query.Terms,
+		Excluded: query.Excluded,
+		Contains: query.Contains,
+		Within:   query.Within,
+		Before:   query.Before,
+		After:    query.After,
+	}
+
+	fromMe := false
+	var senders []string
+	for _, from := range query.From {
+		if strings.EqualFold(from, "me") {
+			fromMe = true
+			continue
+		}
+		jid, err := resolveContact(db, from, query.Within)
+		if err != nil {
+			return nil, fmt.Errorf("from:%s: %v", from, err)
+		}
+		senders = append(senders, jid)
+	}
+	switch {
+	case fromMe && len(senders) == 0:
+		filter.FromMe = boolPtr(true)
+	case fromMe:
+		return nil, fmt.Errorf("from:me can't be combined with other senders")
+	case len(senders) > 0:
+		// The bridge stores either the full JID or just the user part as the sender
+		for _, jid := range senders {
+			filter.Senders = append(filter.Senders, []string{jid, strings.Split(jid, "@")[0]})
+		}
+	}
+
+	for _, in := range query.In {
+		jid, err := resolveChat(db, in, query.Within)
+		if err != nil {
+			return nil, fmt.Errorf("in:%s: %v", in, err)
+		}
+		filter.ChatJIDs = append(filter.ChatJIDs, jid)
+	}
+
+	for _, has := range query.Has {
+		switch has {
+		case "media":
+			filter.HasMedia = true
+		case "link":
+			filter.HasLink = true
+		default:
+			filter.MediaTypes = append(filter.MediaTypes, has)
+		}
+	}
+
+	for _, is := range query.Is {
+		switch is {
+		case "from_me", "to_me":
+			value := is == "from_me"
+			if filter.FromMe != nil && *filter.FromMe != value {
+				return nil, fmt.Errorf("is:from_me and is:to_me (or from:) contradict each other")
+			}
+			filter.FromMe = &value
+		case "reply":
+			filter.IsReply = true
+		case "group", "direct":
+			value := is == "group"
+			if filter.IsGroup != nil && *filter.IsGroup != value {
+				return nil, fmt.Errorf("is:group and is:direct contradict each other")
+			}
+			filter.IsGroup = &value
+		}
+	}
+	return filter, nil
+}
+
+// resolveContact turns a contact name, phone number or JID into a JID. A non-empty within
+// limits names to those chat JIDs, so other chats are neither matched nor listed.
+func resolveContact(db *sql.DB, value string, within []string) (string, error) {
+	value = labelJID(value)
+	if strings.Contains(value, "@") {
+		return value, nil
+	}
+	condition, params := nameCondition("jid NOT LIKE '%@g.us'", within)
+	if phone := normalizePhoneNumber(value); phone != "" {
+		if jid, err := exactName(db, value, condition, params); err != nil || jid != "" {
+			return jid, err
+		}
+		return phone + "@s.whatsapp.net", nil
+	}
+	return resolveName(db, value, "contact", condition, params)
+}
+
+// resolveChat turns a chat name, phone number or JID into a chat JID. A non-empty within
+// limits names to those chat JIDs, so other chats are neither matched nor listed.
+func resolveChat(db *sql.DB, value string, within []string) (string, error) {
+	value = labelJID(value)
+	if strings.Contains(value, "@") {
+		return value, nil
+	}
+	condition, params := nameCondition("1 = 1", within)
+	if phone := normalizePhoneNumber(value); phone != "" {
+		if jid, err := exactName(db, value, condition, params); err != nil || jid != "" {
+			return jid, err
+		}
+		return phone + "@s.whatsapp.net", nil
+	}
+	return resolveName(db, value, "chat", condition, params)
+}
+
+// nameCondition adds the limit to the chats in within, if any, to the condition names are
+// looked up with
+func nameCondition(condition string, within []string) (string, []interface{}) {
+	if len(within) == 0 {
+		return condition, nil
+	}
+	clause, params := chatsIn("jid", within)
+	return condition + " AND " + clause, params
+}
+
+// exactName returns the JID of the only chat named exactly value, or "" if there is none.
+// Names made of digits, such as a group called "2024 2025", win over reading them as a
+// phone number.
+func exactName(db *sql.DB, value, condition string, params []interface{}) (string, error) {
+	rows, err := db.Query("SELECT jid FROM chats WHERE LOWER(name) = LOWER(?) AND "+condition+" LIMIT 2", append([]interface{}{value}, params...)...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var jids []string
+	for rows.Next() {
+		var jid string
+		if err := rows.Scan(&jid); err != nil {
+			return "", err
+		}
+		jids = append(jids, jid)
+	}
+	if len(jids) != 1 {
+		return "", rows.Err()
+	}
+	return jids[0], rows.Err()
+}
+
+// labelJID returns the JID of a chat written as "Name (jid)", the way chats are shown and
+// suggested, or value unchanged if it isn't written like that
+func labelJID(value string) string {
+	value = strings.TrimSpace(value)
+	open := strings.LastIndex(value, " (")
+	if open < 0 || !strings.HasSuffix(value, ")") {
+		return value
+	}
+	if jid := value[open+2 : len(value)-1]; strings.Contains(jid, "@") && !strings.ContainsAny(jid, " ()") {
+		return jid
+	}
+	return value
+}
+
+// resolveName finds the chat whose name matches value: an exact (case-insensitive) match
+// wins, otherwise the name must be contained in exactly one chat name
+func resolveName(db *sql.DB, value, kind, condition string, params []interface{}) (string, error) {
+	for _, match := range []struct{ clause, arg string }{
+		{"LOWER(name) = LOWER(?)", value},
+		{"LOWER(name) LIKE LOWER(?)", "%" + value + "%"},
+	} {
+		rows, err := db.Query(
+			"SELECT jid, name FROM chats WHERE "+match.clause+" AND "+condition+" ORDER BY last_message_time DESC LIMIT 6",
+			append([]interface{}{match.arg}, params...)...,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		var candidates []string
+		var jid string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&jid, &name); err != nil {
+				rows.Close()
+				return "", err
+			}
+			candidates = append(candidates, fmt.Sprintf("%s (%s)", name, jid))
+		}
+		rows.Close()
+
+		switch {
+		case len(candidates) == 1:
+			return jid, nil
+		case len(candidates) > 1:
+			more := ""
+			if len(candidates) > 5 {
+				candidates, more = candidates[:5], ", ..."
+			}
+			return "", fmt.Errorf("%q matches several %ss: %s%s; use a more specific name, the phone number or the JID", value, kind, strings.Join(candidates, ", "), more)
+		}
+	}
+	return "", fmt.Errorf("no %s named %q", kind, value)
+}
+
+// normalizePhoneNumber returns the digits of value if it looks like a phone number, or ""
+func normalizePhoneNumber(value string) string {
+	var digits strings.Builder
+	for _, r := range value {
+		switch {
+		case unicode.IsDigit(r):
+			digits.WriteRune(r)
+		case r == '+' || r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return ""
+		}
+	}
+	if digits.Len() < 5 {
+		return ""
+	}
+	return digits.String()
+}
+
+// whereClauses turns the filter into SQL conditions on the messages and chats tables.
+// Terms use the FTS5 index when useFTS is set and substring matching otherwise.
+func (f *messageFilter) whereClauses(useFTS bool) ([]string, []interface{}) {
+	var clauses []string
+	var params []interface{}
+
+	// Timestamps are stored in UTC and compared as text
+	if f.After != nil {
+		clauses = append(clauses, "messages.timestamp >= ?")
+		params = append(params, f.After.UTC())
+	}
+	if f.Before != nil {
+		clauses = append(clauses, "messages.timestamp < ?")
+		params = append(params, f.Before.UTC())
+	}
+
+	if len(f.Senders) > 0 {
+		var senderClauses []string
+		for _, sender := range f.Senders {
+			senderClauses = append(senderClauses, "messages.sender IN (?, ?)")
+			params = append(params, sender[0], sender[1])
+		}
+		clauses = append(clauses, "("+strings.Join(senderClauses, " OR ")+")")
+	}
+	if f.FromMe != nil {
+		clauses = append(clauses, "messages.is_from_me = ?")
+		params = append(params, *f.FromMe)
+	}
+
+	if len(f.ChatJIDs) > 0 {
+		clause, jids := chatsIn("messages.chat_jid", f.ChatJIDs)
+		clauses = append(clauses, clause)
+		params = append(params, jids...)
+	}
+	if len(f.Within) > 0 {
+		clause, jids := chatsIn("messages.chat_jid", f.Within)
+		clauses = append(clauses, clause)
+		params = append(params, jids...)
+	}
+	if f.IsGroup != nil {
+		if *f.IsGroup {
+			clauses = append(clauses, "messages.chat_jid LIKE '%@g.us'")
+		} else {
+			clauses = append(clauses, "messages.chat_jid NOT LIKE '%@g.us'")
+		}
+	}
+
+	if len(f.MediaTypes) > 0 {
+		clauses = append(clauses, "messages.media_type IN (?"+strings.Repeat(", ?", len(f.MediaTypes)-1)+")")
+		for _, mediaType := range f.MediaTypes {
+			params = append(params, mediaType)
+		}
+	}
+	if f.HasMedia {
+		clauses = append(clauses, "COALESCE(messages.media_type, '') != ''")
+	}
+	if f.HasLink {
+		clauses = append(clauses, "(messages.content LIKE '%http://%' OR messages.content LIKE '%https://%' OR messages.caption LIKE '%http://%' OR messages.caption LIKE '%https://%')")
+	}
+	if f.IsReply {
+		clauses = append(clauses, "COALESCE(messages.reply_to_id, '') != ''")
+	}
+
+	for _, contains := range f.Contains {
+		clauses = append(clauses, "LOWER(messages.content) LIKE LOWER(?)")
+		params = append(params, "%"+contains+"%")
+	}
+
+	if useFTS {
+		if len(f.Terms) > 0 {
+			clauses = append(clauses, "messages.rowid IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)")
+			params = append(params, strings.Join(quoteFTSPhrases(f.Terms), " "))
+		}
+		if len(f.Excluded) > 0 {
+			clauses = append(clauses, "messages.rowid NOT IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)")
+			params = append(params, strings.Join(quoteFTSPhrases(f.Excluded), " OR "))
+		}
+	} else {
+		for _, term := range f.Terms {
+			clauses = append(clauses, "(LOWER(messages.content) LIKE LOWER(?) OR LOWER(messages.caption) LIKE LOWER(?) OR LOWER(messages.filename) LIKE LOWER(?))")
+			params = append(params, "%"+term+"%", "%"+term+"%", "%"+term+"%")
+		}
+		for _, term := range f.Excluded {
+			clauses = append(clauses, "NOT (LOWER(COALESCE(messages.content, '')) LIKE LOWER(?) OR LOWER(COALESCE(messages.caption, '')) LIKE LOWER(?) OR LOWER(COALESCE(messages.filename, '')) LIKE LOWER(?))")
+			params = append(params, "%"+term+"%", "%"+term+"%", "%"+term+"%")
+		}
+	}
+
+	return clauses, params
+}
+
+// usesFTS reports whether the filter has words or phrases to match
+func (f *messageFilter) usesFTS() bool {
+	return len(f.Terms) > 0 || len(f.Excluded) > 0
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// chatsIn returns the condition that column is one of the chat JIDs, with its params
+func chatsIn(column string, jids []string) (string, []interface{}) {
+	params := make([]interface{}, len(jids))
+	for i, jid := range jids {
+		params[i] = jid
+	}
+	return column + " IN (?" + strings.Repeat(", ?", len(jids)-1) + ")", params
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSchema is the part of the bridge's messages.db schema the server reads
+const testSchema = `
+	CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at TIMESTAMP NOT NULL);
+	CREATE TABLE chats (jid TEXT PRIMARY KEY, name TEXT, last_message_time TIMESTAMP);
+	CREATE TABLE messages (
+		id TEXT, chat_jid TEXT, sender TEXT, content TEXT, timestamp TIMESTAMP, is_from_me BOOLEAN,
+		media_type TEXT, filename TEXT, url TEXT, mimetype TEXT, file_length INTEGER,
+		width INTEGER, height INTEGER, duration INTEGER, caption TEXT, reply_to_id TEXT,
+		PRIMARY KEY (id, chat_jid)
+	);
+	CREATE TABLE message_reactions (
+		message_id TEXT NOT NULL, chat_jid TEXT NOT NULL, sender TEXT NOT NULL, is_from_me BOOLEAN NOT NULL,
+		emoji TEXT NOT NULL, timestamp TIMESTAMP NOT NULL, PRIMARY KEY (message_id, chat_jid, sender)
+	);
+`
+
+// openTestDB creates an empty messages.db in a temporary directory, running the statements
+// after the schema
+func openTestDB(t *testing.T, statements ...string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, statement := range append([]string{testSchema}, statements...) {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return db
+}
+
+// testNow is a Wednesday afternoon
+var testNow = time.Date(2026, 3, 4, 15, 0, 0, 0, time.UTC)
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestTokenizeSearchQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []searchToken
+	}{
+		{`deploy friday`, []searchToken{{value: "deploy"}, {value: "friday"}}},
+		{`"release notes"  -draft`, []searchToken{{value: "release notes"}, {value: "draft", negated: true}}},
+		{`-"do not merge"`, []searchToken{{value: "do not merge", negated: true}}},
+		{`From:alice IN:"Project X"`, []searchToken{{operator: "from", value: "alice"}, {operator: "in", value: "Project X"}}},
+		{`-from:bob`, []searchToken{{operator: "from", value: "bob", negated: true}}},
+		{`note:this`, []searchToken{{value: "note:this"}}},
+		{`https://example.com/a:b?x=1`, []searchToken{{value: "https://example.com/a:b?x=1"}}},
+		{`has:`, []searchToken{{operator: "has"}}},
+		{`a - b`, []searchToken{{value: "a"}, {value: "-"}, {value: "b"}}},
+		{`""`, nil},
+		{``, nil},
+	}
+	for _, test := range tests {
+		got, err := tokenizeSearchQuery(test.q)
+		if err != nil {
+			t.Errorf("tokenizeSearchQuery(%q): %v", test.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeSearchQuery(%q) = %+v, want %+v", test.q, got, test.want)
+		}
+	}
+
+	for _, q := range []string{`"unterminated`, `from:"Alice`, `ok "then not`} {
+		if _, err := tokenizeSearchQuery(q); err == nil || !strings.Contains(err.Error(), "unterminated quote") {
+			t.Errorf("tokenizeSearchQuery(%q) error = %v, want an unterminated quote", q, err)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want searchQuery
+	}{
+		{`deploy "release notes" -draft -"do not"`, searchQuery{
+			Terms:    []string{"deploy", "release notes"},
+			Excluded: []string{"draft", "do not"},
+		}},
+		{`from:alice in:"Project X" has:image is:reply`, searchQuery{
+			From: []string{"alice"},
+			In:   []string{"Project X"},
+			Has:  []string{"image"},
+			Is:   []string{"reply"},
+		}},
+		{`from:alice from:me in:ops in:dev has:image has:LINK is:from-me is:group`, searchQuery{
+			From: []string{"alice", "me"},
+			In:   []string{"ops", "dev"},
+			Has:  []string{"image", "link"},
+			Is:   []string{"from_me", "group"},
+		}},
+		{`status:done see https://example.com/x`, searchQuery{
+			Terms: []string{"status:done", "see", "https://example.com/x"},
+		}},
+		{`after:2026-03-01`, searchQuery{
+			After: timePtr(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)),
+		}},
+		{`before:2026-03-01`, searchQuery{
+			Before: timePtr(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)),
+		}},
+		{`during:yesterday`, searchQuery{
+			After:  timePtr(time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)),
+			Before: timePtr(time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC)),
+		}},
+		{`after:"3 days ago" in:ops`, searchQuery{
+			In:    []string{"ops"},
+			After: timePtr(time.Date(2026, 3, 1, 15, 0, 0, 0, time.UTC)),
+		}},
+		// Repeated dates narrow the window
+		{`after:2026-02-01 after:2026-03-01 before:2026-03-10 before:"2026-03-05"`, searchQuery{
+			After:  timePtr(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)),
+			Before: timePtr(time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)),
+		}},
+	}
+	for _, test := range tests {
+		got, err := parseSearchQuery(test.q, testNow)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q): %v", test.q, err)
+			continue
+		}
+		if wantDates := strings.Count(test.q, "after:") + strings.Count(test.q, "before:") + strings.Count(test.q, "during:"); len(got.Dates) != wantDates {
+			t.Errorf("parseSearchQuery(%q) explains %d dates, want %d: %v", test.q, len(got.Dates), wantDates, got.Dates)
+		}
+		if !equalTimes(got.After, test.want.After) || !equalTimes(got.Before, test.want.Before) {
+			t.Errorf("parseSearchQuery(%q) window = %v to %v, want %v to %v", test.q, got.After, got.Before, test.want.After, test.want.Before)
+		}
+		got.Dates, got.After, got.Before = nil, nil, nil
+		test.want.After, test.want.Before = nil, nil
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", test.q, *got, test.want)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{`"unterminated phrase`, "unterminated quote"},
+		{`has:gif`, "has:gif is not supported"},
+		{`is:starred`, "is:starred is not supported"},
+		{`-from:alice`, "-from: is not supported"},
+		{`from:`, "from: needs a value"},
+		{`after:someday`, "after: can't read"},
+		{`during:"3 hours ago"`, "is an exact time"},
+		{`after:2026-03-05 before:2026-03-01`, "the time window is empty"},
+		{`during:today before:yesterday`, "the time window is empty"},
+	}
+	for _, test := range tests {
+		_, err := parseSearchQuery(test.q, testNow)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseSearchQuery(%q) error = %v, want %q", test.q, err, test.want)
+		}
+	}
+}
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := map[string]string{
+		"+31 6 1234 5678": "31612345678",
+		"(020) 555-1234":  "0205551234",
+		"12345":           "12345",
+		"2024":            "",
+		"12a45":           "",
+		"Alice":           "",
+		"":                "",
+	}
+	for value, want := range tests {
+		if got := normalizePhoneNumber(value); got != want {
+			t.Errorf("normalizePhoneNumber(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestResolveMessageFilter(t *testing.T) {
+	db := openTestDB(t, `
+		INSERT INTO chats (jid, name) VALUES
+			('31611111111@s.whatsapp.net', 'Alice'),
+			('31622222222@s.whatsapp.net', 'Alicia'),
+			('proj@g.us', 'Project X'),
+			('year@g.us', '2024'),
+			('numbers@g.us', '112233');
+	`)
+
+	tests := []struct {
+		q    string
+		want messageFilter
+	}{
+		{`from:me`, messageFilter{FromMe: boolPtr(true)}},
+		{`from:Alice`, messageFilter{Senders: [][]string{{"31611111111@s.whatsapp.net", "31611111111"}}}},
+		{`from:"+31 6 3333 3333"`, messageFilter{Senders: [][]string{{"31633333333@s.whatsapp.net", "31633333333"}}}},
+		{`in:"project x"`, messageFilter{ChatJIDs: []string{"proj@g.us"}}},
+		{`in:"Project X (proj@g.us)"`, messageFilter{ChatJIDs: []string{"proj@g.us"}}},
+		{`in:2024`, messageFilter{ChatJIDs: []string{"year@g.us"}}},
+		// A chat named like a phone number is found by its name
+		{`in:112233`, messageFilter{ChatJIDs: []string{"numbers@g.us"}}},
+		{`in:445566`, messageFilter{ChatJIDs: []string{"445566@s.whatsapp.net"}}},
+		{`has:image has:video has:media has:link`, messageFilter{MediaTypes: []string{"image", "video"}, HasMedia: true, HasLink: true}},
+		{`is:to_me is:reply is:direct`, messageFilter{FromMe: boolPtr(false), IsReply: true, IsGroup: boolPtr(false)}},
+		{`deploy -draft`, messageFilter{Terms: []string{"deploy"}, Excluded: []string{"draft"}}},
+	}
+	for _, test := range tests {
+		query, err := parseSearchQuery(test.q, testNow)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", test.q, err)
+		}
+		got, err := resolveMessageFilter(db, query)
+		if err != nil {
+			t.Errorf("resolveMessageFilter(%q): %v", test.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("resolveMessageFilter(%q) = %+v, want %+v", test.q, *got, test.want)
+		}
+	}
+
+	for q, want := range map[string]string{
+		`in:nobody`:            `no chat named "nobody"`,
+		`from:ali`:             "matches several contacts",
+		`from:me from:Alice`:   "can't be combined",
+		`from:me is:to_me`:     "contradict each other",
+		`is:group is:direct`:   "contradict each other",
+		`from:"Project X"`:     `no contact named "Project X"`,
+		`in:"Project Y (x y)"`: `no chat named "Project Y (x y)"`,
+	} {
+		query, err := parseSearchQuery(q, testNow)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", q, err)
+		}
+		if _, err := resolveMessageFilter(db, query); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("resolveMessageFilter(%q) error = %v, want %q", q, err, want)
+		}
+	}
+}
+
+func TestResolveMessageFilterWithin(t *testing.T) {
+	db := openTestDB(t, `
+		INSERT INTO chats (jid, name) VALUES
+			('31611111111@s.whatsapp.net', 'Alice'),
+			('31622222222@s.whatsapp.net', 'Alicia'),
+			('proj@g.us', 'Project X'),
+			('numbers@g.us', '112233');
+	`)
+	within := []string{"31611111111@s.whatsapp.net", "proj@g.us"}
+
+	// Names only match the chats the client may access, so ambiguity between an allowed
+	// and another chat doesn't come up
+	for q, want := range map[string]messageFilter{
+		`from:ali`:   {Senders: [][]string{{"31611111111@s.whatsapp.net", "31611111111"}}},
+		`in:project`: {ChatJIDs: []string{"proj@g.us"}},
+	} {
+		query, err := parseSearchQuery(q, testNow)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", q, err)
+		}
+		query.Within = within
+		got, err := resolveMessageFilter(db, query)
+		if err != nil {
+			t.Errorf("resolveMessageFilter(%q): %v", q, err)
+			continue
+		}
+		want.Within = within
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("resolveMessageFilter(%q) = %+v, want %+v", q, *got, want)
+		}
+	}
+
+	// Other chats are reported as missing, without naming them
+	for q, want := range map[string]string{
+		`from:alicia`: `no contact named "alicia"`,
+		`in:alicia`:   `no chat named "alicia"`,
+	} {
+		query, err := parseSearchQuery(q, testNow)
+		if err != nil {
+			t.Fatalf("parseSearchQuery(%q): %v", q, err)
+		}
+		query.Within = within
+		_, err = resolveMessageFilter(db, query)
+		if err == nil || !strings.Contains(err.Error(), want) || strings.Contains(err.Error(), "@") {
+			t.Errorf("resolveMessageFilter(%q) error = %v, want %q", q, err, want)
+		}
+	}
+
+	// A chat named like a phone number is only found by name if it is allowed
+	jid, err := resolveChat(db, "112233", within)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jid != "112233@s.whatsapp.net" {
+		t.Errorf("resolveChat of another chat's name = %s, want the number read as a phone number", jid)
+	}
+}
+
+func TestHasLinkMatchesHTTPAndHTTPS(t *testing.T) {
+	db := openTestDB(t, `
+		INSERT INTO messages (id, chat_jid, content, caption) VALUES
+			('content-http', 'c', 'see http://example.com', NULL),
+			('content-https', 'c', 'see https://example.com', NULL),
+			('caption-http', 'c', '', 'photo from http://example.com'),
+			('caption-https', 'c', '', 'photo from https://example.com'),
+			('no-link', 'c', 'http is a protocol', 'no link here');
+	`)
+
+	filter := &messageFilter{HasLink: true}
+	clauses, params := filter.whereClauses(false)
+	rows, err := db.Query("SELECT id FROM messages WHERE "+strings.Join(clauses, " AND "), params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id)
+	}
+	sort.Strings(got)
+	want := []string{"caption-http", "caption-https", "content-http", "content-https"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("has:link matched %v, want %v", got, want)
+	}
+}
+
+// equalTimes reports whether two optional times are both unset or the same instant
+func equalTimes(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// resourceChatsLimit is how many of the most recently active chats whatsapp://chats lists
+const resourceChatsLimit = 100
+
+// Resources and resource templates. JIDs contain "@", so they are matched as reserved
+// strings ({+jid}), which also lets the chat template match the URIs of the chat's messages.
+var (
+	chatsResource = mcp.NewResource("whatsapp://chats", "WhatsApp chats",
+		mcp.WithResourceDescription(fmt.Sprintf("The %d most recently active chats with their last message, as JSON", resourceChatsLimit)),
+		mcp.WithMIMEType("application/json"),
+	)
+	chatResourceTemplate = mcp.NewResourceTemplate("whatsapp://chat/{+jid}", "WhatsApp chat",
+		mcp.WithTemplateDescription("A chat's metadata and last message, as JSON"),
+		mcp.WithTemplateMIMEType("application/json"),
+	)
+	chatMessagesResourceTemplate = mcp.NewResourceTemplate("whatsapp://chat/{+jid}/messages{?since,cursor}", "WhatsApp chat messages",
+		mcp.WithTemplateDescription("A chat's messages as a transcript, since a date or time in the same formats as list_messages (default the past 24 hours). Long transcripts end with the URI of the next chunk."),
+		mcp.WithTemplateMIMEType("text/plain"),
+	)
+	messageResourceTemplate = mcp.NewResourceTemplate("whatsapp://message/{+chat}/{id}", "WhatsApp message",
+		mcp.WithTemplateDescription("One message with its sender, media, the message it replies to and reactions, as JSON"),
+		mcp.WithTemplateMIMEType("application/json"),
+	)
+	mediaResourceTemplate = mcp.NewResourceTemplate("whatsapp://media/{+chat}/{id}", "WhatsApp media",
+		mcp.WithTemplateDescription("The image, video, audio or document of a message, downloaded through the bridge"),
+	)
+)
+
+// registerResources adds the chats, messages and media of the database as resources
+func registerResources(s *server.MCPServer) {
+	s.AddResource(chatsResource, readChatsResource)
+	s.AddResourceTemplate(chatResourceTemplate, readChatResource)
+	s.AddResourceTemplate(chatMessagesResourceTemplate, readChatMessagesResource)
+	s.AddResourceTemplate(messageResourceTemplate, readMessageResource)
+	s.AddResourceTemplate(mediaResourceTemplate, readMediaResource)
+}
+
+// chatMessagesResource lists the recent messages of a chat as a resource of its own, so
+// clients can offer the chat for attaching
+func chatMessagesResource(jid, name string) server.ServerResource {
+	if name == "" {
+		name = jid
+	}
+	resource := mcp.NewResource(fmt.Sprintf("whatsapp://chat/%s/messages", jid), name,
+		mcp.WithResourceDescription(fmt.Sprintf("Messages of the past 24 hours in %s", name)),
+		mcp.WithMIMEType("text/plain"),
+	)
+	return server.ServerResource{
+		Resource: resource,
+		Handler: func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+			request.Params.Arguments = map[string]any{"jid": jid}
+			return readChatMessagesResource(ctx, request)
+		},
+	}
+}
+
+// resourceArgument returns a variable of the template a resource URI matched, or "" if the
+// URI doesn't set it
+func resourceArgument(request mcp.ReadResourceRequest, name string) string {
+	switch value := request.Params.Arguments[name].(type) {
+	case []string:
+		if len(value) > 0 {
+			return value[0]
+		}
+	case string:
+		return value
+	}
+	return ""
+}
+
+// resourceChatJID returns the JID of the chat a resource URI belongs to, or "" if it doesn't
+// belong to one chat
+func resourceChatJID(uri string) string {
+	// The chat template also matches the URIs of the chat's messages, so it comes after them
+	for _, template := range []mcp.ResourceTemplate{chatMessagesResourceTemplate, chatResourceTemplate, messageResourceTemplate, mediaResourceTemplate} {
+		if vars := template.URITemplate.Match(uri); vars != nil {
+			if jid := vars.Get("jid").String(); jid != "" {
+				return jid
+			}
+			return vars.Get("chat").String()
+		}
+	}
+	return ""
+}
+
+// jsonResource returns value as the JSON content of a resource
+func jsonResource(uri string, value interface{}) ([]mcp.ResourceContents, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("JSON marshal error: %v", err)
+	}
+	return []mcp.ResourceContents{mcp.TextResourceContents{URI: uri, MIMEType: "application/json", Text: string(content)}}, nil
+}
+
+func readChatsResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+
+	chats, _, err := listChats(nil, resourceChatsLimit, 0, nil, true, "last_active", clientFromContext(ctx).allowedChats())
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	for i := range chats {
+		display.chat(&chats[i])
+	}
+	return jsonResource(request.Params.URI, chatsResult{Chats: chats})
+}
+
+func readChatResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	if vars := chatMessagesResourceTemplate.URITemplate.Match(request.Params.URI); vars != nil {
+		request.Params.Arguments = map[string]any{}
+		for name, value := range vars {
+			request.Params.Arguments[name] = value.V
+		}
+		return readChatMessagesResource(ctx, request)
+	}
+
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+
+	jid := resourceArgument(request, "jid")
+	chat, err := getChat(jid, true)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if chat == nil {
+		return nil, fmt.Errorf("no chat %s", jid)
+	}
+	display.chat(chat)
+	return jsonResource(request.Params.URI, chat)
+}
+
+func readChatMessagesResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+
+	jid := resourceArgument(request, "jid")
+	chat, err := getChat(jid, false)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if chat == nil {
+		return nil, fmt.Errorf("no chat %s", jid)
+	}
+
+	start, err := decodeCursor(resourceArgument(request, "cursor"), cursorConversation)
+	if err != nil {
+		return nil, err
+	}
+	if start != nil && (start.Backward || start.ChatJID != chat.JID) {
+		return nil, fmt.Errorf("the cursor belongs to another chat")
+	}
+
+	window := &searchQuery{}
+	if since := resourceArgument(request, "since"); since != "" {
+		if err := window.addDateFilter("after", since, display.now); err != nil {
+			return nil, fmt.Errorf("invalid 'since': %v", err)
+		}
+	} else if start == nil {
+		window.addDateFilter("after", defaultConversationWindow, display.now)
+	}
+
+	chunk, err := getConversation(chat.JID, window.After, nil, start, newOutputBudget(defaultMaxChars), display)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	chunk.result.Dates = window.Dates
+
+	text := formatConversation(chunk, chatTitle(chat), func(cursor string) string {
+		return fmt.Sprintf("read whatsapp://chat/%s/messages?cursor=%s", chat.JID, cursor)
+	}, display)
+	return []mcp.ResourceContents{mcp.TextResourceContents{URI: request.Params.URI, MIMEType: "text/plain", Text: text}}, nil
+}
+
+func readMessageResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	display, err := newTimeDisplay("")
+	if err != nil {
+		return nil, err
+	}
+
+	chatJID, messageID := resourceArgument(request, "chat"), resourceArgument(request, "id")
+	message, err := getMessage(chatJID, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if message == nil {
+		return nil, fmt.Errorf("no message %s in chat %s", messageID, chatJID)
+	}
+
+	result, err := buildMessagesResult(matchesOnly([]Message{*message}), display)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResource(request.Params.URI, result.Messages[0].messageOutput)
+}
+
+func readMediaResource(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	chatJID, messageID := resourceArgument(request, "chat"), resourceArgument(request, "id")
+	path := downloadMedia(messageID, chatJID)
+	if path == "" {
+		return nil, fmt.Errorf("failed to download the media of message %s in chat %s", messageID, chatJID)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media file: %v", err)
+	}
+	if len(data) > maxInlineMediaBytes {
+		return nil, fmt.Errorf("media file is too large to return (%d bytes, limit %d), it is saved at %s", len(data), maxInlineMediaBytes, path)
+	}
+
+	mimeType := detectMediaMimeType(path, data)
+	if strings.HasPrefix(mimeType, "text/") {
+		return []mcp.ResourceContents{mcp.TextResourceContents{URI: request.Params.URI, MIMEType: mimeType, Text: string(data)}}, nil
+	}
+	return []mcp.ResourceContents{mcp.BlobResourceContents{URI: request.Params.URI, MIMEType: mimeType, Blob: base64.StdEncoding.EncodeToString(data)}}, nil
+}
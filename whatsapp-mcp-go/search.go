@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// searchMessages runs a full-text query against the FTS5 index the bridge maintains and
+// returns the matches ranked by relevance, with the matching terms highlighted.
+// If this build or the database has no FTS5 support it falls back to substring matching.
+func searchMessages(query string, chatJID *string, limit, offset int) ([]Message, []string, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	messages, err := searchMessagesFTS(db, query, chatJID, limit, offset)
+	if err != nil && isFTSSyntaxError(err) {
+		// Plain text such as "don't" or "3.5" isn't valid FTS5 syntax, search for the words instead
+		messages, err = searchMessagesFTS(db, quoteFTSTerms(query), chatJID, limit, offset)
+	}
+	if err != nil && isFTSUnavailableError(err) {
+		messages, err = searchMessagesLike(db, query, chatJID, limit, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		return messages, []string{"Note: full-text search is unavailable (build the bridge and this server with -tags sqlite_fts5), showing unranked substring matches."}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return messages, nil, nil
+}
+
+// searchMessagesFTS returns messages matching an FTS5 query, best match first
+func searchMessagesFTS(db *sql.DB, query string, chatJID *string, limit, offset int) ([]Message, error) {
+	sqlQuery := `
+		SELECT messages.timestamp, messages.sender, chats.name,
+			snippet(messages_fts, -1, '**', '**', '…', 16),
+			messages.is_from_me, chats.jid, messages.id, messages.media_type
+		FROM messages_fts
+		JOIN messages ON messages.rowid = messages_fts.rowid
+		JOIN chats ON messages.chat_jid = chats.jid
+		WHERE messages_fts MATCH ?`
+	params := []interface{}{query}
+
+	if chatJID != nil {
+		sqlQuery += " AND messages.chat_jid = ?"
+		params = append(params, *chatJID)
+	}
+
+	sqlQuery += " ORDER BY bm25(messages_fts), messages.timestamp DESC LIMIT ? OFFSET ?"
+	params = append(params, limit, offset)
+
+	return querySearchResults(db, sqlQuery, params...)
+}
+
+// searchMessagesLike is the fallback when FTS5 is unavailable
+func searchMessagesLike(db *sql.DB, query string, chatJID *string, limit, offset int) ([]Message, error) {
+	sqlQuery := `
+		SELECT messages.timestamp, messages.sender, chats.name,
+			COALESCE(NULLIF(messages.content, ''), NULLIF(messages.caption, ''), messages.filename, ''),
+			messages.is_from_me, chats.jid, messages.id, messages.media_type
+		FROM messages
+		JOIN chats ON messages.chat_jid = chats.jid
+		WHERE (LOWER(messages.content) LIKE LOWER(?) OR LOWER(messages.caption) LIKE LOWER(?) OR LOWER(messages.filename) LIKE LOWER(?))`
+	pattern := "%" + query + "%"
+	params := []interface{}{pattern, pattern, pattern}
+
+	if chatJID != nil {
+		sqlQuery += " AND messages.chat_jid = ?"
+		params = append(params, *chatJID)
+	}
+
+	sqlQuery += " ORDER BY messages.timestamp DESC LIMIT ? OFFSET ?"
+	params = append(params, limit, offset)
+
+	return querySearchResults(db, sqlQuery, params...)
+}
+
+// querySearchResults scans search result rows into messages
+func querySearchResults(db *sql.DB, query string, params ...interface{}) ([]Message, error) {
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var timestampStr string
+		var chatName, content, mediaType sql.NullString
+
+		if err := rows.Scan(&timestampStr, &msg.Sender, &chatName, &content, &msg.IsFromMe, &msg.ChatJID, &msg.ID, &mediaType); err != nil {
+			return nil, err
+		}
+
+		msg.Timestamp, err = time.Parse(time.RFC3339, timestampStr)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Content = content.String
+		if chatName.Valid {
+			msg.ChatName = &chatName.String
+		}
+		if mediaType.Valid {
+			msg.MediaType = &mediaType.String
+		}
+
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// isFTSSyntaxError reports whether SQLite rejected the search query itself
+func isFTSSyntaxError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "fts5: syntax error") || strings.Contains(msg, "no such column")
+}
+
+// isFTSUnavailableError reports whether the FTS5 module or index is missing
+func isFTSUnavailableError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "no such module: fts5") || strings.Contains(msg, "no such table: messages_fts")
+}
+
+// quoteFTSTerms turns free text into an FTS5 query matching all of its words
+func quoteFTSTerms(query string) string {
+	return strings.Join(quoteFTSPhrases(strings.Fields(query)), " ")
+}
+
+// quoteFTSPhrases quotes each value as an FTS5 phrase so it is matched literally
+func quoteFTSPhrases(values []string) []string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+	}
+	return quoted
+}
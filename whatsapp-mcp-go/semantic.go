@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// rrfK dampens how much the top ranks of either result list dominate the fused ranking
+const rrfK = 60
+
+// hybridSearch finds messages by meaning through the bridge's semantic index and by
+// keywords through the FTS5 index, and merges both rankings with reciprocal rank fusion.
+// If the bridge has no semantic index or isn't running it returns keyword matches only.
+func hybridSearch(query string, chatJID *string, limit, offset int) ([]Message, []string, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	// Both rankings need enough depth to fill the requested results after merging
+	depth := (offset + limit) * 2
+
+	var notes []string
+	jid := ""
+	if chatJID != nil {
+		jid = *chatJID
+	}
+	semantic, err := semanticSearch(query, jid, depth)
+	if err != nil {
+		notes = append(notes, fmt.Sprintf("Note: semantic search is unavailable (%v), showing keyword matches only.", err))
+	} else if !semantic.CaughtUp {
+		notes = append(notes, fmt.Sprintf("Note: the semantic index is still being built (%d messages so far), older messages may be missing.", semantic.Indexed))
+	}
+
+	// Any of the words may match, the fused ranking puts messages matching more of them first
+	keyword, err := searchMessagesFTS(db, strings.Join(quoteFTSPhrases(strings.Fields(query)), " OR "), chatJID, depth, 0)
+	if err != nil && isFTSUnavailableError(err) {
+		keyword, err = searchMessagesLike(db, query, chatJID, depth, 0)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scores := make(map[string]float64)
+	byKey := make(map[string]Message)
+	for rank, msg := range keyword {
+		key := msg.ChatJID + "/" + msg.ID
+		scores[key] += 1.0 / float64(rrfK+rank+1)
+		byKey[key] = msg
+	}
+	var missing []SemanticSearchHit
+	if semantic != nil {
+		for rank, hit := range semantic.Hits {
+			key := hit.ChatJID + "/" + hit.MessageID
+			scores[key] += 1.0 / float64(rrfK+rank+1)
+			if _, ok := byKey[key]; !ok {
+				missing = append(missing, hit)
+			}
+		}
+	}
+
+	semanticOnly, err := loadMessagesByID(db, missing)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, msg := range semanticOnly {
+		byKey[msg.ChatJID+"/"+msg.ID] = msg
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return byKey[keys[i]].Timestamp.After(byKey[keys[j]].Timestamp)
+	})
+
+	var messages []Message
+	for i := offset; i < len(keys) && i < offset+limit; i++ {
+		messages = append(messages, byKey[keys[i]])
+	}
+	return messages, notes, nil
+}
+
+// loadMessagesByID loads the messages behind semantic search hits
+func loadMessagesByID(db *sql.DB, hits []SemanticSearchHit) ([]Message, error) {
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	conditions := make([]string, len(hits))
+	params := make([]interface{}, 0, 2*len(hits))
+	for i, hit := range hits {
+		conditions[i] = "(messages.id = ? AND messages.chat_jid = ?)"
+		params = append(params, hit.MessageID, hit.ChatJID)
+	}
+
+	sqlQuery := `
+		SELECT messages.timestamp, messages.sender, chats.name,
+			COALESCE(NULLIF(messages.content, ''), NULLIF(messages.caption, ''), messages.filename, ''),
+			messages.is_from_me, chats.jid, messages.id, messages.media_type
+		FROM messages
+		JOIN chats ON messages.chat_jid = chats.jid
+		WHERE ` + strings.Join(conditions, " OR ")
+
+	return querySearchResults(db, sqlQuery, params...)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// timeDisplay shows the timestamps in a tool result in one timezone, together with how long
+// ago they were. The bridge stores all times in UTC.
+type timeDisplay struct {
+	location *time.Location
+	now      time.Time
+}
+
+// timezoneParam lets a single call use another timezone than the configured one
+var timezoneParam = mcp.WithString("timezone", mcp.Description("Optional IANA timezone to show times and read dates in, e.g. \"America/New_York\" (default: the server's configured timezone)"))
+
+// newTimeDisplay returns a display for the named timezone, or the configured one if name is empty
+func newTimeDisplay(name string) (timeDisplay, error) {
+	location := userLocation
+	if name != "" {
+		var err error
+		if location, err = time.LoadLocation(name); err != nil {
+			return timeDisplay{}, fmt.Errorf("invalid timezone %q, use an IANA name such as \"Europe/Amsterdam\"", name)
+		}
+	}
+	return timeDisplay{location: location, now: time.Now().In(location)}, nil
+}
+
+// timestamp formats t as "2026-03-01 14:05:09 CET, 2h ago"
+func (d timeDisplay) timestamp(t time.Time) string {
+	return t.In(d.location).Format("2006-01-02 15:04:05 MST") + ", " + d.ago(t)
+}
+
+// ago describes how long before now t was, e.g. "just now", "5m ago", "3d ago" or "2y ago"
+func (d timeDisplay) ago(t time.Time) string {
+	elapsed := d.now.Sub(t)
+	suffix := " ago"
+	if elapsed < 0 {
+		elapsed = -elapsed
+		suffix = " from now"
+	}
+
+	days := int(elapsed.Hours() / 24)
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm%s", int(elapsed.Minutes()), suffix)
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%dh%s", int(elapsed.Hours()), suffix)
+	case days < 14:
+		return fmt.Sprintf("%dd%s", days, suffix)
+	case days < 60:
+		return fmt.Sprintf("%dw%s", days/7, suffix)
+	case days < 365:
+		return fmt.Sprintf("%dmo%s", days/30, suffix)
+	default:
+		return fmt.Sprintf("%dy%s", days/365, suffix)
+	}
+}
+
+// day names the day t falls on, to separate days in transcripts
+func (d timeDisplay) day(t time.Time) string {
+	return t.In(d.location).Format("Monday 2 January 2006")
+}
+
+// chat converts a chat's last message time for JSON output
+func (d timeDisplay) chat(chat *Chat) {
+	if chat.LastMessageTime != nil {
+		t := chat.LastMessageTime.In(d.location)
+		chat.LastMessageTime = &t
+		chat.LastMessageAgo = d.ago(t)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Transports clients can connect over
+const (
+	transportStdio = "stdio" // one client that started the server as a child process
+	transportSSE   = "sse"   // the HTTP+SSE transport of the 2024-11-05 protocol, for older clients
+	transportHTTP  = "http"  // the streamable HTTP transport
+)
+
+// Settings of the HTTP transports
+const (
+	defaultListenAddr = "localhost:8081"
+	keepAliveInterval = 30 * time.Second // keeps idle event streams open through proxies
+	shutdownTimeout   = 10 * time.Second // how long open requests get to finish on shutdown
+)
+
+// serve runs the MCP server over the transport until the client disconnects (stdio), the
+// server fails or ctx is done. On the HTTP transports every client gets a session of its own,
+// and requests still running when ctx is done are cancelled before the server shuts down.
+// Clients of the HTTP transports must authenticate if auth is set, which it must be unless
+// the server only listens on the loopback interface.
+func serve(ctx context.Context, s *server.MCPServer, transport, addr string, auth *authenticator) error {
+	if transport == transportStdio {
+		if auth != nil {
+			return fmt.Errorf("-auth only applies to the %s and %s transports", transportSSE, transportHTTP)
+		}
+		err := server.NewStdioServer(s).Listen(ctx, os.Stdin, os.Stdout)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	}
+	if auth == nil && !isLoopback(addr) {
+		return fmt.Errorf("anyone who can reach %s could read every chat, pass -auth or listen on localhost", addr)
+	}
+	requireAuth := func(handler http.Handler) http.Handler {
+		if auth == nil {
+			return handler
+		}
+		return auth.require(handler)
+	}
+
+	mux := http.NewServeMux()
+	if auth != nil && auth.oauth != nil {
+		// OAuth clients find the authorization server here (RFC 9728)
+		mux.Handle(server.ProtectedResourceMetadataPath(auth.oauth.Resource), server.NewProtectedResourceMetadataHandler(auth.metadata()))
+	}
+	httpServer := &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	var start func() error
+	var shutdown func(context.Context) error
+	switch transport {
+	case transportSSE:
+		sseServer := server.NewSSEServer(s,
+			server.WithHTTPServer(httpServer),
+			server.WithKeepAliveInterval(keepAliveInterval),
+		)
+		mux.Handle("/", requireAuth(sseServer))
+		start = func() error { return sseServer.Start(addr) }
+		shutdown = sseServer.Shutdown
+		log.Printf("Serving MCP over SSE at http://%s%s", addr, sseServer.CompleteSsePath())
+	case transportHTTP:
+		streamableServer := server.NewStreamableHTTPServer(s,
+			server.WithStreamableHTTPServer(httpServer),
+			server.WithHeartbeatInterval(keepAliveInterval),
+		)
+		mux.Handle("/mcp", requireAuth(streamableServer))
+		start = func() error { return streamableServer.Start(addr) }
+		shutdown = streamableServer.Shutdown
+		log.Printf("Serving MCP over streamable HTTP at http://%s/mcp", addr)
+	default:
+		return fmt.Errorf("unknown transport %q, use %s, %s or %s", transport, transportStdio, transportSSE, transportHTTP)
+	}
+
+	failed := make(chan error, 1)
+	go func() { failed <- start() }()
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down: %v", err)
+	}
+	if err := <-failed; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limits of wait_for_message
+const (
+	defaultWaitTimeout   = 5 * time.Minute
+	maxWaitTimeout       = time.Hour
+	waitProgressInterval = 5 * time.Second
+)
+
+// waitForMessage returns the first message stored after the call started that matches filter
+// and whose text or caption matches pattern, checking every pollInterval. It returns nil if
+// none arrives within timeout, and ctx's error if the call is cancelled. waiting is called
+// every few seconds with the time waited so far.
+func waitForMessage(ctx context.Context, filter *messageFilter, pattern *regexp.Regexp, timeout time.Duration, waiting func(waited time.Duration)) (*Message, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var lastRowID int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM messages").Scan(&lastRowID); err != nil {
+		return nil, err
+	}
+	filterClauses, filterParams := filter.whereClauses(false)
+	whereClauses := append([]string{"messages.rowid > ?", "messages.rowid <= ?"}, filterClauses...)
+
+	started := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	progress := time.NewTicker(waitProgressInterval)
+	defer progress.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline.C:
+			return nil, nil
+		case <-progress.C:
+			waiting(time.Since(started))
+			continue
+		case <-poll.C:
+		}
+
+		// Messages stored while this check runs are left for the next one
+		var newest int64
+		if err := db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM messages").Scan(&newest); err != nil {
+			return nil, err
+		}
+		if newest <= lastRowID {
+			continue
+		}
+
+		rows, err := db.Query(`
+			SELECT messages.chat_jid, messages.id, COALESCE(messages.content, ''), COALESCE(messages.caption, '')
+			FROM messages
+			WHERE `+strings.Join(whereClauses, " AND ")+`
+			ORDER BY messages.rowid`, append([]interface{}{lastRowID, newest}, filterParams...)...)
+		if err != nil {
+			return nil, err
+		}
+		var chatJID, messageID string
+		found := false
+		for rows.Next() {
+			var content, caption string
+			if err := rows.Scan(&chatJID, &messageID, &content, &caption); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if pattern == nil || pattern.MatchString(content) || pattern.MatchString(caption) {
+				found = true
+				break
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		lastRowID = newest
+
+		if found {
+			message, err := getMessage(chatJID, messageID)
+			if err != nil || message != nil {
+				return message, err
+			}
+		}
+	}
+}
+
+// parseWaitTimeout returns the timeout of a wait in seconds as a duration
+func parseWaitTimeout(seconds float64) (time.Duration, error) {
+	if seconds == 0 {
+		return defaultWaitTimeout, nil
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout < time.Second || timeout > maxWaitTimeout {
+		return 0, fmt.Errorf("timeout must be between 1 and %d seconds", int(maxWaitTimeout.Seconds()))
+	}
+	return timeout, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// resourceWatcher polls messages.db for messages the bridge stored since the last poll. It
+// notifies the sessions subscribed to resources of chats with new messages, and lists every
+// chat as a resource so that new chats change the resource list.
+type resourceWatcher struct {
+	server *server.MCPServer
+
+	mu            sync.Mutex
+	subscriptions map[string]map[string]bool // session ID -> subscribed URIs
+
+	// Only used by poll, which runs on one goroutine at a time
+	chats     map[string]bool // JIDs listed as resources
+	lastRowID int64           // the newest message seen
+}
+
+// newResourceWatcher lists the existing chats as resources and starts tracking subscriptions.
+// Messages stored before it was created don't cause notifications.
+func newResourceWatcher(s *server.MCPServer, hooks *server.Hooks) (*resourceWatcher, error) {
+	w := &resourceWatcher{
+		server:        s,
+		subscriptions: make(map[string]map[string]bool),
+		chats:         make(map[string]bool),
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM messages").Scan(&w.lastRowID)
+	db.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.poll(); err != nil {
+		return nil, err
+	}
+
+	hooks.AddAfterSubscribe(func(ctx context.Context, id any, request *mcp.SubscribeRequest, result *mcp.EmptyResult) {
+		// Clients can't learn when chats they may not access change
+		if session := server.ClientSessionFromContext(ctx); session != nil && checkResourceAccess(ctx, request.Params.URI) == nil {
+			w.subscribe(session.SessionID(), request.Params.URI)
+		}
+	})
+	hooks.AddAfterUnsubscribe(func(ctx context.Context, id any, request *mcp.UnsubscribeRequest, result *mcp.EmptyResult) {
+		if session := server.ClientSessionFromContext(ctx); session != nil {
+			w.unsubscribe(session.SessionID(), request.Params.URI)
+		}
+	})
+	hooks.AddOnUnregisterSession(func(ctx context.Context, session server.ClientSession) {
+		w.mu.Lock()
+		delete(w.subscriptions, session.SessionID())
+		w.mu.Unlock()
+	})
+	return w, nil
+}
+
+// run polls for new messages every interval until ctx is done
+func (w *resourceWatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.poll(); err != nil {
+				log.Printf("Failed to check for new messages: %v", err)
+			}
+		}
+	}
+}
+
+func (w *resourceWatcher) subscribe(sessionID, uri string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.subscriptions[sessionID] == nil {
+		w.subscriptions[sessionID] = make(map[string]bool)
+	}
+	w.subscriptions[sessionID][uri] = true
+}
+
+func (w *resourceWatcher) unsubscribe(sessionID, uri string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.subscriptions[sessionID], uri)
+}
+
+// poll lists new chats as resources and notifies subscribers of the chats with new messages
+func (w *resourceWatcher) poll() error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	changed, err := w.newMessages(db)
+	if err != nil {
+		return err
+	}
+	if err := w.newChats(db); err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		w.notify(changed)
+	}
+	return nil
+}
+
+// newMessages returns the chats with messages stored since the last poll. The bridge updates
+// messages it stores again in place, which keeps their rowid, so only new messages count.
+func (w *resourceWatcher) newMessages(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT rowid, chat_jid FROM messages WHERE rowid > ? ORDER BY rowid", w.lastRowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changed := make(map[string]bool)
+	for rows.Next() {
+		var chatJID string
+		if err := rows.Scan(&w.lastRowID, &chatJID); err != nil {
+			return nil, err
+		}
+		changed[chatJID] = true
+	}
+	return changed, rows.Err()
+}
+
+// newChats lists the chats that aren't listed yet as resources, which tells clients that
+// the resource list changed
+func (w *resourceWatcher) newChats(db *sql.DB) error {
+	rows, err := db.Query("SELECT jid, name FROM chats")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var resources []server.ServerResource
+	for rows.Next() {
+		var jid string
+		var name sql.NullString
+		if err := rows.Scan(&jid, &name); err != nil {
+			return err
+		}
+		if w.chats[jid] {
+			continue
+		}
+		w.chats[jid] = true
+		resources = append(resources, chatMessagesResource(jid, name.String))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(resources) > 0 {
+		w.server.AddResources(resources...)
+	}
+	return nil
+}
+
+// notify sends a resource update to every session subscribed to a resource that shows
+// messages of the changed chats
+func (w *resourceWatcher) notify(changed map[string]bool) {
+	type update struct{ sessionID, uri string }
+	var updates []update
+	w.mu.Lock()
+	for sessionID, uris := range w.subscriptions {
+		for uri := range uris {
+			if resourceChanged(uri, changed) {
+				updates = append(updates, update{sessionID, uri})
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, u := range updates {
+		err := w.server.SendNotificationToSpecificClient(u.sessionID, mcp.MethodNotificationResourceUpdated, map[string]any{"uri": u.uri})
+		if err != nil {
+			log.Printf("Failed to notify session %s of an update to %s: %v", u.sessionID, u.uri, err)
+		}
+	}
+}
+
+// resourceChanged reports whether new messages in the changed chats change a resource
+func resourceChanged(uri string, changed map[string]bool) bool {
+	if uri == chatsResource.URI {
+		return true
+	}
+	// The chat template also matches the URIs of the chat's messages, so it comes last
+	for _, template := range []mcp.ResourceTemplate{chatMessagesResourceTemplate, chatResourceTemplate} {
+		if vars := template.URITemplate.Match(uri); vars != nil {
+			return changed[vars.Get("jid").String()]
+		}
+	}
+	return false
+}